@@ -0,0 +1,44 @@
+// Command goverlay-signal runs a self-hosted rendezvous server for overlay
+// nodes to find bootstrap peers and exchange WebRTC signals through.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/keepalive"
+	"github.com/matanbroner/goverlay/lib/signal"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	bootstrap := flag.Int("bootstrap", signal.DefaultBootstrapSize, "number of bootstrap peers handed out on connect")
+	pingInterval := flag.Duration("ping-interval", keepalive.DefaultPingInterval, "how often clients are pinged")
+	readTimeout := flag.Duration("read-timeout", keepalive.DefaultReadTimeout, "how long a silent client is kept")
+	acceptUnbound := flag.Bool("accept-unbound", false, "accept messages signed without an id and timestamp, from clients which predate them")
+	flag.Parse()
+
+	signer.SetAcceptUnboundMessages(*acceptUnbound)
+
+	s := signal.New()
+	s.BootstrapSize = *bootstrap
+	s.PingInterval = *pingInterval
+	s.ReadTimeout = *readTimeout
+	bound, err := s.Listen(*addr)
+	if err != nil {
+		fmt.Printf("goverlay-signal listen error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("goverlay-signal listening on %s\n", bound.String())
+
+	interrupt := make(chan os.Signal, 1)
+	ossignal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+	if err := s.Shutdown(); err != nil {
+		fmt.Printf("goverlay-signal shutdown error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"os"
+	"strings"
+)
+
+// PassphraseEnv names the environment variable a key passphrase may be given
+// in, when no passphrase file is.
+const PassphraseEnv = "GOVERLAY_PASSPHRASE"
+
+// identityMain runs the id subcommand, which creates and inspects identity
+// files for nodes to keep their ID across restarts.
+func identityMain(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: goverlay id generate|inspect [flags] <file>")
+	}
+	switch args[0] {
+	case "generate":
+		return generateIdentity(args[1:])
+	case "inspect":
+		return inspectIdentity(args[1:])
+	default:
+		return fmt.Errorf("unknown id command %s, expected generate or inspect", args[0])
+	}
+}
+
+func generateIdentity(args []string) error {
+	flags := flag.NewFlagSet("goverlay id generate", flag.ExitOnError)
+	keyType := flags.String("type", string(id.DefaultKeyType), "key type: rsa, ed25519 or ecdsa-p256")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase to encrypt the key with, instead of $"+PassphraseEnv)
+	force := flags.Bool("force", false, "replace an existing identity file")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: goverlay id generate [flags] <file>")
+	}
+	path := flags.Arg(0)
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to replace the identity in it", path)
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	pkid, err := createIdentity(path, id.KeyType(*keyType), passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", pkid.ID)
+	return nil
+}
+
+func inspectIdentity(args []string) error {
+	flags := flag.NewFlagSet("goverlay id inspect", flag.ExitOnError)
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase the key is encrypted with, instead of $"+PassphraseEnv)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: goverlay id inspect [flags] <file>")
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	pkid, err := id.LoadIdentity(flags.Arg(0), passphrase, "")
+	if err != nil {
+		return err
+	}
+	keyType, err := pkid.KeyType()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("id:        %s\n", pkid.ID)
+	fmt.Printf("type:      %s\n", keyType)
+	if keyType == id.RSA {
+		// the ID peers knew this key by before IDs were canonical
+		legacy, err := id.LegacyIDFromPublicKey(pkid.PrivateKey.Public())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("legacy id: %s\n", legacy)
+	}
+	return nil
+}
+
+// loadIdentity loads the node identity kept at path, creating it on first run.
+// Without a path every run gets a fresh identity.
+func loadIdentity(path string, passphraseFile string) (*id.PublicKeyId, error) {
+	if path == "" {
+		return id.NewPublicKeyId(nil, "")
+	}
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		pkid, err := createIdentity(path, id.DefaultKeyType, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("goverlay created identity %s in %s\n", id.ShortID(pkid.ID), path)
+		return pkid, nil
+	}
+	return id.LoadIdentity(path, passphrase, "")
+}
+
+func createIdentity(path string, keyType id.KeyType, passphrase []byte) (*id.PublicKeyId, error) {
+	key, err := id.GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := id.SaveIdentity(path, pkid, passphrase); err != nil {
+		return nil, err
+	}
+	return pkid, nil
+}
+
+// readPassphrase returns the first line of the passphrase file if there is
+// one, or the passphrase in the environment. An empty passphrase leaves keys
+// unencrypted.
+func readPassphrase(path string) ([]byte, error) {
+	if path == "" {
+		return []byte(os.Getenv(PassphraseEnv)), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("passphrase read error: %s", err.Error())
+	}
+	passphrase := strings.SplitN(string(data), "\n", 2)[0]
+	return []byte(strings.TrimSuffix(passphrase, "\r")), nil
+}
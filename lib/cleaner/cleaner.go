@@ -10,6 +10,7 @@ import (
 	"github.com/pion/webrtc/v3"
 	"math/big"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -20,6 +21,10 @@ type NetworkCleaner struct {
 	Overlay        *overlay.Overlay
 	QueryTime      int
 	CleanupChannel chan struct{}
+
+	lock sync.Mutex
+	// stopped is closed once the cleanup goroutine has returned
+	stopped chan struct{}
 }
 
 func NewNetworkCleaner(o *overlay.Overlay) *NetworkCleaner {
@@ -34,16 +39,14 @@ func (n *NetworkCleaner) Start() {
 	n.SetCleanupInterval()
 }
 
+// Stop ends periodic cleanup, returning once no clean is in progress. It is
+// safe to call more than once.
 func (n *NetworkCleaner) Stop() {
 	n.ClearCleanupInterval()
 }
 
 func (n *NetworkCleaner) Clean() {
-	for _, msg := range n.Overlay.PendingMessages {
-		msg.Data.Proxies = nil
-		n.Overlay.Proxy(msg)
-	}
-	n.Overlay.PendingMessages = nil
+	n.Overlay.RetryPending(time.Now())
 	if !n.Overlay.Status.IsSubordinate {
 		//this.checkFloodAndFingers(true);
 		//this.timeoutConnections();
@@ -51,15 +54,22 @@ func (n *NetworkCleaner) Clean() {
 }
 
 func (n *NetworkCleaner) SetCleanupInterval() {
+	n.ClearCleanupInterval()
 	ticker := time.NewTicker(CleanUpSeconds * time.Second)
-	n.CleanupChannel = make(chan struct{})
+	cleanup := make(chan struct{})
+	stopped := make(chan struct{})
+	n.lock.Lock()
+	n.CleanupChannel = cleanup
+	n.stopped = stopped
+	n.lock.Unlock()
 	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				n.Clean()
-			case <-n.CleanupChannel:
-				ticker.Stop()
+			case <-cleanup:
 				return
 			}
 		}
@@ -67,10 +77,16 @@ func (n *NetworkCleaner) SetCleanupInterval() {
 }
 
 func (n *NetworkCleaner) ClearCleanupInterval() {
-	if n.CleanupChannel != nil {
-		close(n.CleanupChannel)
-	}
+	n.lock.Lock()
+	cleanup := n.CleanupChannel
+	stopped := n.stopped
 	n.CleanupChannel = nil
+	n.stopped = nil
+	n.lock.Unlock()
+	if cleanup != nil {
+		close(cleanup)
+		<-stopped
+	}
 }
 
 func (n *NetworkCleaner) ExpireConnectionIfPending(conn *wrtc.WebRTCConnection) {
@@ -84,7 +100,7 @@ func (n *NetworkCleaner) ExpireConnectionIfPending(conn *wrtc.WebRTCConnection)
 }
 
 func (n *NetworkCleaner) TimeoutConnections() {
-	for _, conn := range n.Overlay.WebRTCWrapper.Connections {
+	for _, conn := range n.Overlay.WebRTCWrapper.Connections() {
 		if conn.IsPending() {
 			n.ExpireConnectionIfPending(conn)
 		} else if conn.PeerConnection.ICEConnectionState() == webrtc.ICEConnectionStateClosed {
@@ -96,50 +112,37 @@ func (n *NetworkCleaner) TimeoutConnections() {
 }
 
 func (n *NetworkCleaner) FingerIsInactive(finger string) bool {
-	return n.Overlay.WebRTCWrapper.GetConnection(finger, nil) == nil
+	return !n.Overlay.IsActive(finger)
 }
 
 func (n *NetworkCleaner) CheckFloodAndFingers(retry bool) error {
 	golden := n.Overlay.GoldenIDs()
-	flood := n.Overlay.Flood
-	fingers := n.Overlay.Fingers
+	flood := n.Overlay.FloodSnapshot()
+	fingers := n.Overlay.FingersSnapshot()
 	// only worry about fingers if flood is full
-	if len(flood) == n.Overlay.MaxFloodSize {
+	if n.Overlay.IsFloodFull() && len(flood) > 0 {
 		distance := id.DirectedDistanceBetweenIDs(flood[0], flood[len(flood)-1])
-		var movingDistance *big.Int
-		movingDistance.Rsh(id.HalfMax, uint(len(fingers)))
+		movingDistance := new(big.Int).Rsh(id.HalfMax, uint(len(fingers)))
 		if distance.Cmp(movingDistance) < 0 {
-			n.Overlay.Fingers = append(fingers, id.PendingID)
-			level := len(n.Overlay.Fingers) - 1
-			n.Overlay.SendToClosest(&message.Message{
-				Data: message.MessageData{
-					Action: message.FindFinger,
-					To:     id.IdealFinger(n.Overlay.ID.ID, level),
-					Value:  []byte(strconv.Itoa(level)),
-				},
-			})
+			level := n.Overlay.AddFinger(id.PendingID)
+			n.findFinger(level)
 		}
 		if len(fingers) > 0 && distance.Cmp(movingDistance) > 0 {
 			// need to remove a finger
-			util.Pop(n.Overlay.Fingers)
+			n.Overlay.RemoveLastFinger()
 		}
 		if retry {
-			inactive := util.Filter(n.Overlay.Fingers, n.FingerIsInactive)
-			for idx := range inactive {
-				n.Overlay.Fingers[idx] = id.PendingID
-				n.Overlay.SendToClosest(&message.Message{
-					Data: message.MessageData{
-						Action: message.FindFinger,
-						To:     id.IdealFinger(n.Overlay.ID.ID, idx),
-						Value:  []byte(strconv.Itoa(idx)),
-					},
-				})
+			for idx, finger := range n.Overlay.FingersSnapshot() {
+				if n.FingerIsInactive(finger) && n.Overlay.SetFinger(idx, id.PendingID) {
+					n.findFinger(idx)
+				}
 			}
 		}
 	} else {
 		// if not at full capacity, no need for fingers
-		n.Overlay.Fingers = nil
+		n.Overlay.ClearFingers()
 	}
+	fingers = n.Overlay.FingersSnapshot()
 	var leftOverConnections []string
 	for _, gid := range golden {
 		if n.Overlay.InFlood(gid) {
@@ -147,12 +150,15 @@ func (n *NetworkCleaner) CheckFloodAndFingers(retry bool) error {
 				return err
 			}
 		} else {
-			if util.Contains(n.Overlay.Fingers, gid) {
+			if util.Contains(fingers, gid) {
 				if err := n.Overlay.WebRTCWrapper.MarkUsed(gid); err != nil {
 					return err
 				}
 			} else {
-				conn := n.Overlay.WebRTCWrapper.ConnectionsMap[gid]
+				conn := n.Overlay.WebRTCWrapper.GetConnection(gid, nil)
+				if conn == nil {
+					continue
+				}
 				if time.Now().Sub(conn.LastUsed) > 60*time.Second {
 					leftOverConnections = append(leftOverConnections, gid)
 				} else {
@@ -163,7 +169,7 @@ func (n *NetworkCleaner) CheckFloodAndFingers(retry bool) error {
 			}
 		}
 	}
-	if len(n.Overlay.Flood) == n.Overlay.MaxFloodSize {
+	if n.Overlay.IsFloodFull() {
 		for _, gid := range leftOverConnections {
 			if err := n.Overlay.WebRTCWrapper.MarkUnused(gid); err != nil {
 				return err
@@ -172,3 +178,14 @@ func (n *NetworkCleaner) CheckFloodAndFingers(retry bool) error {
 	}
 	return nil
 }
+
+// findFinger asks the network for the peer closest to our ideal finger at level.
+func (n *NetworkCleaner) findFinger(level int) {
+	n.Overlay.SendToClosest(&message.Message{
+		Data: message.MessageData{
+			Action: message.FindFinger,
+			To:     id.IdealFinger(n.Overlay.ID.ID, level),
+			Value:  []byte(strconv.Itoa(level)),
+		},
+	})
+}
@@ -1,13 +1,15 @@
 package dht
 
 import (
+	"context"
 	"crypto/sha256"
-	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/matanbroner/goverlay/lib/message"
 	"github.com/matanbroner/goverlay/lib/overlay"
+	"sync"
 )
 
 type DHT struct {
@@ -15,6 +17,8 @@ type DHT struct {
 	Data           map[string]map[string]string
 	Callbacks      map[string]func(map[string]string)
 	MessageCounter int
+
+	lock sync.Mutex
 }
 
 type OverlayListener struct {
@@ -37,14 +41,10 @@ func NewDHT(overlay *overlay.Overlay) *DHT {
 func (d *DHT) Get(key string, cb func(map[string]string)) {
 	hashed := d.HashKey(key)
 	if d.Overlay.InFloodRange(hashed) {
-		if submap, ok := d.Data[key]; !ok {
-			cb(submap)
-		} else {
-			cb(nil)
-		}
+		cb(d.lookup(hashed))
 	} else {
 		msgId := uuid.New().String()
-		d.Callbacks[msgId] = cb
+		d.addCallback(msgId, cb)
 		d.Overlay.SendToClosest(&message.Message{
 			Data: message.MessageData{
 				Action: message.DHTGet,
@@ -57,16 +57,15 @@ func (d *DHT) Get(key string, cb func(map[string]string)) {
 
 func (d *DHT) Put(key string, value string, id string, cb func(map[string]string)) {
 	hashed := d.HashKey(key)
+	d.lock.Lock()
 	d.MessageCounter += 1
+	d.lock.Unlock()
 	if d.Overlay.InFloodRange(hashed) {
-		if _, ok := d.Data[key]; !ok {
-			d.Data[key] = make(map[string]string)
-		}
-		d.Data[key][id] = value
+		d.store(hashed, id, value)
 		cb(nil)
 	} else {
 		msgId := uuid.New().String()
-		d.Callbacks[msgId] = cb
+		d.addCallback(msgId, cb)
 		d.Overlay.SendToClosest(&message.Message{
 			Data: message.MessageData{
 				Action: message.DHTPut,
@@ -79,9 +78,104 @@ func (d *DHT) Put(key string, value string, id string, cb func(map[string]string
 }
 
 func (d *DHT) HashKey(key string) string {
+	// keys live in the same hex space as node IDs so they can be routed on
 	h := sha256.New()
 	h.Write([]byte(key))
-	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Handoff sends every value we store to the peer which will be responsible for
+// its key once we leave, returning when each peer has acknowledged its share
+// (or been reported undeliverable) or when ctx is done. Without any peer there
+// is nothing to hand off to, which is not an error.
+func (d *DHT) Handoff(ctx context.Context) error {
+	batches := make(map[string]map[string]map[string]string)
+	d.lock.Lock()
+	for hashed, submap := range d.Data {
+		peer := d.Overlay.ClosestPeer(hashed)
+		if peer == "" {
+			// alone, there is nobody to keep the data for
+			fmt.Printf("dht no peer to hand off %d keys to\n", len(d.Data))
+			d.lock.Unlock()
+			return nil
+		}
+		if _, ok := batches[peer]; !ok {
+			batches[peer] = make(map[string]map[string]string)
+		}
+		values := make(map[string]string, len(submap))
+		for k, v := range submap {
+			values[k] = v
+		}
+		batches[peer][hashed] = values
+	}
+	d.lock.Unlock()
+
+	acked := make(chan struct{}, len(batches))
+	for peer, batch := range batches {
+		bytes, err := json.Marshal(batch)
+		if err != nil {
+			return fmt.Errorf("dht marshal handoff error: %s", err.Error())
+		}
+		msgId := uuid.New().String()
+		d.addCallback(msgId, func(map[string]string) {
+			acked <- struct{}{}
+		})
+		d.Overlay.SendToClosest(&message.Message{
+			Data: message.MessageData{
+				Action: message.DHTHandoff,
+				Value:  bytes,
+				To:     peer,
+			},
+			ID: msgId,
+		})
+	}
+	for i := 0; i < len(batches); i++ {
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return fmt.Errorf("dht handoff error: %s", ctx.Err().Error())
+		}
+	}
+	return nil
+}
+
+// lookup returns a copy of the values stored under a hashed key, or nil.
+func (d *DHT) lookup(hashed string) map[string]string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	submap, ok := d.Data[hashed]
+	if !ok {
+		return nil
+	}
+	values := make(map[string]string, len(submap))
+	for k, v := range submap {
+		values[k] = v
+	}
+	return values
+}
+
+func (d *DHT) store(hashed string, id string, value string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.Data[hashed]; !ok {
+		d.Data[hashed] = make(map[string]string)
+	}
+	d.Data[hashed][id] = value
+}
+
+func (d *DHT) addCallback(msgId string, cb func(map[string]string)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Callbacks[msgId] = cb
+}
+
+// takeCallback removes and returns the callback waiting on msgId, if any.
+func (d *DHT) takeCallback(msgId string) (func(map[string]string), bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cb, ok := d.Callbacks[msgId]
+	delete(d.Callbacks, msgId)
+	return cb, ok
 }
 
 // OverlayMessageListener Methods
@@ -96,14 +190,32 @@ func (oml *OverlayListener) OnMessage(m *message.Message) {
 	switch m.Data.Action {
 	case message.DHTPut:
 		{
-			submap := oml.DHT.Data[m.Data.To]
-			if submap == nil {
-				submap := make(map[string]string)
-				oml.DHT.Data[m.Data.To] = submap
+			oml.DHT.store(m.Data.To, m.Data.From, string(m.Data.Value))
+			if err := oml.DHT.Overlay.SendMessage(&message.Message{
+				Data: message.MessageData{
+					To:     m.Data.From,
+					Action: message.DHTPutAck,
+				},
+				AckID: m.ID,
+			}); err != nil {
+				fmt.Printf("dht send message error: %s\n", err.Error())
+			}
+		}
+	case message.DHTHandoff:
+		{
+			batch := map[string]map[string]string{}
+			if err := json.Unmarshal(m.Data.Value, &batch); err != nil {
+				fmt.Printf("dht unmarshal handoff error: %s\n", err.Error())
+				return
+			}
+			for hashed, submap := range batch {
+				for id, value := range submap {
+					oml.DHT.store(hashed, id, value)
+				}
 			}
-			submap[m.Data.From] = string(m.Data.Value)
 			if err := oml.DHT.Overlay.SendMessage(&message.Message{
 				Data: message.MessageData{
+					To:     m.Data.From,
 					Action: message.DHTPutAck,
 				},
 				AckID: m.ID,
@@ -111,15 +223,15 @@ func (oml *OverlayListener) OnMessage(m *message.Message) {
 				fmt.Printf("dht send message error: %s\n", err.Error())
 			}
 		}
-	case message.DHTPutAck:
+	case message.DHTPutAck, message.Undeliverable:
 		{
-			if cb, ok := oml.DHT.Callbacks[m.AckID]; ok {
+			if cb, ok := oml.DHT.takeCallback(m.AckID); ok {
 				cb(nil)
 			}
 		}
 	case message.DHTGet:
 		{
-			submap := oml.DHT.Data[m.Data.To]
+			submap := oml.DHT.lookup(m.Data.To)
 			if submap == nil {
 				submap = make(map[string]string)
 			}
@@ -140,7 +252,7 @@ func (oml *OverlayListener) OnMessage(m *message.Message) {
 		}
 	case message.DHTGot:
 		{
-			if cb, ok := oml.DHT.Callbacks[m.AckID]; ok {
+			if cb, ok := oml.DHT.takeCallback(m.AckID); ok {
 				submap := map[string]string{}
 				if err := json.Unmarshal(m.Data.Value, &submap); err != nil {
 					fmt.Printf("dht unmarhsal submap error: %s\n", err.Error())
@@ -1,11 +1,7 @@
 package id
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"crypto"
 	"fmt"
 	"github.com/google/uuid"
 	"strings"
@@ -14,15 +10,22 @@ import (
 
 const bitSize = 4096
 const instanceIDDelimiter = "<>"
+
+// timeFormat is the creation time format of instance IDs, that of
+// Date.toISOString in the JS Woverlay peers. Peers before it wrote the time
+// as Go prints it, in legacyTimeFormat.
 const timeFormat = "2006-01-02T15:04:05.000Z"
+const legacyTimeFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
 
 type PublicKeyId struct {
-	PrivateKey *rsa.PrivateKey
+	PrivateKey crypto.Signer
 	ID         string
 	PublicName string
 	InstanceID *InstanceID
 }
 
+// InstanceID tells apart the instances of an identity, e.g. the same
+// identity running on several devices. ID is the form sent to peers.
 type InstanceID struct {
 	UUID      string
 	CreatedAt time.Time
@@ -31,9 +34,11 @@ type InstanceID struct {
 
 // PublicKeyID Methods
 
-func NewPublicKeyId(key *rsa.PrivateKey, publicName string) (*PublicKeyId, error) {
+// NewPublicKeyId creates an identity from key, which may be an RSA, Ed25519
+// or ECDSA P-256 private key. A key of DefaultKeyType is created if key is nil.
+func NewPublicKeyId(key crypto.Signer, publicName string) (*PublicKeyId, error) {
 	if key == nil {
-		privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
+		privateKey, err := GenerateKey(DefaultKeyType)
 		if err != nil {
 			return nil, err
 		}
@@ -45,48 +50,63 @@ func NewPublicKeyId(key *rsa.PrivateKey, publicName string) (*PublicKeyId, error
 	id := &PublicKeyId{
 		PrivateKey: key,
 	}
-	publicKeyBytes, err := json.Marshal(key.Public())
+	i, err := IDFromPublicKey(key.Public())
 	if err != nil {
 		return nil, err
 	}
-	hash := sha256.Sum256(publicKeyBytes)
-	id.ID = hex.EncodeToString(hash[:])
+	id.ID = i
 	id.PublicName = publicName
 	id.InstanceID = NewInstanceID()
 	return id, nil
 }
 
-func (id *PublicKeyId) MatchesPublicKey(key *rsa.PublicKey) (bool, error) {
-	publicKeyBytes, err := json.Marshal(key)
-	if err != nil {
-		return false, err
-	}
-	hash := sha256.Sum256(publicKeyBytes)
-	return hex.EncodeToString(hash[:]) == id.ID, nil
+// KeyType returns the type of the identity's key.
+func (id *PublicKeyId) KeyType() (KeyType, error) {
+	return KeyTypeOf(id.PrivateKey)
+}
+
+// MatchesPublicKey reports whether key is the key of the identity, see MatchesID.
+func (id *PublicKeyId) MatchesPublicKey(key crypto.PublicKey) (bool, error) {
+	return MatchesID(id.ID, key)
 }
 
 // InstanceID Methods
 
 func NewInstanceID() *InstanceID {
+	// the ID only holds milliseconds, which CreatedAt is cut to so that it
+	// is the same on both ends
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
 	id := &InstanceID{
 		UUID:      uuid.New().String(),
-		CreatedAt: time.Now(),
+		CreatedAt: createdAt,
 	}
-	id.ID = fmt.Sprintf("%s%s%s", id.UUID, instanceIDDelimiter, id.CreatedAt)
+	id.ID = fmt.Sprintf("%s%s%s", id.UUID, instanceIDDelimiter, createdAt.Format(timeFormat))
 	return id
 }
 
+// InstanceIDFromString parses the ID of an instance, returning nil if it is
+// not valid.
 func InstanceIDFromString(id string) *InstanceID {
 	split := strings.Split(id, instanceIDDelimiter)
-	if len(split) != 2 {
+	if len(split) != 2 || split[0] == "" {
 		return nil
 	}
 	parsed, err := time.Parse(timeFormat, split[1])
 	if err != nil {
-		return nil
+		// drop the monotonic clock reading Go prints after the time
+		legacy := strings.SplitN(split[1], " m=", 2)[0]
+		if parsed, err = time.Parse(legacyTimeFormat, legacy); err != nil {
+			return nil
+		}
 	}
 	return &InstanceID{
 		UUID:      split[0],
 		CreatedAt: parsed,
+		ID:        id,
 	}
 }
+
+// Is reports whether i and other are the same instance.
+func (i *InstanceID) Is(other *InstanceID) bool {
+	return i != nil && other != nil && i.UUID == other.UUID
+}
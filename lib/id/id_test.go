@@ -0,0 +1,47 @@
+package id
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestInstanceIDRoundTrip(t *testing.T) {
+	i := NewInstanceID()
+	parsed := InstanceIDFromString(i.ID)
+	if assert.NotNil(t, parsed) {
+		assert.Equal(t, i.ID, parsed.ID)
+		assert.Equal(t, i.UUID, parsed.UUID)
+		assert.True(t, i.CreatedAt.Equal(parsed.CreatedAt))
+		assert.True(t, parsed.Is(i))
+	}
+	assert.False(t, i.Is(NewInstanceID()))
+	assert.False(t, i.Is(nil))
+}
+
+func TestInstanceIDFromString(t *testing.T) {
+	// as the JS peers write them
+	js := InstanceIDFromString("a3f1c2d4-0000-4000-8000-000000000000<>2022-05-01T10:20:30.123Z")
+	if assert.NotNil(t, js) {
+		assert.Equal(t, "a3f1c2d4-0000-4000-8000-000000000000", js.UUID)
+		assert.True(t, js.CreatedAt.Equal(time.Date(2022, 5, 1, 10, 20, 30, 123000000, time.UTC)))
+	}
+	// as older Go peers wrote them, monotonic clock reading included
+	legacy := "a3f1c2d4-0000-4000-8000-000000000000<>2022-05-01 12:20:30.123456789 +0200 CEST m=+0.001234567"
+	parsed := InstanceIDFromString(legacy)
+	if assert.NotNil(t, parsed) {
+		assert.Equal(t, legacy, parsed.ID)
+		assert.True(t, parsed.CreatedAt.Equal(time.Date(2022, 5, 1, 10, 20, 30, 123456789, time.UTC)))
+		assert.True(t, parsed.Is(js))
+	}
+
+	for _, invalid := range []string{
+		"",
+		"a3f1c2d4-0000-4000-8000-000000000000",
+		"<>2022-05-01T10:20:30.123Z",
+		"a3f1c2d4-0000-4000-8000-000000000000<>yesterday",
+		"a<>2022-05-01T10:20:30.123Z<>b",
+	} {
+		assert.Nil(t, InstanceIDFromString(invalid), invalid)
+	}
+}
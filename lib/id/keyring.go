@@ -0,0 +1,43 @@
+package id
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+)
+
+// KeyRing holds the public keys of other peers. Since an ID is derived from
+// its key, every key is checked against the ID it is filed under, and keys
+// can be taken from anyone.
+type KeyRing struct {
+	lock sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string]crypto.PublicKey)}
+}
+
+// Add files key under peerID, failing if it is not that peer's key.
+func (r *KeyRing) Add(peerID string, key crypto.PublicKey) error {
+	matches, err := MatchesID(peerID, key)
+	if err != nil {
+		return err
+	}
+	if !matches {
+		i, _ := IDFromPublicKey(key)
+		return fmt.Errorf("id key belongs to %s, not %s", ShortID(i), ShortID(peerID))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys[peerID] = key
+	return nil
+}
+
+// Get returns the key of peerID, if known.
+func (r *KeyRing) Get(peerID string) (crypto.PublicKey, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	key, ok := r.keys[peerID]
+	return key, ok
+}
@@ -0,0 +1,25 @@
+package id
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeyRingChecksOwner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	owner, err := IDFromPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	r := NewKeyRing()
+	assert.Error(t, r.Add(idWithPrefix("1"), &key.PublicKey))
+	_, ok := r.Get(idWithPrefix("1"))
+	assert.False(t, ok)
+
+	assert.NoError(t, r.Add(owner, &key.PublicKey))
+	found, ok := r.Get(owner)
+	assert.True(t, ok)
+	assert.Equal(t, &key.PublicKey, found)
+}
@@ -0,0 +1,201 @@
+package id
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// KeyType names the kind of key an identity is made of.
+type KeyType string
+
+// RSA keys are what every peer understood before key types existed, and are
+// kept for them. Ed25519 keys are much faster to create and sign with, and
+// make far smaller signatures.
+const (
+	RSA       KeyType = "rsa"
+	Ed25519   KeyType = "ed25519"
+	ECDSAP256 KeyType = "ecdsa-p256"
+)
+
+// DefaultKeyType is the type of identities created without a key. It stays
+// RSA while peers which only verify RSA signatures are about, as they drop
+// every message from a node with another key; newer keys are opt in.
+const DefaultKeyType = RSA
+
+// PublicKey is a self-describing encoding of a public key, as carried in
+// signed messages and key lookups. RSA keys are encoded as the JSON of an
+// rsa.PublicKey, which peers which predate key types expect, and other keys
+// as SubjectPublicKeyInfo DER, which names the algorithm itself. IDs do not
+// depend on the encoding.
+type PublicKey struct {
+	Type KeyType `json:"type"`
+	Key  []byte  `json:"key"`
+}
+
+// GenerateKey creates a private key of the given type.
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case RSA:
+		return rsa.GenerateKey(rand.Reader, bitSize)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("id unknown key type %s", t)
+	}
+}
+
+// KeyTypeOf returns the type of a public or private key.
+func KeyTypeOf(key interface{}) (KeyType, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		return RSA, nil
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		return Ed25519, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return ECDSAP256, nil
+		}
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return ECDSAP256, nil
+		}
+	}
+	return "", fmt.Errorf("id unsupported key %T", key)
+}
+
+// EncodePublicKey returns the self-describing encoding of key.
+func EncodePublicKey(key crypto.PublicKey) (*PublicKey, error) {
+	t, err := KeyTypeOf(key)
+	if err != nil {
+		return nil, err
+	}
+	var bytes []byte
+	if t == RSA {
+		bytes, err = json.Marshal(key)
+	} else {
+		bytes, err = x509.MarshalPKIXPublicKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id key marshall error: %s", err.Error())
+	}
+	return &PublicKey{Type: t, Key: bytes}, nil
+}
+
+// Decode parses the key, checking that it is of the type claimed.
+func (k *PublicKey) Decode() (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	if k.Type == RSA {
+		rsaKey := &rsa.PublicKey{}
+		if err := json.Unmarshal(k.Key, rsaKey); err != nil {
+			return nil, fmt.Errorf("id key parse error: %s", err.Error())
+		}
+		if rsaKey.N == nil || rsaKey.E == 0 {
+			return nil, fmt.Errorf("id key parse error: incomplete rsa key")
+		}
+		key = rsaKey
+	} else {
+		parsed, err := x509.ParsePKIXPublicKey(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("id key parse error: %s", err.Error())
+		}
+		key = parsed
+	}
+	t, err := KeyTypeOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if t != k.Type {
+		return nil, fmt.Errorf("id key is %s, not %s", t, k.Type)
+	}
+	return key, nil
+}
+
+// acceptLegacyIDs is set while RSA peers may go by the IDs they were given
+// before IDs were canonical. It is read on every message, so it is only
+// changed atomically.
+var acceptLegacyIDs int32 = 1
+
+// SetAcceptLegacyIDs allows or refuses legacy RSA IDs. They are accepted
+// while peers move to canonical IDs. The window closes, and this setting goes,
+// in the release which raises message.MinProtocolVersion above 0 and so stops
+// talking to the peers which predate canonical IDs.
+func SetAcceptLegacyIDs(accept bool) {
+	var value int32
+	if accept {
+		value = 1
+	}
+	atomic.StoreInt32(&acceptLegacyIDs, value)
+}
+
+// AcceptsLegacyIDs reports whether legacy RSA IDs are accepted.
+func AcceptsLegacyIDs() bool {
+	return atomic.LoadInt32(&acceptLegacyIDs) == 1
+}
+
+// IDFromPublicKey returns the canonical ID of the peer holding key: the hex
+// SHA-256 of its DER SubjectPublicKeyInfo, which any language can reproduce
+// (WebCrypto exports it as "spki"). The encoding names the algorithm, so a
+// key cannot pass for one of another type with the same ID.
+func IDFromPublicKey(key crypto.PublicKey) (string, error) {
+	if _, err := KeyTypeOf(key); err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", fmt.Errorf("id key marshall error: %s", err.Error())
+	}
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// LegacyIDFromPublicKey returns the ID RSA peers were given before IDs were
+// canonical, the SHA-256 of the JSON of their key as Go encodes it. Other key
+// types have no legacy IDs.
+func LegacyIDFromPublicKey(key crypto.PublicKey) (string, error) {
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("id no legacy id for %T", key)
+	}
+	bytes, err := json.Marshal(rsaKey)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// MatchesID reports whether key belongs to the peer with ID i, which must be
+// its canonical ID unless legacy IDs are accepted.
+func MatchesID(i string, key crypto.PublicKey) (bool, error) {
+	canonical, err := IDFromPublicKey(key)
+	if err != nil {
+		return false, err
+	}
+	if canonical == i {
+		return true, nil
+	}
+	if !AcceptsLegacyIDs() {
+		return false, nil
+	}
+	if _, ok := key.(*rsa.PublicKey); !ok {
+		return false, nil
+	}
+	legacy, err := LegacyIDFromPublicKey(key)
+	if err != nil {
+		return false, err
+	}
+	return legacy == i, nil
+}
@@ -0,0 +1,148 @@
+package id
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// PEM block types of private keys, as written by OpenSSL.
+const (
+	privateKeyBlock          = "PRIVATE KEY"
+	encryptedPrivateKeyBlock = "ENCRYPTED PRIVATE KEY"
+)
+
+// KeyFileMode is the mode identity files are written with. Files which
+// others may access are refused on load.
+const KeyFileMode os.FileMode = 0600
+
+// ErrPassphraseRequired is returned when loading an encrypted key without a
+// passphrase.
+var ErrPassphraseRequired = errors.New("id key is encrypted, a passphrase is required")
+
+// MarshalPrivateKey encodes key as PKCS #8 PEM, encrypted with passphrase
+// unless it is empty.
+func MarshalPrivateKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("id key marshall error: %s", err.Error())
+	}
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: privateKeyBlock, Bytes: der}), nil
+	}
+	encrypted, err := encryptPKCS8(der, passphrase, KeyIterations, oidHMACSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("id key encrypt error: %s", err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedPrivateKeyBlock, Bytes: encrypted}), nil
+}
+
+// ParsePrivateKey decodes a key written by MarshalPrivateKey, or by OpenSSL
+// in PKCS #8 form.
+func ParsePrivateKey(data []byte, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("id key parse error: no PEM block found")
+	}
+	der := block.Bytes
+	switch block.Type {
+	case privateKeyBlock:
+	case encryptedPrivateKeyBlock:
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		decrypted, err := decryptPKCS8(der, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		der = decrypted
+	default:
+		return nil, fmt.Errorf("id key parse error: unsupported PEM block %s", block.Type)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		if block.Type == encryptedPrivateKeyBlock {
+			// a wrong passphrase occasionally leaves valid padding
+			return nil, ErrWrongPassphrase
+		}
+		return nil, fmt.Errorf("id key parse error: %s", err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("id unsupported key %T", key)
+	}
+	if _, err := KeyTypeOf(signer); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// SaveIdentity writes the key of i to path, readable by its owner alone.
+// The file is replaced atomically, so a failed save leaves any previous
+// identity in place.
+func SaveIdentity(path string, i *PublicKeyId, passphrase []byte) error {
+	data, err := MarshalPrivateKey(i.PrivateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("id key save error: %s", err.Error())
+	}
+	// CreateTemp makes files with KeyFileMode already
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("id key save error: %s", err.Error())
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("id key save error: %s", err.Error())
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("id key save error: %s", err.Error())
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("id key save error: %s", err.Error())
+	}
+	return nil
+}
+
+// LoadIdentity reads an identity saved by SaveIdentity, refusing key files
+// which anyone but their owner may access.
+func LoadIdentity(path string, passphrase []byte, publicName string) (*PublicKeyId, error) {
+	if err := CheckKeyFileMode(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("id key load error: %s", err.Error())
+	}
+	key, err := ParsePrivateKey(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewPublicKeyId(key, publicName)
+}
+
+// CheckKeyFileMode fails if the file at path is not a regular file, or if
+// its group or others have any access to it. Windows has no such modes, so
+// it is left to the ACLs of the file there.
+func CheckKeyFileMode(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("id key load error: %s", err.Error())
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("id key file %s is not a regular file", path)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("id key file %s is accessible by others (mode %04o), it should be %04o", path, info.Mode().Perm(), KeyFileMode)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package id
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+)
+
+// Passphrase-protected keys are PKCS #8 EncryptedPrivateKeyInfo, using PBES2
+// with PBKDF2-HMAC-SHA256 and AES-256-CBC as OpenSSL does by default, so that
+// the standard tools can read and write them too. Keys which name no PRF use
+// HMAC-SHA1, the PBKDF2 default, as some older tools write them.
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// KeyIterations is the PBKDF2 iteration count for newly encrypted keys.
+const KeyIterations = 600000
+
+// maxKeyIterations bounds the work a key file can ask of us.
+const maxKeyIterations = 10000000
+
+// ErrWrongPassphrase is returned for encrypted keys which do not decrypt.
+var ErrWrongPassphrase = errors.New("id wrong passphrase")
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// prfHash returns the hash of a PBKDF2 PRF, which is HMAC-SHA1 when absent.
+func prfHash(prf asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf) == 0 || prf.Equal(oidHMACSHA1):
+		return sha1.New, nil
+	case prf.Equal(oidHMACSHA256):
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("id unsupported key derivation %s", prf)
+	}
+}
+
+// encryptPKCS8 encrypts the DER of a PKCS #8 private key with passphrase,
+// deriving the key with prf, or with the default PRF when prf is nil.
+func encryptPKCS8(der []byte, passphrase []byte, iterations int, prf asn1.ObjectIdentifier) ([]byte, error) {
+	newHash, err := prfHash(prf)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key(passphrase, salt, iterations, 32, newHash)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdf := pbkdf2Params{Salt: salt, IterationCount: iterations}
+	if prf != nil {
+		kdf.PRF = pkix.AlgorithmIdentifier{Algorithm: prf, Parameters: asn1.NullRawValue}
+	}
+	kdfParams, err := asn1.Marshal(kdf)
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+}
+
+// decryptPKCS8 returns the DER of the PKCS #8 private key encrypted in der.
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	info := &encryptedPrivateKeyInfo{}
+	if err := unmarshalDER(der, info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("id unsupported key encryption %s", info.Algorithm.Algorithm)
+	}
+	params := &pbes2Params{}
+	if err := unmarshalDER(info.Algorithm.Parameters.FullBytes, params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("id unsupported key encryption %s with %s", params.KeyDerivationFunc.Algorithm, params.EncryptionScheme.Algorithm)
+	}
+	kdf := &pbkdf2Params{}
+	if err := unmarshalDER(params.KeyDerivationFunc.Parameters.FullBytes, kdf); err != nil {
+		return nil, err
+	}
+	newHash, err := prfHash(kdf.PRF.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxKeyIterations || kdf.KeyLength != 0 && kdf.KeyLength != 32 {
+		return nil, fmt.Errorf("id invalid key derivation parameters")
+	}
+	var iv []byte
+	if err := unmarshalDER(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("id invalid encrypted key")
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, 32, newHash))
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!hmac.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, ErrWrongPassphrase
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func unmarshalDER(der []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(der, v)
+	if err != nil {
+		return fmt.Errorf("id key parse error: %s", err.Error())
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("id key parse error: trailing data")
+	}
+	return nil
+}
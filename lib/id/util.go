@@ -1,6 +1,9 @@
 package id
 
-import "math/big"
+import (
+	"math/big"
+	"sync"
+)
 
 const PendingID = "pending-id"
 const MaxStr = "10000000000000000000000000000000000000000000000000000000000000000"
@@ -10,8 +13,12 @@ var Max, _ = new(big.Int).SetString(MaxStr, 16)
 var HalfMax, _ = new(big.Int).SetString(HalfMaxStr, 16)
 var Zero = new(big.Int).SetInt64(0)
 var IDCache = make(map[string]*big.Int)
+var idCacheLock sync.Mutex
 
 func ShortID(i string) string {
+	if len(i) < 6 {
+		return i
+	}
 	return i[0:6]
 }
 
@@ -23,15 +30,26 @@ func IDsToShortIDs(ids []string) []string {
 	return shortIDs
 }
 
+// GetBigInt parses a hex ID, returning nil if it is not valid hex. The
+// returned value is shared through IDCache and must not be mutated.
 func GetBigInt(s string) *big.Int {
-	if s, ok := IDCache[s]; ok {
-		return s
+	idCacheLock.Lock()
+	defer idCacheLock.Unlock()
+	if b, ok := IDCache[s]; ok {
+		return b
+	}
+	b, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		return nil
 	}
-	b, _ := new(big.Int).SetString(s, 16)
 	IDCache[s] = b
 	return b
 }
 
+func IsValidID(s string) bool {
+	return GetBigInt(s) != nil
+}
+
 func ParseBigIntBase10(num int64) *big.Int {
 	return new(big.Int).SetInt64(num)
 }
@@ -56,8 +74,10 @@ func ClosestIDInList(i string, ids []string) string {
 func DistanceBetweenIDs(a string, b string) *big.Int {
 	intA := GetBigInt(a)
 	intB := GetBigInt(b)
-	var distance *big.Int
-	distance.Sub(intB, intA)
+	if intA == nil || intB == nil {
+		return new(big.Int).Set(Max)
+	}
+	distance := new(big.Int).Sub(intB, intA)
 	distance.Abs(distance)
 	if HalfMax.Cmp(distance) < 0 {
 		distance.Sub(Max, distance)
@@ -68,8 +88,10 @@ func DistanceBetweenIDs(a string, b string) *big.Int {
 func DirectedDistanceBetweenIDs(a string, b string) *big.Int {
 	intA := GetBigInt(a)
 	intB := GetBigInt(b)
-	var distance *big.Int
-	distance.Sub(intB, intA)
+	if intA == nil || intB == nil {
+		return new(big.Int).Set(Max)
+	}
+	distance := new(big.Int).Sub(intB, intA)
 	// distance < 0
 	if Zero.Cmp(distance) > 0 {
 		distance.Add(Max, distance)
@@ -78,21 +100,29 @@ func DirectedDistanceBetweenIDs(a string, b string) *big.Int {
 }
 
 func BigIntToID(b *big.Int) string {
-	res := b.String()
+	res := b.Text(16)
 	for {
-		if len(res) < len(HalfMaxStr)+1 {
+		if len(res) < len(HalfMaxStr) {
 			res = "0" + res
 		} else {
 			break
 		}
 	}
+	idCacheLock.Lock()
 	IDCache[res] = b
+	idCacheLock.Unlock()
 	return res
 }
 
+// IdealFinger returns the ID the finger of i at level should ideally have,
+// or "" if i is not a valid ID.
 func IdealFinger(i string, level int) string {
-	ideal := GetBigInt(i)
-	offset := HalfMax
+	b := GetBigInt(i)
+	if b == nil {
+		return ""
+	}
+	ideal := new(big.Int).Set(b)
+	offset := new(big.Int).Set(HalfMax)
 	for i := 0; i < level; i++ {
 		ideal.Add(ideal, offset)
 		if ideal.Cmp(Max) > 0 {
@@ -107,9 +137,8 @@ func IdealFinger(i string, level int) string {
 func CandidateMatchesApproximately(i string, candidate string, level int) bool {
 	// how far are we from the ideal candidate
 	distance := DistanceBetweenIDs(IdealFinger(i, level), candidate)
-	var maxDistance *big.Int
 	// our acceptable distance depends on our level within the chord
-	maxDistance.Rsh(HalfMax, uint(level+2))
+	maxDistance := new(big.Int).Rsh(HalfMax, uint(level+2))
 	// check whether our distance < max
 	return distance.Cmp(maxDistance) < 0
 }
@@ -0,0 +1,50 @@
+package id
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func idWithPrefix(prefix string) string {
+	return prefix + strings.Repeat("0", len(HalfMaxStr)-len(prefix))
+}
+
+func TestDistanceBetweenIDs(t *testing.T) {
+	a := idWithPrefix("1")
+	b := idWithPrefix("3")
+	assert.Equal(t, DistanceBetweenIDs(a, b), DistanceBetweenIDs(b, a))
+	// distance wraps around the ring
+	c := idWithPrefix("f")
+	assert.Equal(t, 0, DistanceBetweenIDs(a, c).Cmp(GetBigInt(idWithPrefix("2"))))
+	// invalid ids are infinitely far away
+	assert.Equal(t, 0, DistanceBetweenIDs(a, "not-an-id").Cmp(Max))
+}
+
+func TestDirectedDistanceBetweenIDs(t *testing.T) {
+	a := idWithPrefix("1")
+	b := idWithPrefix("3")
+	assert.Equal(t, 0, DirectedDistanceBetweenIDs(a, b).Cmp(GetBigInt(idWithPrefix("2"))))
+	assert.Equal(t, 0, DirectedDistanceBetweenIDs(b, a).Cmp(GetBigInt(idWithPrefix("e"))))
+}
+
+func TestClosestIDInList(t *testing.T) {
+	target := idWithPrefix("80")
+	ids := []string{idWithPrefix("10"), idWithPrefix("7f"), idWithPrefix("f0")}
+	assert.Equal(t, idWithPrefix("7f"), ClosestIDInList(target, ids))
+}
+
+func TestIdealFingerDoesNotMutate(t *testing.T) {
+	self := idWithPrefix("1")
+	half := new(big.Int).Set(HalfMax)
+	assert.Equal(t, idWithPrefix("9"), IdealFinger(self, 1))
+	assert.Equal(t, idWithPrefix("d"), IdealFinger(self, 2))
+	assert.Equal(t, 0, half.Cmp(HalfMax))
+	assert.Equal(t, 0, GetBigInt(self).Cmp(GetBigInt(idWithPrefix("1"))))
+}
+
+func TestIdealFingerOfInvalidID(t *testing.T) {
+	assert.Equal(t, "", IdealFinger("not an id", 1))
+	assert.False(t, CandidateMatchesApproximately("not an id", idWithPrefix("9"), 1))
+}
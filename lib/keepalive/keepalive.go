@@ -0,0 +1,41 @@
+// Package keepalive pings websockets and notices when their peer has gone
+// quiet, for both ends of a signaling connection.
+package keepalive
+
+import (
+	"github.com/gorilla/websocket"
+	"strconv"
+	"time"
+)
+
+const DefaultPingInterval = 30 * time.Second
+const DefaultReadTimeout = 60 * time.Second
+
+// Ping sends a ping carrying the current time, which the peer echoes back in
+// its pong for PongLatency to measure the round trip.
+func Ping(conn *websocket.Conn, timeout time.Duration) error {
+	payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(timeout))
+}
+
+// PongLatency returns the round trip time of the ping echoed in data.
+func PongLatency(data string) (time.Duration, error) {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(time.Unix(0, sent)), nil
+}
+
+// Start arranges for reads on conn to fail once nothing, not even a pong,
+// has arrived for readTimeout, so that half-open sockets are noticed. Each
+// pong is passed to onLatency.
+func Start(conn *websocket.Conn, readTimeout time.Duration, onLatency func(time.Duration)) {
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(data string) error {
+		if latency, err := PongLatency(data); err == nil {
+			onLatency(latency)
+		}
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+}
@@ -1,6 +1,7 @@
 package message
 
 const Connect = "connect"
+const Challenge = "challenge"
 const Reconnect = "reconnect"
 const Disconnect = "disconnect"
 const Confirm = "confirm"
@@ -8,12 +9,22 @@ const GetBlock = "get-block"
 const MarkUsedByPeer = "mark-used-by-peer"
 const MarkUnusedByPeer = "mark-unused-by-peer"
 const OverlayMessage = "overlay-message"
+const Undeliverable = "undeliverable"
+const Signal = "signal"
+const Ack = "ack"
+const GetKey = "get-key"
+const Key = "key"
+const Handshake = "handshake"
+const Incompatible = "incompatible"
 
 // DHT Actions
 const DHTPut = "dht-put"
 const DHTPutAck = "dht-put-ack"
 const DHTGet = "dht-get"
 const DHTGot = "dht-got"
+const DHTHandoff = "dht-handoff"
 
 // Chord Actions
 const FindFinger = "find-finger"
+const FindFlood = "find-flood"
+const FloodUpdate = "flood-update"
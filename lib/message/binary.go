@@ -0,0 +1,436 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"time"
+)
+
+// Codec names a wire format for messages.
+type Codec string
+
+// JSON is the format every peer understands, including the JS Woverlay
+// peers, and Binary a compact format for peers which negotiate it.
+const JSON Codec = "json"
+const Binary Codec = "binary/1"
+
+// Codecs lists the formats we decode, most preferred first.
+var Codecs = []Codec{Binary, JSON}
+
+// binaryVersion starts every frame in the binary format. JSON frames always
+// start with '{' or whitespace, which lets Decode tell the two apart.
+const binaryVersion byte = 1
+
+// Flags in the second byte of a binary frame.
+const (
+	flagPacked byte = 1 << iota
+	flagTimestamp
+	flagSDP
+	flagCandidate
+	flagProtocol
+	flagSealed
+	// flagSigned marks packed frames carrying their signed data field by
+	// field rather than as the JSON it was signed as
+	flagSigned
+)
+
+// signedData and packableData mirror the JSON signer packs messages in, which
+// this package cannot import. Binary frames carry their fields, and the JSON
+// is rebuilt on decoding. Frames are only written so when rebuilding gives
+// back the very bytes that were signed, and otherwise carry the JSON as is.
+type signedData struct {
+	Signed    []byte `json:"signed"`
+	Signature []byte `json:"signature"`
+	VerifyID  string `json:"verifyID"`
+}
+
+type packableData struct {
+	Data      string           `json:"data"`
+	PublicKey []byte           `json:"publicKey"`
+	KeyType   string           `json:"keyType,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Timestamp *json.RawMessage `json:"timestamp,omitempty"`
+	AckID     string           `json:"ackID,omitempty"`
+}
+
+// Encode serializes m in the format c.
+func (c Codec) Encode(m *Message) ([]byte, error) {
+	switch c {
+	case JSON:
+		return Encode(m)
+	case Binary:
+		return EncodeBinary(m)
+	default:
+		return nil, fmt.Errorf("message unknown codec %s", c)
+	}
+}
+
+// ChooseCodec returns the first of our Codecs the peer also supports, or
+// JSON if there is none.
+func ChooseCodec(theirs []Codec) Codec {
+	for _, ours := range Codecs {
+		for _, c := range theirs {
+			if c == ours {
+				return c
+			}
+		}
+	}
+	return JSON
+}
+
+// IsBinary reports whether bytes hold a message in the binary format.
+func IsBinary(bytes []byte) bool {
+	return len(bytes) > 0 && bytes[0] == binaryVersion
+}
+
+// EncodeBinary serializes m in the binary format. Unlike Encode it writes
+// Data directly rather than as embedded JSON, and likewise the signed data of
+// packed messages.
+func EncodeBinary(m *Message) ([]byte, error) {
+	var flags byte
+	if m.Packed {
+		flags |= flagPacked
+	}
+	if !m.Timestamp.IsZero() {
+		flags |= flagTimestamp
+	}
+	var signed []byte
+	if m.Packed {
+		signed = encodeSigned(m.EncodedData)
+		if signed != nil {
+			flags |= flagSigned
+		}
+	}
+	flags |= dataFlags(&m.Data)
+	e := &encoder{buf: make([]byte, 0, 128+len(m.Data.Value)+len(m.EncodedData))}
+	e.buf = append(e.buf, binaryVersion, flags)
+	e.string(m.ID)
+	e.string(m.AckID)
+	if !m.Timestamp.IsZero() {
+		e.varint(m.Timestamp.UnixNano())
+	}
+	if signed != nil {
+		e.buf = append(e.buf, signed...)
+		return e.buf, nil
+	}
+	if m.Packed {
+		e.bytes(m.EncodedData)
+		return e.buf, nil
+	}
+	if err := e.data(&m.Data); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// encodeSigned writes the fields of the signed JSON of a packed message, or
+// returns nil if decoding them would not give back the same JSON.
+func encodeSigned(encoded []byte) []byte {
+	s := &signedData{}
+	p := &packableData{}
+	data := &MessageData{}
+	if json.Unmarshal(encoded, s) != nil || json.Unmarshal(s.Signed, p) != nil || json.Unmarshal([]byte(p.Data), data) != nil {
+		return nil
+	}
+	e := &encoder{buf: make([]byte, 0, len(encoded))}
+	e.bytes(s.Signature)
+	e.string(s.VerifyID)
+	e.bytes(p.PublicKey)
+	e.string(p.KeyType)
+	e.string(p.ID)
+	if p.Timestamp != nil {
+		e.bytes(*p.Timestamp)
+	} else {
+		e.bytes(nil)
+	}
+	e.string(p.AckID)
+	e.buf = append(e.buf, dataFlags(data))
+	if e.data(data) != nil {
+		return nil
+	}
+	d := &decoder{buf: e.buf}
+	if rebuilt := d.signed(); d.finish() != nil || !bytes.Equal(rebuilt, encoded) {
+		return nil
+	}
+	return e.buf
+}
+
+// signedJSON rebuilds the signed JSON of a packed message from its fields.
+func signedJSON(s *signedData, p *packableData, data *MessageData) ([]byte, error) {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	p.Data = string(dataBytes)
+	if s.Signed, err = json.Marshal(p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
+
+// dataFlags returns the flags for the optional fields of d.
+func dataFlags(d *MessageData) byte {
+	var flags byte
+	if d.SDP != nil {
+		flags |= flagSDP
+	}
+	if d.Candidate != nil {
+		flags |= flagCandidate
+	}
+	if d.Protocol != nil {
+		flags |= flagProtocol
+	}
+	if d.Sealed {
+		flags |= flagSealed
+	}
+	return flags
+}
+
+// decodeBinary parses a frame produced by EncodeBinary.
+func decodeBinary(bytes []byte) (*Message, error) {
+	if len(bytes) < 2 {
+		return nil, fmt.Errorf("message parse error: truncated frame")
+	}
+	if bytes[0] != binaryVersion {
+		return nil, fmt.Errorf("message parse error: unknown version %d", bytes[0])
+	}
+	flags := bytes[1]
+	d := &decoder{buf: bytes[2:]}
+	m := &Message{Packed: flags&flagPacked != 0}
+	m.Data.Sealed = flags&flagSealed != 0
+	m.ID = d.string()
+	m.AckID = d.string()
+	if flags&flagTimestamp != 0 {
+		m.Timestamp = time.Unix(0, d.varint())
+	}
+	if m.Packed && flags&flagSigned != 0 {
+		m.EncodedData = d.signed()
+		return m, d.finish()
+	}
+	if m.Packed {
+		m.EncodedData = d.bytes()
+		return m, d.finish()
+	}
+	d.data(flags, &m.Data)
+	return m, d.finish()
+}
+
+type encoder struct {
+	buf []byte
+}
+
+// data writes the fields of d, those flagged by dataFlags included.
+func (e *encoder) data(d *MessageData) error {
+	e.string(d.To)
+	e.string(d.ToInstance)
+	e.string(d.From)
+	e.string(d.FromInstance)
+	e.string(d.Action)
+	e.strings(d.Proxies)
+	e.strings(d.Route)
+	e.string(d.Confirmed)
+	e.bytes(d.Value)
+	// signals and hellos are rare on data channels, so they stay JSON
+	if d.SDP != nil {
+		if err := e.json(d.SDP); err != nil {
+			return err
+		}
+	}
+	if d.Candidate != nil {
+		if err := e.json(d.Candidate); err != nil {
+			return err
+		}
+	}
+	if d.Protocol != nil {
+		if err := e.json(d.Protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) json(v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("message marshall error: %s", err.Error())
+	}
+	e.bytes(bytes)
+	return nil
+}
+
+func (e *encoder) strings(list []string) {
+	e.uvarint(uint64(len(list)))
+	for _, s := range list {
+		e.string(s)
+	}
+}
+
+// decoder reads the fields written by encoder, remembering the first error
+// so that callers need only check it once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("message parse error: bad length"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("message parse error: bad timestamp"))
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.fail(fmt.Errorf("message parse error: truncated field"))
+		return nil
+	}
+	// copy, so that the message outlives the frame
+	b := append([]byte{}, d.buf[:n]...)
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+	// every string takes at least a byte, which bounds a forged count
+	if n > uint64(len(d.buf)) {
+		d.fail(fmt.Errorf("message parse error: truncated list"))
+		return nil
+	}
+	list := make([]string, n)
+	for i := range list {
+		list[i] = d.string()
+	}
+	return list
+}
+
+func (d *decoder) json(v interface{}) {
+	bytes := d.bytes()
+	if d.err != nil {
+		return
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		d.fail(fmt.Errorf("message parse error: %s", err.Error()))
+	}
+}
+
+// data reads the fields written by encoder.data.
+func (d *decoder) data(flags byte, data *MessageData) {
+	data.To = d.string()
+	data.ToInstance = d.string()
+	data.From = d.string()
+	data.FromInstance = d.string()
+	data.Action = d.string()
+	data.Proxies = d.strings()
+	data.Route = d.strings()
+	data.Confirmed = d.string()
+	data.Value = d.bytes()
+	data.Sealed = flags&flagSealed != 0
+	if flags&flagSDP != 0 {
+		data.SDP = &webrtc.SessionDescription{}
+		d.json(data.SDP)
+	}
+	if flags&flagCandidate != 0 {
+		data.Candidate = &webrtc.ICECandidate{}
+		d.json(data.Candidate)
+	}
+	if flags&flagProtocol != 0 {
+		data.Protocol = &Hello{}
+		d.json(data.Protocol)
+	}
+}
+
+// signed reads the fields written by encodeSigned, returning the signed JSON
+// they were taken from.
+func (d *decoder) signed() []byte {
+	s := &signedData{}
+	p := &packableData{}
+	s.Signature = d.bytes()
+	s.VerifyID = d.string()
+	p.PublicKey = d.bytes()
+	p.KeyType = d.string()
+	p.ID = d.string()
+	if timestamp := json.RawMessage(d.bytes()); len(timestamp) > 0 {
+		p.Timestamp = &timestamp
+	}
+	p.AckID = d.string()
+	if len(d.buf) == 0 {
+		d.fail(fmt.Errorf("message parse error: truncated signed data"))
+	}
+	if d.err != nil {
+		return nil
+	}
+	flags := d.buf[0]
+	d.buf = d.buf[1:]
+	data := &MessageData{}
+	d.data(flags, data)
+	if d.err != nil {
+		return nil
+	}
+	encoded, err := signedJSON(s, p, data)
+	if err != nil {
+		d.fail(fmt.Errorf("message parse error: %s", err.Error()))
+		return nil
+	}
+	return encoded
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		return fmt.Errorf("message parse error: %d trailing bytes", len(d.buf))
+	}
+	return d.err
+}
@@ -0,0 +1,180 @@
+package message
+
+import (
+	"encoding/json"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func sampleMessage() *Message {
+	return &Message{
+		ID:        "3f1c2a9e-6b1d-4c55-9e0e-1a2b3c4d5e6f",
+		Timestamp: time.Unix(0, time.Now().UnixNano()),
+		Data: MessageData{
+			To:           "9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b",
+			ToInstance:   "2022-10-18T10:00:00Z|7d3e9a1c-2b4f-4e6a-8c0d-1f2e3a4b5c6d",
+			From:         "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0",
+			FromInstance: "2022-10-18T10:00:01Z|1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+			Action:       OverlayMessage,
+			Proxies:      []string{"a", "b"},
+			Route:        []string{"c"},
+			Value:        []byte(`{"key":"value","n":12345}`),
+		},
+	}
+}
+
+// packedSampleMessage packs sampleMessage as signer does, with a made up
+// key and signature of the sizes Ed25519 gives.
+func packedSampleMessage(t testing.TB) *Message {
+	m := sampleMessage()
+	dataBytes, err := json.Marshal(m.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := json.Marshal(m.Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := json.RawMessage(timestamp)
+	signed, err := json.Marshal(&packableData{
+		Data:      string(dataBytes),
+		PublicKey: make([]byte, 44),
+		KeyType:   "ed25519",
+		ID:        m.ID,
+		Timestamp: &raw,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(&signedData{Signed: signed, Signature: make([]byte, 64), VerifyID: m.Data.From})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.EncodedData = encoded
+	m.Packed = true
+	return m
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	m := sampleMessage()
+	m.Data.SDP = &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+	m.Data.Protocol = LocalHello()
+	m.Data.Sealed = true
+	bytes, err := EncodeBinary(m)
+	assert.NoError(t, err)
+	assert.True(t, IsBinary(bytes))
+	decoded, err := Decode(bytes)
+	assert.NoError(t, err)
+	assert.True(t, m.Timestamp.Equal(decoded.Timestamp))
+	decoded.Timestamp = m.Timestamp
+	assert.Equal(t, m, decoded)
+
+	jsonBytes, err := Encode(sampleMessage())
+	assert.NoError(t, err)
+	assert.False(t, IsBinary(jsonBytes))
+	assert.Less(t, len(bytes), len(jsonBytes))
+	decoded, err = Decode(jsonBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, OverlayMessage, decoded.Data.Action)
+
+	packed := &Message{Packed: true, EncodedData: []byte(`{"signed":"..."}`)}
+	bytes, err = Binary.Encode(packed)
+	assert.NoError(t, err)
+	decoded, err = Decode(bytes)
+	assert.NoError(t, err)
+	assert.True(t, decoded.Packed)
+	assert.Equal(t, packed.EncodedData, decoded.EncodedData)
+	assert.True(t, decoded.Timestamp.IsZero())
+}
+
+func TestBinaryPackedRoundTrip(t *testing.T) {
+	packed := packedSampleMessage(t)
+	bytes, err := Binary.Encode(packed)
+	assert.NoError(t, err)
+	assert.NotZero(t, bytes[1]&flagSigned)
+	decoded, err := Decode(bytes)
+	assert.NoError(t, err)
+	assert.True(t, decoded.Packed)
+	assert.Equal(t, packed.EncodedData, decoded.EncodedData)
+
+	jsonBytes, err := JSON.Encode(packedSampleMessage(t))
+	assert.NoError(t, err)
+	assert.Less(t, len(bytes), len(jsonBytes)/2)
+
+	// signed data which would not be rebuilt as it was is carried as is
+	s := &signedData{}
+	assert.NoError(t, json.Unmarshal(packed.EncodedData, s))
+	p := &packableData{}
+	assert.NoError(t, json.Unmarshal(s.Signed, p))
+	p.Data = `{"to":"a","value":""}`
+	s.Signed, err = json.Marshal(p)
+	assert.NoError(t, err)
+	packed.EncodedData, err = json.Marshal(s)
+	assert.NoError(t, err)
+	bytes, err = Binary.Encode(packed)
+	assert.NoError(t, err)
+	assert.Zero(t, bytes[1]&flagSigned)
+	decoded, err = Decode(bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, packed.EncodedData, decoded.EncodedData)
+}
+
+func TestBinaryRejectsBadFrames(t *testing.T) {
+	bytes, err := EncodeBinary(sampleMessage())
+	assert.NoError(t, err)
+	for _, n := range []int{1, 2, 10, len(bytes) - 1} {
+		_, err := Decode(bytes[:n])
+		assert.Error(t, err)
+	}
+	_, err = Decode(append(bytes, 0))
+	assert.Error(t, err)
+	// a forged list length must not allocate a huge list
+	_, err = Decode([]byte{binaryVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	assert.Error(t, err)
+}
+
+func TestChooseCodec(t *testing.T) {
+	assert.Equal(t, Binary, ChooseCodec([]Codec{JSON, Binary}))
+	assert.Equal(t, JSON, ChooseCodec(nil))
+	assert.Equal(t, JSON, ChooseCodec([]Codec{"binary/9"}))
+	_, err := Codec("xml").Encode(sampleMessage())
+	assert.Error(t, err)
+}
+
+func benchmarkEncode(b *testing.B, codec Codec, m *Message) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bytes, err := codec.Encode(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(bytes)))
+	}
+}
+
+func benchmarkDecode(b *testing.B, codec Codec, m *Message) {
+	bytes, err := codec.Encode(m)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(bytes)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B)   { benchmarkEncode(b, JSON, sampleMessage()) }
+func BenchmarkEncodeBinary(b *testing.B) { benchmarkEncode(b, Binary, sampleMessage()) }
+func BenchmarkDecodeJSON(b *testing.B)   { benchmarkDecode(b, JSON, sampleMessage()) }
+func BenchmarkDecodeBinary(b *testing.B) { benchmarkDecode(b, Binary, sampleMessage()) }
+
+// Messages are packed before they are sent, so these are what peers send.
+func BenchmarkEncodePackedJSON(b *testing.B)   { benchmarkEncode(b, JSON, packedSampleMessage(b)) }
+func BenchmarkEncodePackedBinary(b *testing.B) { benchmarkEncode(b, Binary, packedSampleMessage(b)) }
+func BenchmarkDecodePackedJSON(b *testing.B)   { benchmarkDecode(b, JSON, packedSampleMessage(b)) }
+func BenchmarkDecodePackedBinary(b *testing.B) { benchmarkDecode(b, Binary, packedSampleMessage(b)) }
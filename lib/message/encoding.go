@@ -0,0 +1,43 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Encode serializes m for the wire, embedding its Data as JSON in EncodedData
+// unless it is packed, in which case EncodedData already holds the signed Data.
+func Encode(m *Message) ([]byte, error) {
+	if !m.Packed {
+		bytes, err := json.Marshal(m.Data)
+		if err != nil {
+			return nil, fmt.Errorf("message marshall error: %s", err.Error())
+		}
+		m.EncodedData = bytes
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("message marshall error: %s", err.Error())
+	}
+	return bytes, nil
+}
+
+// Decode parses a frame produced by Encode or EncodeBinary. The Data of
+// packed frames is left for the caller to fill in once the signature has been
+// checked.
+func Decode(bytes []byte) (*Message, error) {
+	if IsBinary(bytes) {
+		return decodeBinary(bytes)
+	}
+	m := &Message{}
+	if err := json.Unmarshal(bytes, m); err != nil {
+		return nil, fmt.Errorf("message parse error: %s", err.Error())
+	}
+	if m.Packed {
+		return m, nil
+	}
+	if err := json.Unmarshal(m.EncodedData, &m.Data); err != nil {
+		return nil, fmt.Errorf("message parse error: %s", err.Error())
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+package message
+
+import "fmt"
+
+// ProtocolVersion is the version of the wire protocol we speak, and
+// MinProtocolVersion the oldest we still accept. Peers which send no hello,
+// such as the JS Woverlay peers, speak version 0.
+const ProtocolVersion = 1
+const MinProtocolVersion = 0
+
+// Features a peer may support beyond the base protocol.
+const FeatureFragments = "fragments"
+const FeatureChannels = "channels"
+
+// Features lists the features we support.
+var Features = []string{FeatureFragments, FeatureChannels}
+
+// Hello describes what a peer speaks. It is exchanged when a data channel
+// opens and when connecting to the signal server.
+type Hello struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"minVersion"`
+	Codecs     []Codec  `json:"codecs"`
+	Features   []string `json:"features"`
+}
+
+// Agreement is what two peers settled on after exchanging hellos.
+type Agreement struct {
+	Version  int
+	Codec    Codec
+	Features []string
+}
+
+// LocalHello describes what we speak.
+func LocalHello() *Hello {
+	return &Hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Codecs:     append([]Codec{}, Codecs...),
+		Features:   append([]string{}, Features...),
+	}
+}
+
+// LegacyHello describes peers which predate the handshake.
+func LegacyHello() *Hello {
+	return &Hello{Codecs: []Codec{JSON}}
+}
+
+// Negotiate settles on the newest version, preferred codec and common
+// features we share with a peer which sent theirs, failing if neither of us
+// accepts the other's version.
+func Negotiate(theirs *Hello) (*Agreement, error) {
+	if theirs == nil {
+		theirs = LegacyHello()
+	}
+	if theirs.Version < MinProtocolVersion {
+		return nil, fmt.Errorf("message protocol version %d is older than %d", theirs.Version, MinProtocolVersion)
+	}
+	if theirs.MinVersion > ProtocolVersion {
+		return nil, fmt.Errorf("message protocol version %d is older than the peer's %d", ProtocolVersion, theirs.MinVersion)
+	}
+	version := theirs.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	agreement := &Agreement{Version: version, Codec: ChooseCodec(theirs.Codecs)}
+	for _, feature := range Features {
+		for _, f := range theirs.Features {
+			if f == feature {
+				agreement.Features = append(agreement.Features, feature)
+				break
+			}
+		}
+	}
+	return agreement, nil
+}
+
+// Has reports whether both peers support feature.
+func (a *Agreement) Has(feature string) bool {
+	if a == nil {
+		return false
+	}
+	for _, f := range a.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
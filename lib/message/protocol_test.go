@@ -0,0 +1,34 @@
+package message
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	agreement, err := Negotiate(LocalHello())
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, agreement.Version)
+	assert.Equal(t, Binary, agreement.Codec)
+	assert.True(t, agreement.Has(FeatureFragments))
+
+	// peers without a hello get the base protocol
+	agreement, err = Negotiate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, agreement.Version)
+	assert.Equal(t, JSON, agreement.Codec)
+	assert.False(t, agreement.Has(FeatureFragments))
+
+	// newer peers settle on our version and what we know of theirs
+	agreement, err = Negotiate(&Hello{Version: ProtocolVersion + 1, Codecs: []Codec{"binary/2", JSON}, Features: []string{"teleport", FeatureChannels}})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, agreement.Version)
+	assert.Equal(t, JSON, agreement.Codec)
+	assert.Equal(t, []string{FeatureChannels}, agreement.Features)
+
+	_, err = Negotiate(&Hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1})
+	assert.Error(t, err)
+	_, err = Negotiate(&Hello{Version: MinProtocolVersion - 1})
+	assert.Error(t, err)
+	assert.False(t, (*Agreement)(nil).Has(FeatureChannels))
+}
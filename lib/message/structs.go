@@ -5,17 +5,25 @@ import (
 	"time"
 )
 
+// MessageData is the addressed part of a message. ToInstance picks one
+// instance of To, since several devices may share an identity. When it is
+// empty any instance may take the message, and the signal server hands it to
+// every one of them.
 type MessageData struct {
-	To           string                    `json:"to"`
-	ToInstance   string                    `json:"toInstance"`
-	From         string                    `json:"from"`
-	FromInstance string                    `json:"fromInstance"`
-	Action       string                    `json:"action"`
-	Proxies      []string                  `json:"proxies"`
-	Confirmed    string                    `json:"confirmed"`
-	Value        []byte                    `json:"value"`
-	SDP          webrtc.SessionDescription `json:"sdp"`
-	Candidate    webrtc.ICECandidate       `json:"candidate"`
+	To           string                     `json:"to"`
+	ToInstance   string                     `json:"toInstance"`
+	From         string                     `json:"from"`
+	FromInstance string                     `json:"fromInstance"`
+	Action       string                     `json:"action"`
+	Proxies      []string                   `json:"proxies"`
+	Route        []string                   `json:"route,omitempty"`
+	Confirmed    string                     `json:"confirmed"`
+	Value        []byte                     `json:"value"`
+	SDP          *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate    *webrtc.ICECandidate       `json:"candidate,omitempty"`
+	Protocol     *Hello                     `json:"protocol,omitempty"`
+	// Sealed is set when Value is encrypted for the target alone
+	Sealed bool `json:"sealed,omitempty"`
 }
 
 type Message struct {
@@ -26,3 +34,10 @@ type Message struct {
 	Timestamp   time.Time `json:"timestamp"`
 	Data        MessageData
 }
+
+// Peer identifies a single instance of a peer, as the signal server hands
+// them out.
+type Peer struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"instanceID"`
+}
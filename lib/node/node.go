@@ -0,0 +1,107 @@
+// Package node ties an overlay, its DHT, the network cleaner and an optional
+// signaling server connection into a single lifecycle. Applications start a
+// node with Start or Run and stop it with Close; the library itself never
+// installs process signal handlers, leaving that to the application.
+package node
+
+import (
+	"context"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/cleaner"
+	"github.com/matanbroner/goverlay/lib/dht"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/overlay"
+	"github.com/matanbroner/goverlay/lib/util"
+	"github.com/matanbroner/goverlay/lib/ws"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout bounds how long Run spends closing the node once its
+// context is done.
+const DefaultShutdownTimeout = 10 * time.Second
+
+type Node struct {
+	ID        *id.PublicKeyId
+	Overlay   *overlay.Overlay
+	DHT       *dht.DHT
+	Cleaner   *cleaner.NetworkCleaner
+	WebSocket *ws.WebSocketWrapper
+	// ShutdownTimeout bounds the Close performed by Run
+	ShutdownTimeout time.Duration
+
+	lock   sync.Mutex
+	closed bool
+}
+
+// New creates a node for i which signals through the server at host, or
+// which only uses transports added to its overlay if host is empty.
+func New(i *id.PublicKeyId, host string) *Node {
+	o := overlay.New(i)
+	n := &Node{
+		ID:              i,
+		Overlay:         o,
+		DHT:             dht.NewDHT(o),
+		Cleaner:         cleaner.NewNetworkCleaner(o),
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+	if host != "" {
+		n.WebSocket = ws.NewWebSocketWrapper(o, host)
+	}
+	return n
+}
+
+// Start connects to the signaling server, if any, and starts periodic cleanup.
+func (n *Node) Start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return fmt.Errorf("node closed")
+	}
+	if n.WebSocket != nil {
+		if err := n.WebSocket.Connect(nil); err != nil {
+			return fmt.Errorf("node connect error: %s", err.Error())
+		}
+	}
+	n.Cleaner.Start()
+	return nil
+}
+
+// Run starts the node and keeps it running until ctx is done, then closes it
+// within ShutdownTimeout.
+func (n *Node) Run(ctx context.Context) error {
+	if err := n.Start(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	closeCtx, cancel := context.WithTimeout(context.Background(), n.ShutdownTimeout)
+	defer cancel()
+	return n.Close(closeCtx)
+}
+
+// Close leaves the network gracefully: it stops cleanup, retries pending
+// messages, hands our DHT data off to the peers taking over our keys, tells
+// every peer we are disconnecting and finally closes the signaling server
+// connection. Steps still running when ctx is done are cut short, but every
+// connection is closed regardless and all errors are returned together.
+// Calling Close again does nothing.
+func (n *Node) Close(ctx context.Context) error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.lock.Unlock()
+
+	n.Cleaner.Stop()
+	var errs []error
+	errs = append(errs, n.Overlay.Drain(ctx))
+	errs = append(errs, n.DHT.Handoff(ctx))
+	errs = append(errs, n.Overlay.Close())
+	if n.WebSocket != nil {
+		errs = append(errs, n.WebSocket.Flush(ctx))
+		errs = append(errs, n.WebSocket.Disconnect())
+	}
+	return util.JoinErrors(errs)
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/signal"
+	"github.com/matanbroner/goverlay/lib/transport/socket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, host string) *Node {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(pkid, host)
+}
+
+// withSocket gives n a socket transport, returning the URL it listens on.
+func withSocket(t *testing.T, n *Node) (*socket.Transport, string) {
+	s := socket.New(n.ID)
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Overlay.AddTransport(s)
+	return s, fmt.Sprintf("ws://%s%s", addr.String(), socket.Path)
+}
+
+func TestCloseHandsOffAndDisconnects(t *testing.T) {
+	a := newTestNode(t, "")
+	b := newTestNode(t, "")
+	aSocket, _ := withSocket(t, a)
+	bSocket, bURL := withSocket(t, b)
+	defer aSocket.Shutdown()
+	defer bSocket.Shutdown()
+	assert.NoError(t, a.Start())
+	assert.NoError(t, b.Start())
+	defer b.Close(context.Background())
+
+	// alone, a is responsible for every key
+	a.DHT.Put("key", "value", a.ID.ID, func(map[string]string) {})
+	aSocket.AddPeer(b.ID.ID, bURL)
+	assert.NoError(t, a.Overlay.Connect(b.ID.ID, nil))
+	assert.Eventually(t, func() bool {
+		return b.Overlay.IsActive(a.ID.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, a.Close(ctx))
+	assert.NoError(t, a.Close(ctx))
+	assert.Error(t, a.Start())
+	assert.False(t, a.Overlay.IsActive(b.ID.ID))
+	assert.Eventually(t, func() bool {
+		return !b.Overlay.IsActive(a.ID.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	got := make(chan map[string]string, 1)
+	b.DHT.Get("key", func(values map[string]string) {
+		got <- values
+	})
+	assert.Equal(t, map[string]string{a.ID.ID: "value"}, <-got)
+}
+
+func TestCloseAlone(t *testing.T) {
+	n := newTestNode(t, "")
+	assert.NoError(t, n.Start())
+	n.DHT.Put("key", "value", n.ID.ID, func(map[string]string) {})
+	assert.NoError(t, n.Close(context.Background()))
+}
+
+func TestRunClosesOnCancel(t *testing.T) {
+	s := signal.New()
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	n := newTestNode(t, fmt.Sprintf("ws://%s/", addr.String()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- n.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return")
+	}
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,313 @@
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/util"
+	"sort"
+	"time"
+)
+
+// UpdateFlood recomputes the flood from the currently open connections. The
+// flood holds up to MaxFloodSize predecessors and MaxFloodSize successors of
+// our ID, ordered around the ring from the farthest predecessor to the
+// farthest successor.
+//
+// Whenever the flood changes it is announced to every connected peer, and
+// newly connected peers always receive it, so that neighbours can discover
+// each other. The first connection we make also triggers a Join.
+func (o *Overlay) UpdateFlood() {
+	peers := o.openPeers()
+	o.floodLock.RLock()
+	previous := o.Flood
+	o.floodLock.RUnlock()
+	o.SetFloodPeers(peers)
+
+	o.floodLock.Lock()
+	changed := !equalIDs(previous, o.Flood)
+	announceTo := peers
+	if !changed {
+		announceTo = util.Filter(peers, func(peer string) bool {
+			return !util.Contains(o.announced, peer)
+		})
+	}
+	first := len(o.announced) == 0 && len(peers) > 0
+	o.announced = peers
+	flood := append([]string{}, o.Flood...)
+	o.floodLock.Unlock()
+
+	for _, peer := range announceTo {
+		if err := o.sendFlood(peer, flood); err != nil {
+			fmt.Printf("overlay flood update error: %s\n", err.Error())
+		}
+	}
+	if first {
+		go func() {
+			if err := o.Join(); err != nil {
+				fmt.Printf("overlay join error: %s\n", err.Error())
+			}
+		}()
+	}
+}
+
+// Join asks the node closest to our own ID to connect to us, after which the
+// flood exchange fills in the rest of our neighbourhood. The request is handed
+// to our closest peer since we are trivially the closest node to ourselves.
+func (o *Overlay) Join() error {
+	peer := o.closestPeer(o.ID.ID, nil)
+	if peer == "" {
+		return fmt.Errorf("overlay no peers to join through")
+	}
+	return o.forward(peer, &message.Message{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:           o.ID.ID,
+			From:         o.ID.ID,
+			FromInstance: o.ID.InstanceID.ID,
+			Action:       message.FindFlood,
+			Proxies:      []string{o.ID.ID},
+		},
+	})
+}
+
+// FloodFor returns the predecessors and successors, nearest first, that a
+// node with ID self would keep in its flood given peers.
+func FloodFor(self string, peers []string, maxFloodSize int) ([]string, []string) {
+	successors := append([]string{}, peers...)
+	sort.Slice(successors, func(i, j int) bool {
+		return id.DirectedDistanceBetweenIDs(self, successors[i]).Cmp(id.DirectedDistanceBetweenIDs(self, successors[j])) < 0
+	})
+	predecessors := append([]string{}, peers...)
+	sort.Slice(predecessors, func(i, j int) bool {
+		return id.DirectedDistanceBetweenIDs(predecessors[i], self).Cmp(id.DirectedDistanceBetweenIDs(predecessors[j], self)) < 0
+	})
+	if len(successors) > maxFloodSize {
+		successors = successors[:maxFloodSize]
+	}
+	if len(predecessors) > maxFloodSize {
+		predecessors = predecessors[:maxFloodSize]
+	}
+	return predecessors, successors
+}
+
+// SetFloodPeers rebuilds the flood from an explicit set of candidate peers.
+func (o *Overlay) SetFloodPeers(peers []string) {
+	predecessors, successors := FloodFor(o.ID.ID, peers, o.MaxFloodSize)
+
+	var flood []string
+	for i := len(predecessors) - 1; i >= 0; i-- {
+		flood = append(flood, predecessors[i])
+	}
+	for _, peer := range successors {
+		if !util.Contains(flood, peer) {
+			flood = append(flood, peer)
+		}
+	}
+
+	o.floodLock.Lock()
+	defer o.floodLock.Unlock()
+	o.successors = successors
+	o.predecessors = predecessors
+	o.Flood = flood
+}
+
+// FloodSnapshot returns a copy of the flood. Flood and Fingers change under
+// floodLock, so other packages read them through these accessors.
+func (o *Overlay) FloodSnapshot() []string {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return append([]string{}, o.Flood...)
+}
+
+// FingersSnapshot returns a copy of the fingers, with id.PendingID for those
+// still being looked for.
+func (o *Overlay) FingersSnapshot() []string {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return append([]string{}, o.Fingers...)
+}
+
+// AddFinger appends a finger, returning its level.
+func (o *Overlay) AddFinger(finger string) int {
+	o.floodLock.Lock()
+	defer o.floodLock.Unlock()
+	o.Fingers = append(o.Fingers, finger)
+	return len(o.Fingers) - 1
+}
+
+// SetFinger replaces the finger at level, reporting whether there is one.
+func (o *Overlay) SetFinger(level int, finger string) bool {
+	o.floodLock.Lock()
+	defer o.floodLock.Unlock()
+	if level < 0 || level >= len(o.Fingers) {
+		return false
+	}
+	o.Fingers[level] = finger
+	return true
+}
+
+// RemoveLastFinger drops the finger at the highest level, if any.
+func (o *Overlay) RemoveLastFinger() {
+	o.floodLock.Lock()
+	defer o.floodLock.Unlock()
+	if len(o.Fingers) > 0 {
+		o.Fingers = o.Fingers[:len(o.Fingers)-1]
+	}
+}
+
+// ClearFingers drops every finger.
+func (o *Overlay) ClearFingers() {
+	o.floodLock.Lock()
+	defer o.floodLock.Unlock()
+	o.Fingers = nil
+}
+
+// Successors returns the flood members following us on the ring, nearest first.
+func (o *Overlay) Successors() []string {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return append([]string{}, o.successors...)
+}
+
+// Predecessors returns the flood members preceding us on the ring, nearest first.
+func (o *Overlay) Predecessors() []string {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return append([]string{}, o.predecessors...)
+}
+
+// IsFloodFull reports whether both sides of the flood are at capacity, in
+// which case the flood no longer covers the whole network.
+func (o *Overlay) IsFloodFull() bool {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return o.isFloodFull()
+}
+
+func (o *Overlay) isFloodFull() bool {
+	return len(o.successors) == o.MaxFloodSize && len(o.predecessors) == o.MaxFloodSize
+}
+
+func (o *Overlay) InFlood(key string) bool {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return util.Contains(o.Flood, key)
+}
+
+// InFloodRange reports whether we are responsible for key, i.e. no member of
+// our flood is closer to it than we are. Once the flood is full, keys outside
+// the arc it spans always belong to someone else.
+func (o *Overlay) InFloodRange(key string) bool {
+	if !id.IsValidID(key) {
+		return false
+	}
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	if len(o.Flood) == 0 {
+		return true
+	}
+	if o.isFloodFull() {
+		first := o.Flood[0]
+		last := o.Flood[len(o.Flood)-1]
+		if id.DirectedDistanceBetweenIDs(first, key).Cmp(id.DirectedDistanceBetweenIDs(first, last)) > 0 {
+			return false
+		}
+	}
+	return id.ClosestIDInList(key, append([]string{o.ID.ID}, o.Flood...)) == o.ID.ID
+}
+
+// openPeers lists the distinct remote peers we hold an open link to.
+func (o *Overlay) openPeers() []string {
+	var peers []string
+	for _, t := range o.Transports {
+		for _, peer := range t.Peers() {
+			if peer == o.ID.ID || !id.IsValidID(peer) || util.Contains(peers, peer) {
+				continue
+			}
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// wouldJoinFlood reports whether peer would make it into our flood if we were
+// connected to it.
+func (o *Overlay) wouldJoinFlood(peer string) bool {
+	peers := o.openPeers()
+	if util.Contains(peers, peer) {
+		return false
+	}
+	predecessors, successors := FloodFor(o.ID.ID, append(peers, peer), o.MaxFloodSize)
+	return util.Contains(predecessors, peer) || util.Contains(successors, peer)
+}
+
+func (o *Overlay) sendFlood(peer string, flood []string) error {
+	bytes, err := json.Marshal(flood)
+	if err != nil {
+		return err
+	}
+	return o.forward(peer, &message.Message{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:           peer,
+			From:         o.ID.ID,
+			FromInstance: o.ID.InstanceID.ID,
+			Action:       message.FloodUpdate,
+			Value:        bytes,
+			Proxies:      []string{o.ID.ID},
+		},
+	})
+}
+
+// onFindFlood connects to a joining node whose ID we are the closest to.
+func (o *Overlay) onFindFlood(m *message.Message) {
+	if m.Data.From == o.ID.ID || !id.IsValidID(m.Data.From) {
+		return
+	}
+	o.learnReversePath(m)
+	go func() {
+		if err := o.Connect(m.Data.From, nil); err != nil {
+			fmt.Printf("overlay find flood connect error: %s\n", err.Error())
+		}
+	}()
+}
+
+// onFloodUpdate connects to any peer in a neighbour's flood which belongs in ours.
+func (o *Overlay) onFloodUpdate(m *message.Message) {
+	var flood []string
+	if err := json.Unmarshal(m.Data.Value, &flood); err != nil {
+		fmt.Printf("overlay flood update parse error: %s\n", err.Error())
+		return
+	}
+	for _, peer := range append(flood, m.Data.From) {
+		if peer == o.ID.ID || !id.IsValidID(peer) || !o.wouldJoinFlood(peer) {
+			continue
+		}
+		if peer != m.Data.From {
+			// the neighbour is linked to its flood, so can relay our signals
+			o.learnPath(peer, []string{m.Data.From})
+		}
+		go func(peer string) {
+			if err := o.Connect(peer, nil); err != nil {
+				fmt.Printf("overlay flood connect error: %s\n", err.Error())
+			}
+		}(peer)
+	}
+}
+
+func equalIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package overlay
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func idWithPrefix(prefix string) string {
+	return prefix + strings.Repeat("0", len(id.HalfMaxStr)-len(prefix))
+}
+
+func newTestOverlay(prefix string, maxFloodSize int) *Overlay {
+	o := New(&id.PublicKeyId{
+		ID:         idWithPrefix(prefix),
+		InstanceID: id.NewInstanceID(),
+	})
+	o.MaxFloodSize = maxFloodSize
+	return o
+}
+
+func TestSetFloodPeers(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	o.SetFloodPeers([]string{
+		idWithPrefix("10"),
+		idWithPrefix("70"),
+		idWithPrefix("78"),
+		idWithPrefix("88"),
+		idWithPrefix("90"),
+		idWithPrefix("f0"),
+	})
+	assert.Equal(t, []string{idWithPrefix("78"), idWithPrefix("70")}, o.Predecessors())
+	assert.Equal(t, []string{idWithPrefix("88"), idWithPrefix("90")}, o.Successors())
+	assert.Equal(t, []string{idWithPrefix("70"), idWithPrefix("78"), idWithPrefix("88"), idWithPrefix("90")}, o.Flood)
+	assert.True(t, o.IsFloodFull())
+	assert.True(t, o.InFlood(idWithPrefix("88")))
+	assert.False(t, o.InFlood(idWithPrefix("10")))
+}
+
+func TestSetFloodPeersWrapsAroundRing(t *testing.T) {
+	o := newTestOverlay("02", 1)
+	o.SetFloodPeers([]string{idWithPrefix("f0"), idWithPrefix("08"), idWithPrefix("80")})
+	assert.Equal(t, []string{idWithPrefix("f0"), idWithPrefix("08")}, o.Flood)
+}
+
+func TestInFloodRange(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	// alone on the ring, every key is ours
+	assert.True(t, o.InFloodRange(idWithPrefix("10")))
+	assert.False(t, o.InFloodRange("not-a-key"))
+
+	o.SetFloodPeers([]string{idWithPrefix("70"), idWithPrefix("78"), idWithPrefix("88"), idWithPrefix("90")})
+	assert.True(t, o.InFloodRange(idWithPrefix("81")))
+	assert.True(t, o.InFloodRange(idWithPrefix("7d")))
+	assert.False(t, o.InFloodRange(idWithPrefix("87")))
+	// outside the arc covered by a full flood
+	assert.False(t, o.InFloodRange(idWithPrefix("10")))
+
+	// with a partial flood we know the whole ring, so closeness decides
+	o.SetFloodPeers([]string{idWithPrefix("00")})
+	assert.True(t, o.InFloodRange(idWithPrefix("50")))
+	assert.False(t, o.InFloodRange(idWithPrefix("f0")))
+}
+
+func TestFingers(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	assert.Equal(t, 0, o.AddFinger(idWithPrefix("10")))
+	assert.Equal(t, 1, o.AddFinger(idWithPrefix("20")))
+	assert.True(t, o.SetFinger(1, id.PendingID))
+	assert.False(t, o.SetFinger(2, idWithPrefix("30")))
+	// snapshots are copies
+	fingers := o.FingersSnapshot()
+	fingers[0] = idWithPrefix("40")
+	assert.Equal(t, []string{idWithPrefix("10"), id.PendingID}, o.FingersSnapshot())
+
+	o.PeerClosed(idWithPrefix("10"))
+	assert.Equal(t, []string{id.PendingID, id.PendingID}, o.FingersSnapshot())
+	o.RemoveLastFinger()
+	assert.Len(t, o.FingersSnapshot(), 1)
+	o.ClearFingers()
+	assert.Empty(t, o.FingersSnapshot())
+	o.RemoveLastFinger()
+}
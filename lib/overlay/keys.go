@@ -0,0 +1,146 @@
+package overlay
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/sealer"
+	"time"
+)
+
+// SendSealed routes m to m.Data.To like SendMessage, with its Value encrypted
+// so that only the target can read it. The target's key is looked up first
+// if we do not have it, which may take until ctx is done.
+func (o *Overlay) SendSealed(ctx context.Context, m *message.Message) error {
+	key, err := o.LookupKey(ctx, m.Data.To)
+	if err != nil {
+		return err
+	}
+	m.ID = uuid.New().String()
+	m.Timestamp = time.Now()
+	m.Data.From = o.ID.ID
+	m.Data.FromInstance = o.ID.InstanceID.ID
+	if len(m.Data.Route) == 0 {
+		m.Data.Route = o.exactRoute(m.Data.To)
+	}
+	if err := sealer.SealMessage(m, key); err != nil {
+		return fmt.Errorf("overlay seal error: %s", err.Error())
+	}
+	return o.route(m)
+}
+
+// LookupKey returns the public key of peerID, asking the peer for it unless
+// we already have it. Keys are checked against the ID they are claimed for,
+// so the answer may be relayed by anyone.
+func (o *Overlay) LookupKey(ctx context.Context, peerID string) (crypto.PublicKey, error) {
+	if key, ok := o.Keys.Get(peerID); ok {
+		return key, nil
+	}
+	if !id.IsValidID(peerID) {
+		return nil, fmt.Errorf("overlay invalid key owner: %s", peerID)
+	}
+	requestID := uuid.New().String()
+	reply := make(chan struct{})
+	o.keyLock.Lock()
+	o.keyRequests[requestID] = reply
+	o.keyLock.Unlock()
+	defer func() {
+		o.keyLock.Lock()
+		delete(o.keyRequests, requestID)
+		o.keyLock.Unlock()
+	}()
+	o.SendToClosest(&message.Message{
+		ID:        requestID,
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:     peerID,
+			Route:  o.exactRoute(peerID),
+			Action: message.GetKey,
+		},
+	})
+	select {
+	case <-reply:
+		if key, ok := o.Keys.Get(peerID); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("overlay key of %s not found", id.ShortID(peerID))
+	case <-ctx.Done():
+		return nil, fmt.Errorf("overlay key lookup for %s error: %s", id.ShortID(peerID), ctx.Err().Error())
+	}
+}
+
+// exactRoute returns a route to peer, so that messages only concern peer
+// itself rather than whoever is responsible for its ID. A route learned from
+// signaling is used if we have one.
+func (o *Overlay) exactRoute(peer string) []string {
+	if route := o.SignalPath(peer); len(route) > 0 {
+		return route
+	}
+	return []string{peer}
+}
+
+// onGetKey answers a request for our public key.
+func (o *Overlay) onGetKey(m *message.Message) {
+	if m.Data.To != o.ID.ID {
+		return
+	}
+	key, err := id.EncodePublicKey(o.ID.PrivateKey.Public())
+	if err != nil {
+		fmt.Printf("overlay %s\n", err.Error())
+		return
+	}
+	bytes, err := json.Marshal(key)
+	if err != nil {
+		fmt.Printf("overlay key marshall error: %s\n", err.Error())
+		return
+	}
+	o.SendToClosest(&message.Message{
+		AckID: m.ID,
+		Data: message.MessageData{
+			To:     m.Data.From,
+			Route:  o.exactRoute(m.Data.From),
+			Action: message.Key,
+			Value:  bytes,
+		},
+	})
+}
+
+// onKey files a key we asked for, waking whoever asked.
+func (o *Overlay) onKey(m *message.Message) {
+	o.keyLock.Lock()
+	reply, ok := o.keyRequests[m.AckID]
+	delete(o.keyRequests, m.AckID)
+	o.keyLock.Unlock()
+	if !ok {
+		return
+	}
+	defer close(reply)
+	encoded := &id.PublicKey{}
+	if err := json.Unmarshal(m.Data.Value, encoded); err != nil {
+		fmt.Printf("overlay key parse error: %s\n", err.Error())
+		return
+	}
+	key, err := encoded.Decode()
+	if err != nil {
+		fmt.Printf("overlay %s\n", err.Error())
+		return
+	}
+	if err := o.Keys.Add(m.Data.From, key); err != nil {
+		fmt.Printf("overlay %s\n", err.Error())
+	}
+}
+
+// open decrypts a sealed message addressed to us.
+func (o *Overlay) open(m *message.Message) error {
+	if m.Data.To != o.ID.ID {
+		return fmt.Errorf("overlay sealed message %s is for %s", m.ID, id.ShortID(m.Data.To))
+	}
+	if err := sealer.OpenMessage(m, o.ID.PrivateKey); err != nil {
+		return fmt.Errorf("overlay open error: %s", err.Error())
+	}
+	return nil
+}
@@ -1,33 +1,63 @@
 package overlay
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/matanbroner/goverlay/lib/id"
 	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/matanbroner/goverlay/lib/util"
 	"github.com/matanbroner/goverlay/lib/wrtc"
+	"sync"
 	"time"
 )
 
 const MaxFloodSize = 5
+const MaxProxies = 32
 
 type Overlay struct {
 	ID              *id.PublicKeyId
 	Listeners       []Listener
 	Status          OverlayStatusMap
-	PendingMessages []*message.Message
+	PendingMessages []*PendingMessage
 	WebRTCWrapper   *wrtc.WebRTCWrapper
-	Fingers         []string
-	Flood           []string
-	MaxFloodSize    int
-}
+	// Transports carry messages to peers, starting with WebRTCWrapper
+	Transports   []transport.Transport
+	Fingers      []string
+	Flood        []string
+	MaxFloodSize int
+	// PendingTTL bounds how long an unroutable message is retried for
+	PendingTTL         time.Duration
+	MaxPendingMessages int
+	// MaxSignalPaths bounds how many learned routes to peers are kept
+	MaxSignalPaths int
+	// BootstrapSignaler creates signalers for connections made while we have
+	// no peers to relay signals through, e.g. via a signaling server
+	BootstrapSignaler func(peerID string, instanceID *id.InstanceID) Signaler
+	// Keys holds the public keys of peers we have sealed messages for
+	Keys *id.KeyRing
 
-type Signaler interface {
-	SetConnection(connection *wrtc.WebRTCConnection)
-	IsOverlay() bool
-	AddConnection()
-	Send(m *message.Message)
+	pendingLock  sync.Mutex
+	floodLock    sync.RWMutex
+	successors   []string
+	predecessors []string
+	// announced holds the peers which have been sent our current flood
+	announced []string
+	// closed is set once we start leaving, after which lost links no longer
+	// trigger flood updates
+	closed   bool
+	pathLock sync.Mutex
+	// signalPaths holds routes to peers greedy routing may not find yet
+	signalPaths map[string][]string
+	keyLock     sync.Mutex
+	// keyRequests holds the key lookups awaiting an answer
+	keyRequests map[string]chan struct{}
 }
 
+type Signaler = wrtc.Signaler
+
 type Listener interface {
 	OnMessage(m *message.Message)
 }
@@ -39,48 +69,404 @@ func New(i *id.PublicKeyId) *Overlay {
 			IsInitialized: false,
 			IsSubordinate: false,
 		},
-		ID:           i,
-		Listeners:    []Listener{},
-		MaxFloodSize: MaxFloodSize,
+		ID:                 i,
+		Listeners:          []Listener{},
+		MaxFloodSize:       MaxFloodSize,
+		PendingTTL:         DefaultPendingTTL,
+		MaxPendingMessages: DefaultMaxPendingMessages,
+		MaxSignalPaths:     DefaultMaxSignalPaths,
+		signalPaths:        make(map[string][]string),
+		Keys:               id.NewKeyRing(),
+		keyRequests:        make(map[string]chan struct{}),
 	}
+	o.WebRTCWrapper = wrtc.NewWebRTCWrapper(i)
+	o.WebRTCWrapper.NewSignaler = o.NewSignaler
+	o.AddTransport(o.WebRTCWrapper)
 
 	return o
 }
 
+// AddTransport registers another way of reaching peers. Routing considers
+// peers on every transport, and Connect tries the most recently added transport
+// first, leaving WebRTC, which can attempt to reach anyone, as the last resort.
+func (o *Overlay) AddTransport(t transport.Transport) {
+	o.Transports = append(o.Transports, t)
+	t.OnMessage(func(m *message.Message) {
+		if err := o.OnMessage(m); err != nil {
+			fmt.Printf("overlay message handler error: %s\n", err.Error())
+		}
+	})
+	t.OnStateChange(o.onStateChange)
+}
+
+// OnMessage unwraps an OverlayMessage envelope received from a peer and either
+// hands the inner message to our listeners or forwards it towards its target.
+// The envelope is only signed by the peer it came from, so messages are
+// dropped unless signed by their origin too.
 func (o *Overlay) OnMessage(m *message.Message) error {
+	inner := &message.Message{}
+	if err := json.Unmarshal(m.Data.Value, inner); err != nil {
+		return fmt.Errorf("overlay message parse error: %s", err.Error())
+	}
+	if err := verifyOrigin(inner); err != nil {
+		return err
+	}
+	if o.IsForThisInstance(inner) {
+		// our other instances share our ID, so it may be among the proxies
+		if !util.Contains(inner.Data.Proxies, o.ID.ID) {
+			inner.Data.Proxies = append(inner.Data.Proxies, o.ID.ID)
+		}
+		o.deliver(inner)
+		return nil
+	}
+	if util.Contains(inner.Data.Proxies, o.ID.ID) {
+		return fmt.Errorf("overlay routing loop for message %s via %v", inner.ID, id.IDsToShortIDs(inner.Data.Proxies))
+	}
+	if len(inner.Data.Proxies) >= MaxProxies {
+		return fmt.Errorf("overlay message %s exceeded %d hops", inner.ID, MaxProxies)
+	}
+	if o.IsAddressedToUs(inner) {
+		inner.Data.Proxies = append(inner.Data.Proxies, o.ID.ID)
+		o.deliver(inner)
+		return nil
+	}
+	return o.route(inner)
+}
+
+// verifyOrigin checks that m was signed by the peer it is from, replacing its
+// contents with the signed ones. Relays only add to the proxies of a message,
+// which are kept, and it must still be for the target it is routed to.
+func verifyOrigin(m *message.Message) error {
+	proxies, to, toInstance := m.Data.Proxies, m.Data.To, m.Data.ToInstance
+	if err := signer.UnpackMessage(m); err != nil {
+		return fmt.Errorf("overlay message %s from %s error: %s", m.ID, id.ShortID(m.Data.From), err.Error())
+	}
+	if m.Data.To != to || m.Data.ToInstance != toInstance {
+		return fmt.Errorf("overlay message %s was signed for %s, not %s", m.ID, id.ShortID(m.Data.To), id.ShortID(to))
+	}
+	m.Data.Proxies = proxies
 	return nil
 }
 
+// IsAddressedToUs reports whether m targets our ID or a key we are responsible
+// for. Messages with an explicit route are only for their exact target.
+func (o *Overlay) IsAddressedToUs(m *message.Message) bool {
+	return m.Data.To == o.ID.ID || len(m.Data.Route) == 0 && o.InFloodRange(m.Data.To)
+}
+
+// IsForThisInstance reports whether m targets this very instance of our ID,
+// rather than any of them.
+func (o *Overlay) IsForThisInstance(m *message.Message) bool {
+	return m.Data.To == o.ID.ID && m.Data.ToInstance == o.ID.InstanceID.ID
+}
+
+// SendMessage stamps m with a fresh ID and timestamp and routes it towards m.Data.To.
 func (o *Overlay) SendMessage(m *message.Message) error {
 	m.ID = uuid.New().String()
 	m.Timestamp = time.Now()
-	return nil
+	return o.route(m)
 }
 
-func (o *Overlay) ConnectionClosed(conn *wrtc.WebRTCConnection) error {
+// Connect opens a link to the given peer over the first transport able to
+// reach it, unless we are already connected.
+func (o *Overlay) Connect(peerID string, instanceID *id.InstanceID) error {
+	if o.IsActive(peerID) {
+		return nil
+	}
+	err := fmt.Errorf("overlay no transport to connect to %s", id.ShortID(peerID))
+	for i := len(o.Transports) - 1; i >= 0; i-- {
+		if err = o.Transports[i].Connect(peerID, instanceID); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// IsActive reports whether any transport holds an open link to peer.
+func (o *Overlay) IsActive(peer string) bool {
+	return o.transportFor(peer) != nil
+}
+
+func (o *Overlay) transportFor(peer string) transport.Transport {
+	for _, t := range o.Transports {
+		if t.IsActive(peer) {
+			return t
+		}
+	}
 	return nil
 }
 
-func (o *Overlay) AddListener(l Listener) {
-	o.Listeners = append(o.Listeners, l)
+func (o *Overlay) onStateChange(peerID string, state transport.State) {
+	if o.isClosed() {
+		return
+	}
+	switch state {
+	case transport.StateOpen:
+		o.UpdateFlood()
+	case transport.StateClosed:
+		o.PeerClosed(peerID)
+	}
 }
 
-func (o *Overlay) InFloodRange(key string) bool {
-	return false
+// Close leaves the network, telling every peer on every transport that we are
+// disconnecting before closing our link to it. Links which have yet to open
+// are closed too. Every link is attempted even if some fail.
+func (o *Overlay) Close() error {
+	o.floodLock.Lock()
+	o.closed = true
+	o.floodLock.Unlock()
+	var errs []error
+	for _, t := range o.Transports {
+		var peers []string
+		// a peer is listed once for each of its instances we are linked to
+		for _, peer := range t.Peers() {
+			if !util.Contains(peers, peer) {
+				peers = append(peers, peer)
+			}
+		}
+		for _, peer := range peers {
+			if err := t.Send(&message.Message{
+				Data: message.MessageData{
+					To:     peer,
+					Action: message.Disconnect,
+				},
+			}); err != nil {
+				errs = append(errs, err)
+			}
+			errs = append(errs, t.Close(peer))
+		}
+	}
+	errs = append(errs, o.WebRTCWrapper.Stop())
+	return util.JoinErrors(errs)
 }
 
-func (o *Overlay) InFlood(key string) bool {
-	return false
+func (o *Overlay) isClosed() bool {
+	o.floodLock.RLock()
+	defer o.floodLock.RUnlock()
+	return o.closed
 }
 
-func (o *Overlay) SendToClosest(m *message.Message) {
-	// make sure to set id here, maybe by calling SendMessage
+// PeerClosed drops a peer we lost our link to from our fingers and flood.
+func (o *Overlay) PeerClosed(peerID string) {
+	if o.IsActive(peerID) {
+		// another link to the same peer is still usable
+		return
+	}
+	o.floodLock.Lock()
+	for i, finger := range o.Fingers {
+		if finger == peerID {
+			o.Fingers[i] = id.PendingID
+		}
+	}
+	o.floodLock.Unlock()
+	o.UpdateFlood()
 }
 
-func (o *Overlay) Proxy(m *message.Message) {
+func (o *Overlay) AddListener(l Listener) {
+	o.Listeners = append(o.Listeners, l)
+}
 
+// SendToClosest hands m to the known peer closest to m.Data.To, or to our own
+// listeners if no peer is closer than we are. Messages which cannot be
+// forwarded are queued for the cleaner to retry.
+func (o *Overlay) SendToClosest(m *message.Message) {
+	if m.ID == "" {
+		if err := o.SendMessage(m); err != nil {
+			fmt.Printf("overlay send to closest error: %s\n", err.Error())
+		}
+		return
+	}
+	if err := o.route(m); err != nil {
+		fmt.Printf("overlay send to closest error: %s\n", err.Error())
+	}
 }
 
 func (o *Overlay) GoldenIDs() []string {
 	return []string{}
 }
+
+// NextHop returns the ID of the peer we should forward a message addressed to
+// key through, skipping any IDs in exclude. Our own ID is returned when no
+// reachable peer is closer to key than we are.
+func (o *Overlay) NextHop(key string, exclude []string) string {
+	peer := o.closestPeer(key, exclude)
+	if peer == "" {
+		return o.ID.ID
+	}
+	return id.ClosestIDInList(key, []string{o.ID.ID, peer})
+}
+
+// ClosestPeer returns the reachable peer closest to key, or "" if there is
+// none. Unlike NextHop it never returns our own ID.
+func (o *Overlay) ClosestPeer(key string) string {
+	return o.closestPeer(key, nil)
+}
+
+// closestPeer returns the reachable peer closest to key, or "" if there is none.
+func (o *Overlay) closestPeer(key string, exclude []string) string {
+	var candidates []string
+	for _, peer := range o.routingCandidates() {
+		if peer == o.ID.ID || util.Contains(exclude, peer) || util.Contains(candidates, peer) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return id.ClosestIDInList(key, candidates)
+}
+
+// routingCandidates lists every peer we currently hold an open channel to,
+// drawn from the flood, the fingers and any other live connection.
+func (o *Overlay) routingCandidates() []string {
+	var candidates []string
+	o.floodLock.RLock()
+	known := append(append([]string{}, o.Flood...), o.Fingers...)
+	o.floodLock.RUnlock()
+	for _, t := range o.Transports {
+		known = append(known, t.Peers()...)
+	}
+	for _, peer := range known {
+		if peer == id.PendingID || !id.IsValidID(peer) {
+			continue
+		}
+		if o.IsActive(peer) {
+			candidates = append(candidates, peer)
+		}
+	}
+	return candidates
+}
+
+func (o *Overlay) route(m *message.Message) error {
+	if !id.IsValidID(m.Data.To) {
+		return fmt.Errorf("overlay invalid destination id: %s", m.Data.To)
+	}
+	if m.Data.From == "" {
+		m.Data.From = o.ID.ID
+		m.Data.FromInstance = o.ID.InstanceID.ID
+	}
+	if !util.Contains(m.Data.Proxies, o.ID.ID) {
+		m.Data.Proxies = append(m.Data.Proxies, o.ID.ID)
+	}
+	next := o.routeHop(m)
+	if next == "" {
+		next = o.NextHop(m.Data.To, m.Data.Proxies)
+	}
+	if next == o.ID.ID {
+		o.deliver(m)
+		return nil
+	}
+	if err := o.forward(next, m); err != nil {
+		o.Enqueue(m)
+		return err
+	}
+	return nil
+}
+
+// routeHop follows the explicit route of m, if it has one, returning the
+// hop furthest along it (or the target itself) that we hold a link to.
+func (o *Overlay) routeHop(m *message.Message) string {
+	if len(m.Data.Route) == 0 {
+		return ""
+	}
+	hops := append(append([]string{}, m.Data.Route...), m.Data.To)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == o.ID.ID {
+			break
+		}
+		if !util.Contains(m.Data.Proxies, hops[i]) && o.IsActive(hops[i]) {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+// forward wraps m in an OverlayMessage envelope and sends it to the given peer.
+// Messages are signed where they start, so that relays cannot alter them.
+func (o *Overlay) forward(peer string, m *message.Message) error {
+	if m.Data.From == o.ID.ID && !m.Packed {
+		if err := signer.PackMessage(m, o.ID); err != nil {
+			return fmt.Errorf("overlay message sign error: %s", err.Error())
+		}
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("overlay message marshall error: %s", err.Error())
+	}
+	t := o.transportFor(peer)
+	if t == nil {
+		return fmt.Errorf("overlay no open link to %s", id.ShortID(peer))
+	}
+	return t.Send(&message.Message{
+		Data: message.MessageData{
+			To:     peer,
+			Action: message.OverlayMessage,
+			Value:  bytes,
+		},
+	})
+}
+
+// deliver hands m to us. Messages for another of our instances are passed on
+// to it, still sealed, whereas those for any instance are taken by the first
+// to get them.
+func (o *Overlay) deliver(m *message.Message) {
+	if m.Data.To == o.ID.ID && m.Data.ToInstance != "" && !o.IsForThisInstance(m) {
+		o.forwardToInstance(m)
+		return
+	}
+	if m.Data.Sealed {
+		if err := o.open(m); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return
+		}
+	}
+	switch m.Data.Action {
+	case message.GetKey:
+		o.onGetKey(m)
+		return
+	case message.Key:
+		o.onKey(m)
+		return
+	case message.FindFlood:
+		o.onFindFlood(m)
+	case message.FloodUpdate:
+		o.onFloodUpdate(m)
+	case message.Signal:
+		o.onSignal(m)
+		return
+	}
+	for _, l := range o.Listeners {
+		l.OnMessage(m)
+	}
+}
+
+// forwardToInstance passes m to the instance of our ID it is for, over our
+// direct connection to that instance.
+func (o *Overlay) forwardToInstance(m *message.Message) {
+	instanceID := id.InstanceIDFromString(m.Data.ToInstance)
+	if instanceID == nil {
+		fmt.Printf("overlay invalid instance id %s in message %s\n", m.Data.ToInstance, m.ID)
+		return
+	}
+	conn := o.WebRTCWrapper.GetConnection(o.ID.ID, instanceID)
+	if conn == nil || !conn.IsOpen() {
+		o.undeliverable(m, fmt.Sprintf("instance %s not connected", m.Data.ToInstance))
+		return
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		fmt.Printf("overlay message marshall error: %s\n", err.Error())
+		return
+	}
+	if err := o.WebRTCWrapper.Send(&message.Message{
+		Data: message.MessageData{
+			To:         o.ID.ID,
+			ToInstance: m.Data.ToInstance,
+			Action:     message.OverlayMessage,
+			Value:      bytes,
+		},
+	}); err != nil {
+		o.undeliverable(m, err.Error())
+	}
+}
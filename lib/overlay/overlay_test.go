@@ -0,0 +1,237 @@
+package overlay
+
+import (
+	"encoding/json"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type recordingListener struct {
+	messages []*message.Message
+}
+
+func (l *recordingListener) OnMessage(m *message.Message) {
+	l.messages = append(l.messages, m)
+}
+
+func newSender(t *testing.T) *id.PublicKeyId {
+	key, err := id.GenerateKey(id.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+// signedBy signs m as its origin sender would.
+func signedBy(t *testing.T, sender *id.PublicKeyId, m *message.Message) *message.Message {
+	m.Data.From = sender.ID
+	if err := signer.PackMessage(m, sender); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func envelope(t *testing.T, m *message.Message) *message.Message {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &message.Message{
+		Data: message.MessageData{
+			Action: message.OverlayMessage,
+			Value:  bytes,
+		},
+	}
+}
+
+func TestOnMessageDeliversToListeners(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	sender := newSender(t)
+
+	err := o.OnMessage(envelope(t, signedBy(t, sender, &message.Message{
+		ID: "m1",
+		Data: message.MessageData{
+			To:      o.ID.ID,
+			Action:  message.DHTGet,
+			Proxies: []string{sender.ID},
+		},
+	})))
+	assert.Nil(t, err)
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, "m1", l.messages[0].ID)
+	assert.Equal(t, sender.ID, l.messages[0].Data.From)
+	assert.Equal(t, message.DHTGet, l.messages[0].Data.Action)
+	assert.Equal(t, []string{sender.ID, o.ID.ID}, l.messages[0].Data.Proxies)
+}
+
+func TestOnMessageDeliversKeysInFloodRange(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+	o.SetFloodPeers([]string{idWithPrefix("70"), idWithPrefix("90")})
+
+	assert.Nil(t, o.OnMessage(envelope(t, signedBy(t, newSender(t), &message.Message{
+		ID:   "m1",
+		Data: message.MessageData{To: idWithPrefix("82"), Action: message.DHTPut},
+	}))))
+	assert.Len(t, l.messages, 1)
+}
+
+func TestOnMessageDetectsLoops(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	err := o.OnMessage(envelope(t, signedBy(t, newSender(t), &message.Message{
+		ID: "m1",
+		Data: message.MessageData{
+			To:      o.ID.ID,
+			Action:  message.DHTGet,
+			Proxies: []string{idWithPrefix("10"), o.ID.ID, idWithPrefix("20")},
+		},
+	})))
+	assert.NotNil(t, err)
+	assert.Empty(t, l.messages)
+}
+
+func TestOnMessageFromOurOtherInstance(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	// passed on by another instance of our ID, which is among the proxies
+	err := o.OnMessage(envelope(t, signedBy(t, newSender(t), &message.Message{
+		ID: "m1",
+		Data: message.MessageData{
+			To:         o.ID.ID,
+			ToInstance: o.ID.InstanceID.ID,
+			Action:     message.DHTGet,
+			Proxies:    []string{idWithPrefix("10"), o.ID.ID},
+		},
+	})))
+	assert.Nil(t, err)
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, []string{idWithPrefix("10"), o.ID.ID}, l.messages[0].Data.Proxies)
+}
+
+func TestOnMessageForOtherInstance(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	// we hold no connection to the instance, so it cannot be passed on
+	sender := newSender(t)
+	err := o.OnMessage(envelope(t, signedBy(t, sender, &message.Message{
+		ID: "m1",
+		Data: message.MessageData{
+			To:         o.ID.ID,
+			ToInstance: id.NewInstanceID().ID,
+			Action:     message.DHTGet,
+			Proxies:    []string{sender.ID},
+		},
+	})))
+	assert.Nil(t, err)
+	// the sender is told, though with no peers the notice comes back to us
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, message.Undeliverable, l.messages[0].Data.Action)
+
+	// whereas any instance may take those for no instance in particular
+	assert.Nil(t, o.OnMessage(envelope(t, signedBy(t, sender, &message.Message{
+		ID:   "m2",
+		Data: message.MessageData{To: o.ID.ID, Action: message.DHTGet},
+	}))))
+	assert.Len(t, l.messages, 2)
+	assert.Equal(t, "m2", l.messages[1].ID)
+}
+
+func TestOnMessageDropsForgedOrigin(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+	sender := newSender(t)
+
+	// unsigned messages may come from anyone
+	assert.NotNil(t, o.OnMessage(envelope(t, &message.Message{
+		ID:   "m1",
+		Data: message.MessageData{To: o.ID.ID, From: sender.ID, Action: message.DHTPut},
+	})))
+
+	// nor may relays change where a message is for
+	altered := signedBy(t, sender, &message.Message{
+		ID:   "m2",
+		Data: message.MessageData{To: idWithPrefix("82"), Action: message.DHTPut},
+	})
+	altered.Data.To = o.ID.ID
+	assert.NotNil(t, o.OnMessage(envelope(t, altered)))
+	assert.Empty(t, l.messages)
+
+	// or pass it off as another's, or change what it says, though they add
+	// themselves to its proxies
+	relayed := signedBy(t, sender, &message.Message{
+		ID:   "m3",
+		Data: message.MessageData{To: o.ID.ID, Action: message.DHTPut, Value: []byte("v")},
+	})
+	relayed.Data.From = newSender(t).ID
+	relayed.Data.Value = []byte("forged")
+	relayed.Data.Proxies = []string{sender.ID, idWithPrefix("10")}
+	assert.Nil(t, o.OnMessage(envelope(t, relayed)))
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, sender.ID, l.messages[0].Data.From)
+	assert.Equal(t, "v", string(l.messages[0].Data.Value))
+	assert.Equal(t, []string{sender.ID, idWithPrefix("10"), o.ID.ID}, l.messages[0].Data.Proxies)
+}
+
+func TestOnMessageRejectsGarbage(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	err := o.OnMessage(&message.Message{
+		Data: message.MessageData{
+			Action: message.OverlayMessage,
+			Value:  []byte("{"),
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+// instancesTransport links to a peer through two of its instances.
+type instancesTransport struct {
+	peer   string
+	sent   []*message.Message
+	closed int
+}
+
+func (t *instancesTransport) Connect(peerID string, instanceID *id.InstanceID) error { return nil }
+func (t *instancesTransport) IsActive(peerID string) bool                            { return peerID == t.peer }
+func (t *instancesTransport) Peers() []string                                        { return []string{t.peer, t.peer} }
+func (t *instancesTransport) OnMessage(handler transport.MessageHandler)             {}
+func (t *instancesTransport) OnStateChange(handler transport.StateHandler)           {}
+
+func (t *instancesTransport) Send(m *message.Message) error {
+	t.sent = append(t.sent, m)
+	return nil
+}
+
+func (t *instancesTransport) Close(peerID string) error {
+	t.closed++
+	return nil
+}
+
+func TestCloseDisconnectsEachPeerOnce(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	instances := &instancesTransport{peer: idWithPrefix("10")}
+	o.AddTransport(instances)
+	assert.NoError(t, o.Close())
+	assert.Len(t, instances.sent, 1)
+	assert.Equal(t, message.Disconnect, instances.sent[0].Data.Action)
+	assert.Equal(t, 1, instances.closed)
+}
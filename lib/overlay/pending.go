@@ -0,0 +1,174 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/message"
+	"time"
+)
+
+const DefaultPendingTTL = 2 * time.Minute
+const DefaultMaxPendingMessages = 256
+const PendingRetryBase = time.Second
+const PendingRetryMax = 30 * time.Second
+
+// DrainInterval is how often Drain retries while messages remain pending.
+const DrainInterval = 100 * time.Millisecond
+
+// PendingMessage is a message we failed to forward, along with its retry state.
+type PendingMessage struct {
+	Message   *message.Message
+	Attempts  int
+	QueuedAt  time.Time
+	NextRetry time.Time
+}
+
+// Expired reports whether the message has outlived ttl at time now.
+func (p *PendingMessage) Expired(now time.Time, ttl time.Duration) bool {
+	return now.Sub(p.QueuedAt) >= ttl
+}
+
+func backoff(attempts int) time.Duration {
+	delay := PendingRetryBase
+	for i := 1; i < attempts && delay < PendingRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > PendingRetryMax {
+		delay = PendingRetryMax
+	}
+	return delay
+}
+
+// Enqueue holds m for a later retry. Messages already queued under the same
+// ID are ignored, and the oldest message is expired when the queue is full.
+func (o *Overlay) Enqueue(m *message.Message) {
+	o.pendingLock.Lock()
+	for _, p := range o.PendingMessages {
+		if p.Message.ID == m.ID {
+			o.pendingLock.Unlock()
+			return
+		}
+	}
+	var evicted *PendingMessage
+	if o.MaxPendingMessages > 0 && len(o.PendingMessages) >= o.MaxPendingMessages {
+		evicted = o.PendingMessages[0]
+		o.PendingMessages = o.PendingMessages[1:]
+	}
+	now := time.Now()
+	o.PendingMessages = append(o.PendingMessages, &PendingMessage{
+		Message:   m,
+		QueuedAt:  now,
+		NextRetry: now.Add(backoff(1)),
+	})
+	o.pendingLock.Unlock()
+
+	if evicted != nil {
+		o.undeliverable(evicted.Message, "pending queue full")
+	}
+}
+
+// RetryPending re-proxies every queued message whose backoff has elapsed and
+// gives up on those older than PendingTTL, notifying their original sender.
+func (o *Overlay) RetryPending(now time.Time) {
+	o.pendingLock.Lock()
+	var due, expired []*PendingMessage
+	var remaining []*PendingMessage
+	for _, p := range o.PendingMessages {
+		switch {
+		case p.Expired(now, o.PendingTTL):
+			expired = append(expired, p)
+		case !now.Before(p.NextRetry):
+			p.Attempts += 1
+			p.NextRetry = now.Add(backoff(p.Attempts + 1))
+			due = append(due, p)
+			remaining = append(remaining, p)
+		default:
+			remaining = append(remaining, p)
+		}
+	}
+	o.PendingMessages = remaining
+	o.pendingLock.Unlock()
+
+	for _, p := range expired {
+		o.undeliverable(p.Message, fmt.Sprintf("expired after %d attempts", p.Attempts))
+	}
+	for _, p := range due {
+		if err := o.Proxy(p.Message); err != nil {
+			fmt.Printf("overlay proxy pending message error: %s\n", err.Error())
+			continue
+		}
+		o.removePending(p.Message.ID)
+	}
+}
+
+// Drain retries every pending message, regardless of backoff, until none
+// remain or ctx is done. It is used when leaving the network, so that
+// messages we accepted are not silently dropped.
+func (o *Overlay) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(DrainInterval)
+	defer ticker.Stop()
+	for {
+		o.pendingLock.Lock()
+		pending := append([]*PendingMessage{}, o.PendingMessages...)
+		o.pendingLock.Unlock()
+		for _, p := range pending {
+			if err := o.Proxy(p.Message); err == nil {
+				o.removePending(p.Message.ID)
+			}
+		}
+		if o.PendingCount() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("overlay drain error: %d messages still pending: %s", o.PendingCount(), ctx.Err().Error())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Proxy makes another attempt at forwarding a pending message. The proxies
+// recorded on earlier attempts are discarded so that routing can pick any
+// peer which has since become reachable. Drain and RetryPending may retry the
+// same message at once, so each attempt routes a copy of it.
+func (o *Overlay) Proxy(m *message.Message) error {
+	retry := *m
+	retry.Data.Proxies = nil
+	return o.route(&retry)
+}
+
+// PendingCount returns the number of messages waiting to be retried.
+func (o *Overlay) PendingCount() int {
+	o.pendingLock.Lock()
+	defer o.pendingLock.Unlock()
+	return len(o.PendingMessages)
+}
+
+func (o *Overlay) removePending(messageID string) {
+	o.pendingLock.Lock()
+	defer o.pendingLock.Unlock()
+	for i, p := range o.PendingMessages {
+		if p.Message.ID == messageID {
+			o.PendingMessages = append(o.PendingMessages[:i], o.PendingMessages[i+1:]...)
+			return
+		}
+	}
+}
+
+// undeliverable tells the original sender of m that we gave up on it.
+func (o *Overlay) undeliverable(m *message.Message, reason string) {
+	if m.Data.Action == message.Undeliverable || m.Data.From == "" {
+		return
+	}
+	if err := o.SendMessage(&message.Message{
+		Data: message.MessageData{
+			To:         m.Data.From,
+			ToInstance: m.Data.FromInstance,
+			Action:     message.Undeliverable,
+			Value:      []byte(reason),
+		},
+		AckID: m.ID,
+	}); err != nil {
+		fmt.Printf("overlay undeliverable notice error: %s\n", err.Error())
+	}
+}
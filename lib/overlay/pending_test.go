@@ -0,0 +1,104 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func pendingMessage(o *Overlay, messageID string, to string) *message.Message {
+	return &message.Message{
+		ID: messageID,
+		Data: message.MessageData{
+			To:     to,
+			From:   o.ID.ID,
+			Action: message.DHTGet,
+		},
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, 4*time.Second, backoff(3))
+	assert.Equal(t, PendingRetryMax, backoff(20))
+}
+
+func TestEnqueueDeduplicates(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	o.Enqueue(pendingMessage(o, "m1", idWithPrefix("10")))
+	o.Enqueue(pendingMessage(o, "m1", idWithPrefix("10")))
+	o.Enqueue(pendingMessage(o, "m2", idWithPrefix("10")))
+	assert.Equal(t, 2, o.PendingCount())
+}
+
+func TestEnqueueEvictsOldest(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	o.MaxPendingMessages = 2
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	o.Enqueue(pendingMessage(o, "m1", idWithPrefix("10")))
+	o.Enqueue(pendingMessage(o, "m2", idWithPrefix("10")))
+	o.Enqueue(pendingMessage(o, "m3", idWithPrefix("10")))
+	assert.Equal(t, 2, o.PendingCount())
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, message.Undeliverable, l.messages[0].Data.Action)
+	assert.Equal(t, "m1", l.messages[0].AckID)
+}
+
+func TestRetryPendingExpires(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	o.Enqueue(pendingMessage(o, "m1", idWithPrefix("10")))
+	o.RetryPending(time.Now().Add(o.PendingTTL))
+	assert.Equal(t, 0, o.PendingCount())
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, message.Undeliverable, l.messages[0].Data.Action)
+	assert.Equal(t, "m1", l.messages[0].AckID)
+}
+
+func TestRetryPendingWaitsForBackoff(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+
+	o.Enqueue(pendingMessage(o, "m1", idWithPrefix("10")))
+	o.RetryPending(time.Now())
+	assert.Equal(t, 1, o.PendingCount())
+	assert.Empty(t, l.messages)
+
+	// with no peers left to forward to, the retry delivers locally
+	o.RetryPending(time.Now().Add(PendingRetryBase))
+	assert.Equal(t, 0, o.PendingCount())
+	assert.Len(t, l.messages, 1)
+	assert.Equal(t, "m1", l.messages[0].ID)
+}
+
+func TestDrainWhileRetrying(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	var queued []*message.Message
+	for i := 0; i < 64; i++ {
+		m := pendingMessage(o, fmt.Sprint(i), idWithPrefix("10"))
+		m.Data.Proxies = []string{idWithPrefix("20")}
+		o.Enqueue(m)
+		queued = append(queued, m)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.RetryPending(time.Now().Add(PendingRetryBase))
+	}()
+	assert.NoError(t, o.Drain(context.Background()))
+	<-done
+	assert.Equal(t, 0, o.PendingCount())
+	// queued messages are left as they were
+	for _, m := range queued {
+		assert.Equal(t, []string{idWithPrefix("20")}, m.Data.Proxies)
+	}
+}
@@ -0,0 +1,133 @@
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/util"
+	"github.com/matanbroner/goverlay/lib/wrtc"
+)
+
+const DefaultMaxSignalPaths = 64
+
+// OverlaySignaler carries the SDP and ICE messages of one WebRTC connection
+// as overlay messages routed to the peer, so that nodes already in the ring
+// can open connections without a signaling server. Peers which are not yet
+// linked into their neighbourhood cannot be found by greedy routing, so
+// signals follow Route when we have learned one.
+type OverlaySignaler struct {
+	Overlay    *Overlay
+	To         string
+	ToInstance string
+	Route      []string
+	Connection *wrtc.WebRTCConnection
+}
+
+// NewSignaler picks how to signal a new connection: through the overlay once
+// we have an open connection to route over, otherwise with BootstrapSignaler.
+// Signals for our own other instances would be routed back to us, so they
+// always go through BootstrapSignaler.
+func (o *Overlay) NewSignaler(peerID string, instanceID *id.InstanceID) Signaler {
+	if (len(o.openPeers()) == 0 || peerID == o.ID.ID) && o.BootstrapSignaler != nil {
+		return o.BootstrapSignaler(peerID, instanceID)
+	}
+	s := &OverlaySignaler{
+		Overlay: o,
+		To:      peerID,
+		Route:   o.SignalPath(peerID),
+	}
+	if instanceID != nil {
+		s.ToInstance = instanceID.ID
+	}
+	return s
+}
+
+func (s *OverlaySignaler) SetConnection(connection *wrtc.WebRTCConnection) {
+	s.Connection = connection
+}
+
+func (s *OverlaySignaler) IsOverlay() bool {
+	return true
+}
+
+func (s *OverlaySignaler) AddConnection() {}
+
+func (s *OverlaySignaler) Send(m *message.Message) {
+	if s.Connection != nil {
+		m.Timestamp = s.Connection.Timestamp
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		fmt.Printf("overlay signal encode error: %s\n", err.Error())
+		return
+	}
+	s.Overlay.SendToClosest(&message.Message{
+		Data: message.MessageData{
+			To:         s.To,
+			ToInstance: s.ToInstance,
+			Action:     message.Signal,
+			Value:      bytes,
+			Route:      s.Route,
+		},
+	})
+}
+
+// onSignal hands a signal routed to us to the WebRTC wrapper. Signals only
+// make sense for their exact target, so those which ended up with us merely
+// because we are closest to a missing node are dropped.
+func (o *Overlay) onSignal(m *message.Message) {
+	if m.Data.To != o.ID.ID || m.Data.ToInstance != "" && m.Data.ToInstance != o.ID.InstanceID.ID {
+		return
+	}
+	signal := &message.Message{}
+	if err := json.Unmarshal(m.Data.Value, signal); err != nil {
+		fmt.Printf("overlay signal parse error: %s\n", err.Error())
+		return
+	}
+	o.learnReversePath(m)
+	reply := &OverlaySignaler{
+		Overlay:    o,
+		To:         m.Data.From,
+		ToInstance: m.Data.FromInstance,
+		Route:      o.SignalPath(m.Data.From),
+	}
+	err := o.WebRTCWrapper.HandleSignal(m.Data.From, id.InstanceIDFromString(m.Data.FromInstance), signal, reply)
+	if err != nil && !errors.Is(err, wrtc.ErrStaleSignal) {
+		fmt.Printf("overlay signal error: %s\n", err.Error())
+	}
+}
+
+// SignalPath returns the route learned to peer, if any.
+func (o *Overlay) SignalPath(peer string) []string {
+	o.pathLock.Lock()
+	defer o.pathLock.Unlock()
+	return append([]string{}, o.signalPaths[peer]...)
+}
+
+// learnPath records a route to peer, evicting an arbitrary route when full.
+func (o *Overlay) learnPath(peer string, path []string) {
+	o.pathLock.Lock()
+	defer o.pathLock.Unlock()
+	if _, ok := o.signalPaths[peer]; !ok && len(o.signalPaths) >= o.MaxSignalPaths {
+		for evict := range o.signalPaths {
+			delete(o.signalPaths, evict)
+			break
+		}
+	}
+	o.signalPaths[peer] = path
+}
+
+// learnReversePath records the way back to the sender of m along the peers
+// which relayed it to us.
+func (o *Overlay) learnReversePath(m *message.Message) {
+	var path []string
+	for i := len(m.Data.Proxies) - 1; i >= 0; i-- {
+		proxy := m.Data.Proxies[i]
+		if proxy != o.ID.ID && proxy != m.Data.From && !util.Contains(path, proxy) {
+			path = append(path, proxy)
+		}
+	}
+	o.learnPath(m.Data.From, path)
+}
@@ -0,0 +1,64 @@
+package overlay
+
+import (
+	"encoding/json"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type nopSignaler struct {
+	OverlaySignaler
+}
+
+func TestNewSignalerUsesBootstrapUntilConnected(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	assert.True(t, o.NewSignaler(idWithPrefix("10"), nil).IsOverlay())
+
+	o.BootstrapSignaler = func(peerID string, instanceID *id.InstanceID) Signaler {
+		return &nopSignaler{}
+	}
+	_, ok := o.NewSignaler(idWithPrefix("10"), nil).(*nopSignaler)
+	assert.True(t, ok)
+}
+
+func TestSignalsAreOnlyForTheirExactTarget(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	l := &recordingListener{}
+	o.AddListener(l)
+	signal, err := json.Marshal(&message.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// routed signals are not delivered to whoever is closest to their target
+	sender := newSender(t)
+	assert.Nil(t, o.OnMessage(envelope(t, signedBy(t, sender, &message.Message{
+		ID: "s1",
+		Data: message.MessageData{
+			To:     idWithPrefix("81"),
+			Action: message.Signal,
+			Value:  signal,
+			Route:  []string{idWithPrefix("20")},
+		},
+	}))))
+	assert.Empty(t, l.messages)
+	assert.Empty(t, o.SignalPath(sender.ID))
+}
+
+func TestLearnReversePath(t *testing.T) {
+	o := newTestOverlay("80", 2)
+	o.learnReversePath(&message.Message{
+		Data: message.MessageData{
+			From:    idWithPrefix("10"),
+			Proxies: []string{idWithPrefix("10"), idWithPrefix("20"), idWithPrefix("30"), o.ID.ID},
+		},
+	})
+	assert.Equal(t, []string{idWithPrefix("30"), idWithPrefix("20")}, o.SignalPath(idWithPrefix("10")))
+
+	o.MaxSignalPaths = 1
+	o.learnPath(idWithPrefix("40"), []string{idWithPrefix("50")})
+	assert.Empty(t, o.SignalPath(idWithPrefix("10")))
+	assert.Equal(t, []string{idWithPrefix("50")}, o.SignalPath(idWithPrefix("40")))
+}
@@ -0,0 +1,67 @@
+package sealer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+// ECDSA P-256 identities seal with ECDH on the same key. As for Ed25519 the
+// payload key is derived from a fresh ephemeral key agreed with the target's,
+// and the uncompressed ephemeral public key is sent in its place.
+
+// p256Info separates sealer keys from any other use of the shared secret.
+const p256Info = "goverlay sealer p256"
+
+// sealP256 returns an ephemeral public key and the payload key agreed with
+// recipient through it.
+func sealP256(recipient *ecdsa.PublicKey) ([]byte, []byte, error) {
+	curve := elliptic.P256()
+	if recipient.Curve != curve || !curve.IsOnCurve(recipient.X, recipient.Y) {
+		return nil, nil, fmt.Errorf("sealer invalid p256 key")
+	}
+	ephemeral, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralKey := elliptic.Marshal(curve, x, y)
+	shared, err := agreeP256(ephemeral, recipient.X, recipient.Y)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := deriveKey(shared, ephemeralKey, elliptic.Marshal(curve, recipient.X, recipient.Y), p256Info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeralKey, key, nil
+}
+
+// openP256 returns the payload key agreed with the ephemeral public key.
+func openP256(ephemeralKey []byte, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	curve := elliptic.P256()
+	if privateKey.Curve != curve {
+		return nil, fmt.Errorf("sealer unsupported curve %s", privateKey.Curve.Params().Name)
+	}
+	// Unmarshal refuses points which are not on the curve
+	x, y := elliptic.Unmarshal(curve, ephemeralKey)
+	if x == nil {
+		return nil, fmt.Errorf("sealer invalid ephemeral key")
+	}
+	shared, err := agreeP256(privateKey.D.FillBytes(make([]byte, 32)), x, y)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(shared, ephemeralKey, elliptic.Marshal(curve, privateKey.X, privateKey.Y), p256Info)
+}
+
+// agreeP256 returns the x coordinate of the point (x, y) multiplied by
+// scalar, the shared secret of P-256 ECDH.
+func agreeP256(scalar []byte, x, y *big.Int) ([]byte, error) {
+	sharedX, sharedY := elliptic.P256().ScalarMult(x, y, scalar)
+	if sharedX.Sign() == 0 && sharedY.Sign() == 0 {
+		return nil, fmt.Errorf("sealer key agreement error: point at infinity")
+	}
+	return sharedX.FillBytes(make([]byte, 32)), nil
+}
@@ -0,0 +1,179 @@
+// Package sealer encrypts the payloads of overlay messages for their target
+// alone. Each payload is encrypted with a fresh AES-256-GCM key, which is in
+// turn encrypted with the target's RSA key or agreed with its Ed25519 or ECDSA
+// P-256 key, while the routing fields of the message stay readable and are
+// bound to the payload as associated data.
+package sealer
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/message"
+)
+
+// keySize is the size of the AES-256 keys payloads are encrypted with.
+const keySize = 32
+
+// Sealed is an encrypted payload.
+type Sealed struct {
+	// Key is the payload key encrypted for an RSA target, or the ephemeral
+	// key it was agreed with for an Ed25519 or P-256 one
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// header holds the fields of a message which relays may not change, and
+// which the payload is bound to.
+type header struct {
+	ID     string `json:"id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Action string `json:"action"`
+}
+
+// Seal encrypts plaintext so that only the holder of the private half of
+// recipient can read it, binding it to additional data.
+func Seal(plaintext []byte, additional []byte, recipient crypto.PublicKey) ([]byte, error) {
+	var key, sealedKey []byte
+	switch recipientKey := recipient.(type) {
+	case *rsa.PublicKey:
+		key = make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipientKey, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("sealer key encrypt error: %s", err.Error())
+		}
+		sealedKey = encryptedKey
+	case ed25519.PublicKey:
+		ephemeralKey, agreedKey, err := sealX25519(recipientKey)
+		if err != nil {
+			return nil, err
+		}
+		key, sealedKey = agreedKey, ephemeralKey
+	case *ecdsa.PublicKey:
+		ephemeralKey, agreedKey, err := sealP256(recipientKey)
+		if err != nil {
+			return nil, err
+		}
+		key, sealedKey = agreedKey, ephemeralKey
+	default:
+		return nil, fmt.Errorf("sealer unsupported key %T", recipient)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&Sealed{
+		Key:        sealedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, additional),
+	})
+}
+
+// Open decrypts a payload sealed for privateKey with the same additional data.
+func Open(sealed []byte, additional []byte, privateKey crypto.Signer) ([]byte, error) {
+	s := &Sealed{}
+	if err := json.Unmarshal(sealed, s); err != nil {
+		return nil, fmt.Errorf("sealer parse error: %s", err.Error())
+	}
+	var key []byte
+	switch ownKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		decrypted, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, ownKey, s.Key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("sealer key decrypt error: %s", err.Error())
+		}
+		key = decrypted
+	case ed25519.PrivateKey:
+		agreed, err := openX25519(s.Key, ownKey)
+		if err != nil {
+			return nil, err
+		}
+		key = agreed
+	case *ecdsa.PrivateKey:
+		agreed, err := openP256(s.Key, ownKey)
+		if err != nil {
+			return nil, err
+		}
+		key = agreed
+	default:
+		return nil, fmt.Errorf("sealer unsupported key %T", privateKey)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("sealer invalid nonce")
+	}
+	plaintext, err := aead.Open(nil, s.Nonce, s.Ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("sealer decrypt error: %s", err.Error())
+	}
+	return plaintext, nil
+}
+
+// SealMessage encrypts the Value of m for recipient, which must be the key
+// of m.Data.To. The ID, sender, target and action of m must be final, since
+// changing them afterwards stops the target from opening it.
+func SealMessage(m *message.Message, recipient crypto.PublicKey) error {
+	if m.Data.Sealed {
+		return fmt.Errorf("sealer message already sealed")
+	}
+	additional, err := headerOf(m)
+	if err != nil {
+		return err
+	}
+	sealed, err := Seal(m.Data.Value, additional, recipient)
+	if err != nil {
+		return err
+	}
+	m.Data.Value = sealed
+	m.Data.Sealed = true
+	return nil
+}
+
+// OpenMessage decrypts the Value of a message sealed for privateKey.
+func OpenMessage(m *message.Message, privateKey crypto.Signer) error {
+	if !m.Data.Sealed {
+		return fmt.Errorf("sealer message is not sealed")
+	}
+	additional, err := headerOf(m)
+	if err != nil {
+		return err
+	}
+	plaintext, err := Open(m.Data.Value, additional, privateKey)
+	if err != nil {
+		return err
+	}
+	m.Data.Value = plaintext
+	m.Data.Sealed = false
+	return nil
+}
+
+func headerOf(m *message.Message) ([]byte, error) {
+	return json.Marshal(&header{ID: m.ID, From: m.Data.From, To: m.Data.To, Action: m.Data.Action})
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("sealer cipher error: %s", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
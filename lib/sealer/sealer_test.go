@@ -0,0 +1,104 @@
+package sealer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var keyTypes = []id.KeyType{id.RSA, id.Ed25519, id.ECDSAP256}
+
+func newKey(t *testing.T, keyType id.KeyType) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	if keyType == id.RSA {
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+	} else {
+		key, err = id.GenerateKey(keyType)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sealedMessage(t *testing.T, recipient crypto.PublicKey) *message.Message {
+	m := &message.Message{
+		ID: "m1",
+		Data: message.MessageData{
+			From:   "a",
+			To:     "b",
+			Action: message.DHTPut,
+			Value:  []byte("secret"),
+		},
+	}
+	assert.NoError(t, SealMessage(m, recipient))
+	assert.True(t, m.Data.Sealed)
+	assert.NotContains(t, string(m.Data.Value), "secret")
+	return m
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	for _, keyType := range keyTypes {
+		key := newKey(t, keyType)
+		m := sealedMessage(t, key.Public())
+		assert.Error(t, SealMessage(m, key.Public()))
+
+		// relays may still change the routing fields
+		m.Data.Proxies = []string{"c"}
+		m.Data.Route = []string{"d"}
+		assert.NoError(t, OpenMessage(m, key), keyType)
+		assert.False(t, m.Data.Sealed)
+		assert.Equal(t, "secret", string(m.Data.Value))
+		assert.Error(t, OpenMessage(m, key))
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	for _, keyType := range keyTypes {
+		key := newKey(t, keyType)
+
+		m := sealedMessage(t, key.Public())
+		m.Data.To = "c"
+		assert.Error(t, OpenMessage(m, key))
+
+		m = sealedMessage(t, key.Public())
+		m.Data.Action = message.DHTGet
+		assert.Error(t, OpenMessage(m, key))
+
+		m = sealedMessage(t, key.Public())
+		m.Data.Value[len(m.Data.Value)-3] ^= 1
+		assert.Error(t, OpenMessage(m, key))
+
+		m = sealedMessage(t, key.Public())
+		assert.Error(t, OpenMessage(m, newKey(t, keyType)))
+		assert.True(t, m.Data.Sealed)
+	}
+}
+
+func TestOpenRejectsInvalidEphemeralKey(t *testing.T) {
+	key := newKey(t, id.ECDSAP256)
+	m := sealedMessage(t, key.Public())
+	sealed := &Sealed{}
+	assert.NoError(t, json.Unmarshal(m.Data.Value, sealed))
+	sealed.Key[len(sealed.Key)-1] ^= 1
+	value, err := json.Marshal(sealed)
+	assert.NoError(t, err)
+	m.Data.Value = value
+	assert.Error(t, OpenMessage(m, key))
+}
+
+func TestSealUnsupportedKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	m := &message.Message{Data: message.MessageData{Value: []byte("secret")}}
+	assert.Error(t, SealMessage(m, key.Public()))
+	assert.False(t, m.Data.Sealed)
+}
@@ -0,0 +1,111 @@
+package sealer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+)
+
+// Ed25519 identities seal with X25519 on the same key, the Montgomery form of
+// the Edwards curve. The payload key is derived from a fresh ephemeral key
+// agreed with the target's, and the ephemeral public key is sent in its place.
+
+// fieldPrime is the prime 2^255 - 19 both curves are defined over.
+var fieldPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519Info separates sealer keys from any other use of the shared secret.
+const x25519Info = "goverlay sealer x25519"
+
+// x25519PublicKey converts an Ed25519 public key to X25519, mapping the
+// Edwards y coordinate to the Montgomery u = (1 + y) / (1 - y).
+func x25519PublicKey(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("sealer invalid ed25519 key")
+	}
+	y := new(big.Int).SetBytes(reverse(key))
+	// the top bit holds the sign of x, which u does not depend on
+	y.SetBit(y, 255, 0)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, fieldPrime)
+	if denominator.Sign() == 0 || y.Cmp(fieldPrime) >= 0 {
+		return nil, fmt.Errorf("sealer invalid ed25519 key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, fieldPrime))
+	u.Mod(u, fieldPrime)
+	bytes := make([]byte, curve25519.PointSize)
+	u.FillBytes(bytes)
+	return reverse(bytes), nil
+}
+
+// x25519PrivateKey converts an Ed25519 private key to the X25519 scalar it
+// signs with, which X25519 clamps as Ed25519 does.
+func x25519PrivateKey(key ed25519.PrivateKey) []byte {
+	hash := sha512.Sum512(key.Seed())
+	return hash[:curve25519.ScalarSize]
+}
+
+// sealX25519 returns an ephemeral public key and the payload key agreed with
+// recipient through it.
+func sealX25519(recipient ed25519.PublicKey) ([]byte, []byte, error) {
+	recipientKey, err := x25519PublicKey(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, nil, err
+	}
+	ephemeralKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipientKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("sealer key agreement error: %s", err.Error())
+	}
+	key, err := deriveKey(shared, ephemeralKey, recipientKey, x25519Info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeralKey, key, nil
+}
+
+// openX25519 returns the payload key agreed with the ephemeral public key.
+func openX25519(ephemeralKey []byte, privateKey ed25519.PrivateKey) ([]byte, error) {
+	scalar := x25519PrivateKey(privateKey)
+	ownKey, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(scalar, ephemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("sealer key agreement error: %s", err.Error())
+	}
+	return deriveKey(shared, ephemeralKey, ownKey, x25519Info)
+}
+
+// deriveKey stretches a shared secret into a payload key, binding both
+// public keys of the agreement and the curve it was made on.
+func deriveKey(shared []byte, ephemeralKey []byte, recipientKey []byte, info string) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralKey...), recipientKey...)
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("sealer key derivation error: %s", err.Error())
+	}
+	return key, nil
+}
+
+func reverse(bytes []byte) []byte {
+	reversed := make([]byte, len(bytes))
+	for i, b := range bytes {
+		reversed[len(bytes)-1-i] = b
+	}
+	return reversed
+}
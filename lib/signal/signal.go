@@ -0,0 +1,463 @@
+// Package signal is the rendezvous server that ws.WebSocketWrapper clients
+// talk to. It authenticates each client by its signed hello, hands out
+// bootstrap peers, and relays addressed messages such as SDP offers, answers
+// and ICE candidates between clients which have no connection yet.
+package signal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/keepalive"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultBootstrapSize = 3
+const HelloTimeout = 10 * time.Second
+
+// Peer identifies a single connected client instance.
+type Peer = message.Peer
+
+type Server struct {
+	// BootstrapSize is how many peers are handed to a client on Connect
+	BootstrapSize int
+	// PingInterval is how often clients are pinged, and ReadTimeout how long
+	// a client may stay silent before it is considered gone
+	PingInterval time.Duration
+	ReadTimeout  time.Duration
+	Upgrader     websocket.Upgrader
+	// Replay remembers the signed messages received, to refuse them if
+	// replayed
+	Replay *signer.ReplayCache
+
+	lock    sync.Mutex
+	clients map[Peer]*client
+	// conns holds every upgraded socket, including those still saying hello
+	conns  map[*websocket.Conn]bool
+	server *http.Server
+}
+
+type client struct {
+	peer Peer
+	conn *websocket.Conn
+	// confirmed is set once the client reports a working peer connection,
+	// after which it is preferred as a bootstrap peer for others
+	confirmed bool
+	// latency is the round trip time measured by the last ping
+	latency time.Duration
+	// agreement is the protocol settled on from the client's hello
+	agreement *message.Agreement
+	writeLock sync.Mutex
+}
+
+func New() *Server {
+	return &Server{
+		BootstrapSize: DefaultBootstrapSize,
+		PingInterval:  keepalive.DefaultPingInterval,
+		ReadTimeout:   keepalive.DefaultReadTimeout,
+		Replay:        signer.NewReplayCache(),
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: make(map[Peer]*client),
+		conns:   make(map[*websocket.Conn]bool),
+	}
+}
+
+// Listen serves clients on addr, returning the address actually bound so
+// that ":0" can be used.
+func (s *Server) Listen(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.server = &http.Server{Handler: s}
+	server := s.server
+	s.lock.Unlock()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("signal serve error: %s\n", err.Error())
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// Shutdown stops listening and drops every client.
+func (s *Server) Shutdown() error {
+	s.lock.Lock()
+	server := s.server
+	s.server = nil
+	conns := make([]*websocket.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	if server != nil {
+		return server.Close()
+	}
+	return nil
+}
+
+// Latency returns the round trip time last measured to a connected client.
+func (s *Server) Latency(peer Peer) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.clients[peer]
+	if !ok {
+		return 0, false
+	}
+	return c.latency, true
+}
+
+// Agreement returns the protocol settled on with a connected client.
+func (s *Server) Agreement(peer Peer) (*message.Agreement, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.clients[peer]
+	if !ok {
+		return nil, false
+	}
+	return c.agreement, true
+}
+
+// Peers lists the client instances currently connected.
+func (s *Server) Peers() []Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	peers := make([]Peer, 0, len(s.clients))
+	for peer := range s.clients {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("signal upgrade error: %s\n", err.Error())
+		return
+	}
+	s.lock.Lock()
+	s.conns[conn] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+	}()
+	c, hello, err := s.hello(conn)
+	if err != nil {
+		fmt.Printf("signal hello error: %s\n", err.Error())
+		_ = conn.Close()
+		return
+	}
+	defer s.remove(c)
+	done := make(chan struct{})
+	defer close(done)
+	keepalive.Start(conn, s.ReadTimeout, func(latency time.Duration) {
+		s.lock.Lock()
+		c.latency = latency
+		s.lock.Unlock()
+	})
+	go s.ping(c, done)
+	s.onHello(c, hello)
+	for {
+		_, bytes, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		m, err := message.Decode(bytes)
+		if err != nil {
+			fmt.Printf("signal %s\n", err.Error())
+			continue
+		}
+		if err := s.verify(c, m); err != nil {
+			fmt.Printf("signal verify error: %s\n", err.Error())
+			if errors.Is(err, signer.ErrReplayed) {
+				// most likely resent after a reconnection, so that the
+				// client is waiting for our ack. Stale messages were never
+				// seen, so they are not acked.
+				s.ack(c, m.ID)
+			}
+			continue
+		}
+		s.onMessage(c, m, bytes)
+	}
+}
+
+// hello reads the first message from a client, which must be a signed
+// Connect or Reconnect, and registers the client under the peer it proves to be.
+func (s *Server) hello(conn *websocket.Conn) (*client, *message.Message, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(HelloTimeout))
+	_, bytes, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	m, err := message.Decode(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := signer.UnpackMessage(m); err != nil {
+		return nil, nil, err
+	}
+	if err := s.Replay.CheckMessage(m); err != nil {
+		return nil, nil, err
+	}
+	if m.Data.Action != message.Connect && m.Data.Action != message.Reconnect {
+		return nil, nil, fmt.Errorf("signal expected hello but got %s", m.Data.Action)
+	}
+	// clients which send no protocol predate the handshake
+	agreement, err := message.Negotiate(m.Data.Protocol)
+	if err != nil {
+		s.refuse(conn, m, err)
+		return nil, nil, err
+	}
+	c := &client{
+		peer:      Peer{ID: m.Data.From, InstanceID: m.Data.FromInstance},
+		conn:      conn,
+		agreement: agreement,
+		// a reconnecting client is already part of the network
+		confirmed: m.Data.Action == message.Reconnect,
+	}
+	s.lock.Lock()
+	previous := s.clients[c.peer]
+	s.clients[c.peer] = c
+	s.lock.Unlock()
+	if previous != nil {
+		_ = previous.conn.Close()
+	}
+	return c, m, nil
+}
+
+// ping keeps a client's socket alive until done is closed.
+func (s *Server) ping(c *client, done chan struct{}) {
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := keepalive.Ping(c.conn, s.PingInterval); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) remove(c *client) {
+	s.lock.Lock()
+	if s.clients[c.peer] == c {
+		delete(s.clients, c.peer)
+	}
+	s.lock.Unlock()
+	_ = c.conn.Close()
+}
+
+// verify checks that m was sent by the client it arrived from. Packed
+// messages are verified by signature, unpacked ones must at least not claim
+// another sender.
+func (s *Server) verify(c *client, m *message.Message) error {
+	if m.Packed {
+		if err := signer.UnpackMessage(m); err != nil {
+			return err
+		}
+		if err := s.Replay.CheckMessage(m); err != nil {
+			return err
+		}
+	}
+	if m.Data.From != c.peer.ID || m.Data.FromInstance != "" && m.Data.FromInstance != c.peer.InstanceID {
+		return fmt.Errorf("signal client %s claimed to be %s", id.ShortID(c.peer.ID), id.ShortID(m.Data.From))
+	}
+	return nil
+}
+
+func (s *Server) onHello(c *client, m *message.Message) {
+	var peers []Peer
+	if m.Data.Action == message.Connect {
+		peers = s.bootstrapPeers(c.peer)
+	}
+	if err := s.reply(c, m.Data.Action, m.ID, peers, message.LocalHello()); err != nil {
+		fmt.Printf("signal hello reply error: %s\n", err.Error())
+	}
+}
+
+func (s *Server) onMessage(c *client, m *message.Message, raw []byte) {
+	switch m.Data.Action {
+	case message.Connect, message.Reconnect:
+		fmt.Printf("signal duplicate hello from %s\n", id.ShortID(c.peer.ID))
+	case message.Confirm:
+		s.lock.Lock()
+		c.confirmed = true
+		s.lock.Unlock()
+		s.ack(c, m.ID)
+	case message.GetBlock:
+		if err := s.reply(c, message.GetBlock, m.ID, s.bootstrapPeers(c.peer), nil); err != nil {
+			fmt.Printf("signal get block reply error: %s\n", err.Error())
+		}
+	case message.Disconnect:
+		_ = c.conn.Close()
+	default:
+		if s.relay(c, m, raw) {
+			s.ack(c, m.ID)
+		}
+	}
+}
+
+// relay passes an addressed message on untouched, so that its recipient can
+// check the original signature. Messages without a ToInstance reach every
+// instance of the recipient. It reports whether the message was relayed, and
+// otherwise tells the sender that it was undeliverable.
+func (s *Server) relay(from *client, m *message.Message, raw []byte) bool {
+	if m.Data.To == "" {
+		fmt.Printf("signal unaddressed message from %s\n", id.ShortID(from.peer.ID))
+		return false
+	}
+	s.lock.Lock()
+	var targets []*client
+	for peer, c := range s.clients {
+		if peer.ID == m.Data.To && (m.Data.ToInstance == "" || peer.InstanceID == m.Data.ToInstance) {
+			targets = append(targets, c)
+		}
+	}
+	s.lock.Unlock()
+	if len(targets) == 0 {
+		s.undeliverable(from, m)
+		return false
+	}
+	for _, c := range targets {
+		if err := c.write(raw); err != nil {
+			fmt.Printf("signal relay error: %s\n", err.Error())
+		}
+	}
+	return true
+}
+
+// bootstrapPeers picks up to BootstrapSize other clients for peer to connect
+// to, preferring those which have confirmed a working connection.
+func (s *Server) bootstrapPeers(peer Peer) []Peer {
+	s.lock.Lock()
+	var confirmed, unconfirmed []Peer
+	for other, c := range s.clients {
+		if other.ID == peer.ID {
+			continue
+		}
+		if c.confirmed {
+			confirmed = append(confirmed, other)
+		} else {
+			unconfirmed = append(unconfirmed, other)
+		}
+	}
+	s.lock.Unlock()
+	rand.Shuffle(len(confirmed), func(i, j int) {
+		confirmed[i], confirmed[j] = confirmed[j], confirmed[i]
+	})
+	rand.Shuffle(len(unconfirmed), func(i, j int) {
+		unconfirmed[i], unconfirmed[j] = unconfirmed[j], unconfirmed[i]
+	})
+	peers := append(confirmed, unconfirmed...)
+	if len(peers) > s.BootstrapSize {
+		peers = peers[:s.BootstrapSize]
+	}
+	return peers
+}
+
+func (s *Server) reply(c *client, action string, ackID string, peers []Peer, hello *message.Hello) error {
+	value, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	return s.send(c, &message.Message{
+		AckID: ackID,
+		Data: message.MessageData{
+			To:         c.peer.ID,
+			ToInstance: c.peer.InstanceID,
+			Action:     action,
+			Value:      value,
+			Protocol:   hello,
+		},
+	})
+}
+
+// refuse tells a client whose protocol we cannot speak why, along with what
+// we do speak.
+func (s *Server) refuse(conn *websocket.Conn, m *message.Message, reason error) {
+	bytes, err := message.Encode(&message.Message{
+		AckID:     m.ID,
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:         m.Data.From,
+			ToInstance: m.Data.FromInstance,
+			Action:     message.Incompatible,
+			Value:      []byte(reason.Error()),
+			Protocol:   message.LocalHello(),
+		},
+	})
+	if err == nil {
+		err = conn.WriteMessage(websocket.TextMessage, bytes)
+	}
+	if err != nil {
+		fmt.Printf("signal refuse error: %s\n", err.Error())
+	}
+}
+
+// ack tells a client that we have handled its message, so that it need not
+// resend it after reconnecting.
+func (s *Server) ack(c *client, messageID string) {
+	if messageID == "" {
+		return
+	}
+	if err := s.send(c, &message.Message{
+		AckID: messageID,
+		Data: message.MessageData{
+			To:         c.peer.ID,
+			ToInstance: c.peer.InstanceID,
+			Action:     message.Ack,
+		},
+	}); err != nil {
+		fmt.Printf("signal ack error: %s\n", err.Error())
+	}
+}
+
+func (s *Server) undeliverable(c *client, m *message.Message) {
+	if err := s.send(c, &message.Message{
+		AckID: m.ID,
+		Data: message.MessageData{
+			To:         c.peer.ID,
+			ToInstance: c.peer.InstanceID,
+			Action:     message.Undeliverable,
+			Value:      []byte(fmt.Sprintf("%s is not connected", id.ShortID(m.Data.To))),
+		},
+	}); err != nil {
+		fmt.Printf("signal undeliverable notice error: %s\n", err.Error())
+	}
+}
+
+func (s *Server) send(c *client, m *message.Message) error {
+	m.Timestamp = time.Now()
+	bytes, err := message.Encode(m)
+	if err != nil {
+		return err
+	}
+	return c.write(bytes)
+}
+
+func (c *client) write(bytes []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, bytes)
+}
@@ -0,0 +1,324 @@
+package signal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t    *testing.T
+	ID   *id.PublicKeyId
+	conn *websocket.Conn
+}
+
+func newTestServer(t *testing.T) (*Server, string) {
+	s := New()
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fmt.Sprintf("ws://%s/", addr.String())
+}
+
+func dial(t *testing.T, url string, action string) (*testClient, []Peer) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, ID: pkid, conn: conn}
+	c.send(&message.Message{Data: message.MessageData{Action: action}}, true)
+	reply := c.read()
+	assert.Equal(t, action, reply.Data.Action)
+	var peers []Peer
+	if err := json.Unmarshal(reply.Data.Value, &peers); err != nil {
+		t.Fatal(err)
+	}
+	return c, peers
+}
+
+func (c *testClient) send(m *message.Message, packed bool) {
+	if m.Data.From == "" {
+		m.Data.From = c.ID.ID
+		m.Data.FromInstance = c.ID.InstanceID.ID
+	}
+	var bytes []byte
+	var err error
+	if packed {
+		if err := signer.PackMessage(m, c.ID); err != nil {
+			c.t.Fatal(err)
+		}
+		bytes, err = json.Marshal(m)
+	} else {
+		bytes, err = message.Encode(m)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() *message.Message {
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, bytes, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := message.Decode(bytes)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if m.Packed {
+		if err := signer.UnpackMessage(m); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestBootstrapAndRelay(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+
+	a, peers := dial(t, url, message.Connect)
+	assert.Empty(t, peers)
+	b, peers := dial(t, url, message.Connect)
+	assert.Equal(t, []Peer{{ID: a.ID.ID, InstanceID: a.ID.InstanceID.ID}}, peers)
+	assert.Len(t, s.Peers(), 2)
+
+	b.send(&message.Message{
+		ID: "offer",
+		Data: message.MessageData{
+			To:     a.ID.ID,
+			Action: "offer",
+			Value:  []byte("sdp"),
+		},
+	}, true)
+	m := a.read()
+	assert.Equal(t, "offer", m.ID)
+	assert.Equal(t, b.ID.ID, m.Data.From)
+	assert.Equal(t, []byte("sdp"), m.Data.Value)
+	m = b.read()
+	assert.Equal(t, message.Ack, m.Data.Action)
+	assert.Equal(t, "offer", m.AckID)
+
+	// messages claiming another sender are dropped
+	b.send(&message.Message{
+		Data: message.MessageData{
+			To:     a.ID.ID,
+			From:   idWithPrefix("ab"),
+			Action: "offer",
+		},
+	}, false)
+
+	b.send(&message.Message{
+		ID: "lost",
+		Data: message.MessageData{
+			To:     idWithPrefix("cd"),
+			Action: "offer",
+		},
+	}, true)
+	m = b.read()
+	assert.Equal(t, message.Undeliverable, m.Data.Action)
+	assert.Equal(t, "lost", m.AckID)
+}
+
+func TestBootstrapPrefersConfirmed(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+	s.BootstrapSize = 1
+
+	dial(t, url, message.Connect)
+	confirmed, _ := dial(t, url, message.Connect)
+	confirmed.send(&message.Message{ID: "confirm", Data: message.MessageData{Action: message.Confirm}}, true)
+	assert.Equal(t, "confirm", confirmed.read().AckID)
+
+	for i := 0; i < 5; i++ {
+		c, peers := dial(t, url, message.Connect)
+		assert.Equal(t, []Peer{{ID: confirmed.ID.ID, InstanceID: confirmed.ID.InstanceID.ID}}, peers)
+		_ = c.conn.Close()
+	}
+}
+
+func TestRejectsForgedHello(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := message.Encode(&message.Message{
+		Data: message.MessageData{
+			Action: message.Connect,
+			From:   idWithPrefix("ab"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, bytes))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+	assert.Empty(t, s.Peers())
+}
+
+func idWithPrefix(prefix string) string {
+	return prefix + id.HalfMaxStr[len(prefix):]
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+	s.PingInterval = 20 * time.Millisecond
+	s.ReadTimeout = 100 * time.Millisecond
+
+	live, _ := dial(t, url, message.Connect)
+	silent, _ := dial(t, url, message.Connect)
+	// reading is what answers pings
+	go func() {
+		for {
+			if _, _, err := live.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	livePeer := Peer{ID: live.ID.ID, InstanceID: live.ID.InstanceID.ID}
+	assert.Eventually(t, func() bool {
+		latency, ok := s.Latency(livePeer)
+		return ok && latency > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, ok := s.Latency(Peer{ID: silent.ID.ID, InstanceID: silent.ID.InstanceID.ID})
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []Peer{livePeer}, s.Peers())
+}
+
+func TestHelloProtocol(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+
+	// clients which predate the handshake get the base protocol
+	legacy, _ := dial(t, url, message.Connect)
+	defer legacy.conn.Close()
+	agreement, ok := s.Agreement(Peer{ID: legacy.ID.ID, InstanceID: legacy.ID.InstanceID.ID})
+	assert.True(t, ok)
+	assert.Equal(t, 0, agreement.Version)
+	assert.Equal(t, message.JSON, agreement.Codec)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := func(protocol *message.Hello) *testClient {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testClient{t: t, ID: pkid, conn: conn}
+		c.send(&message.Message{Data: message.MessageData{Action: message.Connect, Protocol: protocol}}, true)
+		return c
+	}
+	current := hello(message.LocalHello())
+	defer current.conn.Close()
+	reply := current.read()
+	assert.Equal(t, message.Connect, reply.Data.Action)
+	assert.Equal(t, message.ProtocolVersion, reply.Data.Protocol.Version)
+	agreement, _ = s.Agreement(Peer{ID: pkid.ID, InstanceID: pkid.InstanceID.ID})
+	assert.Equal(t, message.ProtocolVersion, agreement.Version)
+	assert.Equal(t, message.Binary, agreement.Codec)
+
+	// a client too new for us is told so and dropped
+	future := hello(&message.Hello{Version: message.ProtocolVersion + 2, MinVersion: message.ProtocolVersion + 1})
+	reply = future.read()
+	assert.Equal(t, message.Incompatible, reply.Data.Action)
+	assert.Equal(t, message.ProtocolVersion, reply.Data.Protocol.Version)
+	_, _, err = future.conn.ReadMessage()
+	assert.Error(t, err)
+	agreement, _ = s.Agreement(Peer{ID: pkid.ID, InstanceID: pkid.InstanceID.ID})
+	assert.Equal(t, message.ProtocolVersion, agreement.Version)
+}
+
+func TestRefusesReplays(t *testing.T) {
+	s, url := newTestServer(t)
+	defer s.Shutdown()
+
+	a, _ := dial(t, url, message.Connect)
+	b, _ := dial(t, url, message.Connect)
+	offer := &message.Message{
+		ID: "offer",
+		Data: message.MessageData{
+			From:         b.ID.ID,
+			FromInstance: b.ID.InstanceID.ID,
+			To:           a.ID.ID,
+			Action:       "offer",
+		},
+	}
+	if err := signer.PackMessage(offer, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	captured, err := json.Marshal(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.conn.WriteMessage(websocket.TextMessage, captured))
+		// the replay is acknowledged, as for a resend, but not relayed
+		m := b.read()
+		assert.Equal(t, message.Ack, m.Data.Action)
+		assert.Equal(t, "offer", m.AckID)
+	}
+	assert.Equal(t, "offer", a.read().ID)
+	_ = a.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = a.conn.ReadMessage()
+	assert.Error(t, err)
+
+	// a captured hello does not get anyone in either
+	hello := &message.Message{Data: message.MessageData{
+		From:         b.ID.ID,
+		FromInstance: b.ID.InstanceID.ID,
+		Action:       message.Connect,
+	}}
+	if err := signer.PackMessage(hello, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	captured, err = json.Marshal(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, accepted := range []bool{true, false} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, captured))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		assert.Equal(t, accepted, err == nil, "hello %d", i)
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"sync/atomic"
+	"time"
+)
+
+// PackMessage signs the Data, ID, Timestamp and AckID of m with the key of i, storing
+// the result in EncodedData so that any recipient can check that i sent it,
+// and when. Messages without an ID or Timestamp are given them.
+func PackMessage(m *message.Message, i *id.PublicKeyId) error {
+	if m.ID == "" {
+		m.ID = uuid.New().String()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	bytes, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	timestamp := m.Timestamp
+	packed, err := pack(&PackableData{Data: string(bytes), ID: m.ID, Timestamp: &timestamp, AckID: m.AckID}, i.PrivateKey)
+	if err != nil {
+		return err
+	}
+	packed.VerifyID = i.ID
+	packedBytes, err := json.Marshal(packed)
+	if err != nil {
+		return err
+	}
+	m.EncodedData = packedBytes
+	m.Packed = true
+	return nil
+}
+
+// legacyIDPrefix starts the IDs given to messages signed without one.
+const legacyIDPrefix = "legacy-"
+
+// ErrUnbound is returned for messages signed without an ID or Timestamp while
+// they are not accepted.
+var ErrUnbound = errors.New("signer message is not bound to an id and timestamp")
+
+// acceptUnbound is set while messages signed without an ID or Timestamp are
+// accepted. It is read on every message, so it is only changed atomically.
+var acceptUnbound int32
+
+// SetAcceptUnboundMessages allows or refuses messages signed without an ID
+// or Timestamp, as peers which predate binding them, the JS Woverlay peers
+// and older Go nodes, sign them. They are refused unless allowed, as nothing
+// stops such a message being replayed once it leaves the freshness window of
+// a replay cache. The setting goes once those peers are upgraded.
+func SetAcceptUnboundMessages(accept bool) {
+	var value int32
+	if accept {
+		value = 1
+	}
+	atomic.StoreInt32(&acceptUnbound, value)
+}
+
+// AcceptsUnboundMessages reports whether messages signed without an ID or
+// Timestamp are accepted.
+func AcceptsUnboundMessages() bool {
+	return atomic.LoadInt32(&acceptUnbound) == 1
+}
+
+// UnpackMessage checks the signature of a packed message and replaces its
+// Data, ID, Timestamp and AckID with the signed ones. The signer is taken from VerifyID, or from
+// the claimed sender for peers which do not set it, and must be the sender
+// named in the signed contents.
+//
+// Messages signed without an ID or Timestamp are refused with ErrUnbound
+// unless AcceptsUnboundMessages. When accepted they get the digest of what
+// was signed as ID and their arrival as Timestamp, so that a replay cache
+// still refuses them when resent within its freshness window.
+func UnpackMessage(m *message.Message) error {
+	if !m.Packed {
+		return fmt.Errorf("signer message is not packed")
+	}
+	packed := &SignedData{}
+	if err := json.Unmarshal(m.EncodedData, packed); err != nil {
+		return err
+	}
+	claimed := packed.VerifyID
+	if claimed == "" {
+		claimed = m.Data.From
+	}
+	unpacked, err := Unpack(packed, &id.PublicKeyId{ID: claimed})
+	if err != nil {
+		return err
+	}
+	data := message.MessageData{}
+	if err := json.Unmarshal([]byte(unpacked.Data), &data); err != nil {
+		return err
+	}
+	if data.From != claimed {
+		return fmt.Errorf("signer message from %s was signed by %s", id.ShortID(data.From), id.ShortID(claimed))
+	}
+	if unpacked.ID == "" || unpacked.Timestamp == nil || unpacked.Timestamp.IsZero() {
+		if !AcceptsUnboundMessages() {
+			return ErrUnbound
+		}
+		digest := sha256.Sum256(packed.Signed)
+		m.Data = data
+		m.ID = legacyIDPrefix + hex.EncodeToString(digest[:])
+		m.Timestamp = time.Now()
+		return nil
+	}
+	m.Data = data
+	m.ID = unpacked.ID
+	m.Timestamp = *unpacked.Timestamp
+	m.AckID = unpacked.AckID
+	return nil
+}
@@ -0,0 +1,133 @@
+package signer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/message"
+	"sync"
+	"time"
+)
+
+// DefaultFreshness is how far the signed timestamp of a message may be from
+// our clock, and DefaultReplayCacheSize how many messages are remembered.
+const DefaultFreshness = 2 * time.Minute
+const DefaultReplayCacheSize = 8192
+
+// ErrReplayed is returned by Check for messages which were already seen.
+var ErrReplayed = errors.New("signer message replayed")
+
+// ErrStale is returned by Check for messages too old to tell whether they
+// were seen: outside the freshness window, or no newer than messages from the
+// same sender which were forgotten to make room.
+var ErrStale = errors.New("signer message too old to check for replays")
+
+// ReplayCache remembers the signed messages recently received, so that a
+// captured message cannot be delivered again. Messages outside the freshness
+// window are refused outright, so only those inside it need remembering.
+type ReplayCache struct {
+	// Freshness is how far a message's timestamp may be from now
+	Freshness time.Duration
+	// MaxEntries bounds the messages remembered. Once it is reached the
+	// oldest are forgotten, and messages from their senders no newer than
+	// them are refused. Each sender has its own floor, so that one sending
+	// many messages stamped ahead of time cannot lock out the others.
+	MaxEntries int
+
+	lock  sync.Mutex
+	seen  map[string]bool
+	order []seenMessage
+	// floors holds, by sender, the newest timestamp forgotten to make room
+	floors map[string]time.Time
+	// pruned is when floors which left the freshness window were last dropped
+	pruned time.Time
+}
+
+type seenMessage struct {
+	sender    string
+	key       string
+	timestamp time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		Freshness:  DefaultFreshness,
+		MaxEntries: DefaultReplayCacheSize,
+		seen:       make(map[string]bool),
+		floors:     make(map[string]time.Time),
+	}
+}
+
+// CheckMessage checks a message unpacked by UnpackMessage, which holds the
+// signed ID and Timestamp.
+func (c *ReplayCache) CheckMessage(m *message.Message) error {
+	return c.Check(m.Data.From, m.ID, m.Timestamp)
+}
+
+// Check records the message from sender with the given ID and timestamp,
+// failing with ErrReplayed if it was seen before, or ErrStale if it is too
+// old to tell.
+func (c *ReplayCache) Check(sender string, messageID string, timestamp time.Time) error {
+	if messageID == "" {
+		return fmt.Errorf("signer message has no id")
+	}
+	now := time.Now()
+	if timestamp.Before(now.Add(-c.Freshness)) {
+		return fmt.Errorf("%w: sent %s ago", ErrStale, now.Sub(timestamp).Round(time.Second))
+	}
+	if timestamp.After(now.Add(c.Freshness)) {
+		return fmt.Errorf("signer message from the future: %s", timestamp.Format(time.RFC3339))
+	}
+	key := sender + "|" + messageID
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expire(now)
+	if c.seen[key] {
+		return ErrReplayed
+	}
+	if !timestamp.After(c.floors[sender]) {
+		return ErrStale
+	}
+	c.seen[key] = true
+	c.order = append(c.order, seenMessage{sender: sender, key: key, timestamp: timestamp})
+	for len(c.order) > c.MaxEntries {
+		oldest := c.forget()
+		if oldest.timestamp.After(c.floors[oldest.sender]) {
+			c.floors[oldest.sender] = oldest.timestamp
+		}
+	}
+	return nil
+}
+
+// expire forgets messages which have left the freshness window, and would
+// now be refused as stale anyway. Messages are forgotten in the order they
+// arrived, which is close enough to the order they were sent in. Floors
+// which left the window are dropped too, every so often.
+func (c *ReplayCache) expire(now time.Time) {
+	window := now.Add(-c.Freshness)
+	for len(c.order) > 0 && c.order[0].timestamp.Before(window) {
+		c.forget()
+	}
+	if now.Sub(c.pruned) < c.Freshness {
+		return
+	}
+	c.pruned = now
+	for sender, floor := range c.floors {
+		if floor.Before(window) {
+			delete(c.floors, sender)
+		}
+	}
+}
+
+func (c *ReplayCache) forget() seenMessage {
+	oldest := c.order[0]
+	c.order = c.order[1:]
+	delete(c.seen, oldest.key)
+	return oldest
+}
+
+// Len returns how many messages are remembered.
+func (c *ReplayCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.order)
+}
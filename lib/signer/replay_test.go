@@ -0,0 +1,124 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	msg "github.com/matanbroner/goverlay/lib/message"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache()
+	now := time.Now()
+	assert.NoError(t, c.Check("a", "1", now))
+	assert.True(t, errors.Is(c.Check("a", "1", now), ErrReplayed))
+	// IDs are per sender
+	assert.NoError(t, c.Check("b", "1", now))
+	assert.True(t, errors.Is(c.Check("a", "2", now.Add(-time.Hour)), ErrStale))
+	assert.Error(t, c.Check("a", "3", now.Add(time.Hour)))
+	assert.Error(t, c.Check("a", "", now))
+
+	// once full, the oldest are forgotten and nothing as old from their
+	// sender is accepted
+	c.MaxEntries = 2
+	assert.NoError(t, c.Check("a", "4", now.Add(time.Second)))
+	assert.Equal(t, 2, c.Len())
+	assert.True(t, errors.Is(c.Check("a", "1", now), ErrStale))
+	assert.True(t, errors.Is(c.Check("a", "5", now), ErrStale))
+	assert.NoError(t, c.Check("a", "6", now.Add(2*time.Second)))
+	assert.True(t, errors.Is(c.Check("a", "6", now.Add(2*time.Second)), ErrReplayed))
+
+	// a sender filling the cache with messages stamped ahead of time does
+	// not lock the others out
+	c = NewReplayCache()
+	c.MaxEntries = 8
+	assert.NoError(t, c.Check("honest", "1", now))
+	for i := 0; i < 16; i++ {
+		assert.NoError(t, c.Check("flooder", fmt.Sprint(i), now.Add(c.Freshness-time.Second+time.Duration(i)*time.Millisecond)))
+	}
+	assert.NoError(t, c.Check("honest", "2", time.Now()))
+	assert.NoError(t, c.Check("other", "1", time.Now()))
+
+	// messages leave the cache along with the freshness window
+	c = NewReplayCache()
+	c.Freshness = 50 * time.Millisecond
+	assert.NoError(t, c.Check("a", "1", time.Now()))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, c.Check("a", "7", time.Now()))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestPackMessageBindsIDAndTimestamp(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pkid, err := id.NewPublicKeyId(privateKey, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	m := &msg.Message{Data: msg.MessageData{From: pkid.ID, Action: msg.DHTPut}}
+	assert.NoError(t, PackMessage(m, pkid))
+	assert.NotEmpty(t, m.ID)
+	assert.False(t, m.Timestamp.IsZero())
+	sent := *m
+
+	// a replayer cannot pass the message off as a new one
+	m.ID = "fresh"
+	m.Timestamp = time.Now().Add(time.Hour)
+	assert.NoError(t, UnpackMessage(m))
+	assert.Equal(t, sent.ID, m.ID)
+	assert.True(t, sent.Timestamp.Equal(m.Timestamp))
+
+	c := NewReplayCache()
+	assert.NoError(t, c.CheckMessage(m))
+	assert.Error(t, c.CheckMessage(m))
+}
+
+func TestUnpackUnboundMessages(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pkid, err := id.NewPublicKeyId(privateKey, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// signed as peers which predate binding IDs and timestamps sign
+	data, err := json.Marshal(msg.MessageData{From: pkid.ID, Action: msg.DHTPut})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	signed, err := pack(&PackableData{Data: string(data)}, pkid.PrivateKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	encoded, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	m := &msg.Message{Packed: true, EncodedData: encoded, Data: msg.MessageData{From: pkid.ID}}
+	assert.True(t, errors.Is(UnpackMessage(m), ErrUnbound))
+	assert.NotEqual(t, msg.DHTPut, m.Data.Action)
+
+	// while peers upgrade they may be accepted
+	SetAcceptUnboundMessages(true)
+	defer SetAcceptUnboundMessages(false)
+	assert.NoError(t, UnpackMessage(m))
+	assert.True(t, strings.HasPrefix(m.ID, legacyIDPrefix))
+	assert.WithinDuration(t, time.Now(), m.Timestamp, time.Second)
+
+	c := NewReplayCache()
+	assert.NoError(t, c.CheckMessage(m))
+	resent := &msg.Message{Packed: true, EncodedData: encoded, Data: msg.MessageData{From: pkid.ID}}
+	assert.NoError(t, UnpackMessage(resent))
+	assert.Equal(t, m.ID, resent.ID)
+	assert.True(t, errors.Is(c.CheckMessage(resent), ErrReplayed))
+}
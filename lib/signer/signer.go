@@ -2,6 +2,8 @@ package signer
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -10,23 +12,28 @@ import (
 	"github.com/matanbroner/goverlay/lib/id"
 )
 
-func Pack(data string, privateKey *rsa.PrivateKey) (*SignedData, error) {
-	publicKey := privateKey.Public().(*rsa.PublicKey)
-	publicKeyBytes, err := json.Marshal(publicKey)
+// Pack signs data with privateKey, which may be any key type id supports.
+func Pack(data string, privateKey crypto.Signer) (*SignedData, error) {
+	return pack(&PackableData{Data: data}, privateKey)
+}
+
+// pack signs packData, filling in its public key.
+func pack(packData *PackableData, privateKey crypto.Signer) (*SignedData, error) {
+	publicKey, err := id.EncodePublicKey(privateKey.Public())
 	if err != nil {
 		return nil, err
 	}
-	packData := &PackableData{
-		Data:      data,
-		PublicKey: publicKeyBytes,
+	packData.PublicKey = publicKey.Key
+	// RSA is left implicit, as peers which predate key types expect
+	if publicKey.Type != id.RSA {
+		packData.KeyType = publicKey.Type
 	}
 
 	packDataBytes, err := json.Marshal(packData)
 	if err != nil {
 		return nil, err
 	}
-	hashed := sha256.Sum256(packDataBytes)
-	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+	signature, err := sign(privateKey, packDataBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -38,23 +45,65 @@ func Pack(data string, privateKey *rsa.PrivateKey) (*SignedData, error) {
 
 func Unpack(data *SignedData, id *id.PublicKeyId) (*PackableData, error) {
 	packedData := &PackableData{}
-	publicKey := &rsa.PublicKey{}
 	if err := json.Unmarshal(data.Signed, packedData); err != nil {
 		return nil, err
 	}
-	if err := json.Unmarshal(packedData.PublicKey, publicKey); err != nil {
+	publicKey, err := packedData.publicKey()
+	if err != nil {
 		return nil, err
 	}
-	hashed := sha256.Sum256(data.Signed)
 	matches, err := id.MatchesPublicKey(publicKey)
 	if err != nil {
 		return nil, err
 	}
 	if !matches {
 		return nil, fmt.Errorf("id does not match on unpack, should be %s", id.ID)
-	} else if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], data.Signature) != nil {
+	} else if !verify(publicKey, data.Signed, data.Signature) {
 		return nil, fmt.Errorf("hash signature does not match on unpack")
 	} else {
 		return packedData, nil
 	}
 }
+
+// publicKey decodes the key the data claims to be signed with.
+func (p *PackableData) publicKey() (crypto.PublicKey, error) {
+	keyType := p.KeyType
+	if keyType == "" {
+		keyType = id.RSA
+	}
+	encoded := &id.PublicKey{Type: keyType, Key: p.PublicKey}
+	return encoded.Decode()
+}
+
+// sign signs signed with privateKey in the scheme for its type: PKCS #1 v1.5
+// over SHA-256 for RSA, as peers have always used, plain Ed25519, and ASN.1
+// ECDSA over SHA-256.
+func sign(privateKey crypto.Signer, signed []byte) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		hashed := sha256.Sum256(signed)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, signed), nil
+	case *ecdsa.PrivateKey:
+		hashed := sha256.Sum256(signed)
+		return ecdsa.SignASN1(rand.Reader, key, hashed[:])
+	default:
+		return nil, fmt.Errorf("signer unsupported key %T", privateKey)
+	}
+}
+
+func verify(publicKey crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, signature)
+	case *ecdsa.PublicKey:
+		hashed := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(key, hashed[:], signature)
+	default:
+		return false
+	}
+}
@@ -1,10 +1,12 @@
 package signer
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"github.com/matanbroner/goverlay/lib/id"
+	msg "github.com/matanbroner/goverlay/lib/message"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -72,3 +74,144 @@ func TestUnpack(t *testing.T) {
 	assert.Equal(t, unpacked.Data, message)
 	assert.Equal(t, unpacked.PublicKey, publicKeyBytes)
 }
+
+func TestPackMessage(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pkid, err := id.NewPublicKeyId(privateKey, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	m := &msg.Message{
+		Data: msg.MessageData{
+			From:   pkid.ID,
+			Action: msg.Connect,
+		},
+	}
+	if err := PackMessage(m, pkid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// a forwarder cannot change the plaintext copy of the data
+	m.Data.Action = msg.Disconnect
+	assert.NoError(t, UnpackMessage(m))
+	assert.Equal(t, msg.Connect, m.Data.Action)
+
+	// nor claim that somebody else sent it
+	forged := &msg.Message{
+		Data: msg.MessageData{
+			From:   "someone-else",
+			Action: msg.Connect,
+		},
+	}
+	if err := PackMessage(forged, pkid); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Error(t, UnpackMessage(forged))
+}
+
+func TestPackKeyTypes(t *testing.T) {
+	for _, keyType := range []id.KeyType{id.Ed25519, id.ECDSAP256} {
+		pkid := newTestID(t, keyType)
+		packed, err := Pack("Hello, World!", pkid.PrivateKey)
+		assert.NoError(t, err)
+		packedData := &PackableData{}
+		assert.NoError(t, json.Unmarshal(packed.Signed, packedData))
+		assert.Equal(t, keyType, packedData.KeyType)
+
+		unpacked, err := Unpack(packed, pkid)
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello, World!", unpacked.Data)
+		_, err = Unpack(packed, newTestID(t, keyType))
+		assert.Error(t, err)
+
+		packed.Signature[0] ^= 1
+		_, err = Unpack(packed, pkid)
+		assert.Error(t, err)
+	}
+
+	// older RSA peers name no key type
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	packed, err := Pack("Hello, World!", rsaKey)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(packed.Signed), "keyType")
+}
+
+func TestPackMessageKeyTypes(t *testing.T) {
+	for _, keyType := range []id.KeyType{id.Ed25519, id.ECDSAP256} {
+		pkid := newTestID(t, keyType)
+		m := &msg.Message{Data: msg.MessageData{From: pkid.ID, Action: msg.DHTPut}}
+		assert.NoError(t, PackMessage(m, pkid))
+		m.Data = msg.MessageData{}
+		assert.NoError(t, UnpackMessage(m))
+		assert.Equal(t, msg.DHTPut, m.Data.Action)
+	}
+}
+
+func newTestID(t testing.TB, keyType id.KeyType) *id.PublicKeyId {
+	var key crypto.Signer
+	var err error
+	if keyType == id.RSA {
+		// full size RSA keys take too long to create for every test
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = id.GenerateKey(keyType)
+	}
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return pkid
+}
+
+func benchmarkPackMessage(b *testing.B, keyType id.KeyType) {
+	pkid := newTestID(b, keyType)
+	for i := 0; i < b.N; i++ {
+		m := &msg.Message{Data: msg.MessageData{From: pkid.ID, Action: msg.DHTPut, Value: []byte("value")}}
+		if err := PackMessage(m, pkid); err != nil {
+			b.Fatal(err)
+		}
+		if err := UnpackMessage(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPackMessageRSA(b *testing.B) {
+	benchmarkPackMessage(b, id.RSA)
+}
+
+func BenchmarkPackMessageEd25519(b *testing.B) {
+	benchmarkPackMessage(b, id.Ed25519)
+}
+
+func BenchmarkPackMessageECDSAP256(b *testing.B) {
+	benchmarkPackMessage(b, id.ECDSAP256)
+}
+
+func TestUnpackLegacyIDs(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	legacyID, err := id.LegacyIDFromPublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// a peer which still goes by the ID it had before IDs were canonical
+	legacy := &id.PublicKeyId{PrivateKey: privateKey, ID: legacyID}
+	m := &msg.Message{Data: msg.MessageData{From: legacyID, Action: msg.DHTPut}}
+	assert.NoError(t, PackMessage(m, legacy))
+	assert.NoError(t, UnpackMessage(m))
+
+	id.SetAcceptLegacyIDs(false)
+	defer id.SetAcceptLegacyIDs(true)
+	assert.Error(t, UnpackMessage(m))
+}
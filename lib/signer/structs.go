@@ -1,8 +1,22 @@
 package signer
 
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"time"
+)
+
 type PackableData struct {
 	Data      string `json:"data"`
 	PublicKey []byte `json:"publicKey"`
+	// KeyType is the type of PublicKey, or empty for RSA
+	KeyType id.KeyType `json:"keyType,omitempty"`
+	// ID and Timestamp bind a packed message to a single sending, so that
+	// it cannot be replayed unnoticed
+	ID        string     `json:"id,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// AckID names the message this one answers, so that the answer cannot
+	// be passed off as another's
+	AckID string `json:"ackID,omitempty"`
 }
 
 type SignedData struct {
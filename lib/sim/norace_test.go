@@ -0,0 +1,6 @@
+//go:build !race
+
+package sim
+
+const raceEnabled = false
+const raceNodes = 0
@@ -0,0 +1,9 @@
+//go:build race
+
+package sim
+
+// raceEnabled is set when testing with the race detector, which slows every
+// node down too much for the largest simulations to converge in time, so they
+// run with raceNodes nodes instead.
+const raceEnabled = true
+const raceNodes = 12
@@ -0,0 +1,66 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/wrtc"
+	"time"
+)
+
+// Signaler carries SDP and ICE messages between simulated nodes, playing the
+// part of the signaling server. Signals are delayed by the configured latency
+// and blocked by partitions, but are never lost.
+type Signaler struct {
+	From       *Node
+	To         string
+	Connection *wrtc.WebRTCConnection
+}
+
+type signal struct {
+	from      *Node
+	message   *message.Message
+	deliverAt time.Time
+}
+
+func (s *Signaler) SetConnection(connection *wrtc.WebRTCConnection) {
+	s.Connection = connection
+}
+
+func (s *Signaler) IsOverlay() bool {
+	return false
+}
+
+func (s *Signaler) AddConnection() {}
+
+func (s *Signaler) Send(m *message.Message) {
+	to := s.From.Network.Node(s.To)
+	if to == nil || !s.From.Network.reachable(s.From.IP, to.IP) {
+		return
+	}
+	if s.Connection != nil {
+		m.Timestamp = s.Connection.Timestamp
+	}
+	to.inbox <- &signal{
+		from:      s.From,
+		message:   m,
+		deliverAt: time.Now().Add(s.From.Network.Config.Latency),
+	}
+}
+
+// handleSignals feeds incoming signals to the node's wrapper in order.
+func (node *Node) handleSignals() {
+	for {
+		select {
+		case <-node.Network.done:
+			return
+		case sig := <-node.inbox:
+			time.Sleep(time.Until(sig.deliverAt))
+			reply := &Signaler{From: node, To: sig.from.ID.ID}
+			err := node.Overlay.WebRTCWrapper.HandleSignal(sig.from.ID.ID, sig.from.ID.InstanceID, sig.message, reply)
+			if err != nil && !errors.Is(err, wrtc.ErrStaleSignal) {
+				fmt.Printf("sim signal error at %s: %s\n", node.IP, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Package sim runs many overlay nodes inside a single process over a pion
+// virtual network, so that routing, flood maintenance and the DHT can be
+// exercised without real NAT traversal or a public STUN server.
+package sim
+
+import (
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/dht"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/overlay"
+	"github.com/matanbroner/goverlay/lib/util"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// KeyType is the key type of simulated nodes, chosen so that large networks
+// start, and sign their traffic, quickly.
+const KeyType = id.Ed25519
+
+type Config struct {
+	// Latency is the one-way delay applied to every packet and signal
+	Latency time.Duration
+	// Jitter is a random extra delay of up to this much per packet
+	Jitter time.Duration
+	// Loss is the fraction of packets dropped, between 0 and 1
+	Loss float64
+	// MaxFloodSize overrides overlay.MaxFloodSize when non-zero
+	MaxFloodSize int
+	// Seed makes bootstrap choices and packet loss reproducible
+	Seed int64
+}
+
+type Network struct {
+	Config *Config
+	Router *vnet.Router
+	Nodes  []*Node
+
+	lock       sync.Mutex
+	random     *mathrand.Rand
+	partitions map[string]int
+	nodesByID  map[string]*Node
+	done       chan struct{}
+	// serverConnections counts connections signaled through the server
+	serverConnections int
+}
+
+type Node struct {
+	Network *Network
+	ID      *id.PublicKeyId
+	Overlay *overlay.Overlay
+	DHT     *dht.DHT
+	IP      string
+
+	inbox chan *signal
+}
+
+// New starts an empty simulated network.
+func New(config *Config) (*Network, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/8",
+		MinDelay:      config.Latency,
+		MaxJitter:     config.Jitter,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{
+		Config:     config,
+		Router:     router,
+		random:     mathrand.New(mathrand.NewSource(config.Seed)),
+		partitions: make(map[string]int),
+		nodesByID:  make(map[string]*Node),
+		done:       make(chan struct{}),
+	}
+	router.AddChunkFilter(func(c vnet.Chunk) bool {
+		return n.deliverable(hostOf(c.SourceAddr()), hostOf(c.DestinationAddr()))
+	})
+	if err := router.Start(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// AddNode starts a new node and, if the network is not empty, bootstraps it
+// through a randomly chosen existing node.
+func (n *Network) AddNode() (*Node, error) {
+	key, err := id.GenerateKey(KeyType)
+	if err != nil {
+		return nil, err
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	index := len(n.Nodes)
+	ip := fmt.Sprintf("10.0.%d.%d", index/250, index%250+1)
+	var bootstrap *Node
+	if index > 0 {
+		bootstrap = n.Nodes[n.random.Intn(index)]
+	}
+	n.lock.Unlock()
+
+	vn := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+	if err := n.Router.AddNet(vn); err != nil {
+		return nil, err
+	}
+	settings := webrtc.SettingEngine{}
+	settings.SetVNet(vn)
+	settings.SetICETimeouts(2*time.Second, 4*time.Second, 500*time.Millisecond)
+
+	o := overlay.New(pkid)
+	if n.Config.MaxFloodSize > 0 {
+		o.MaxFloodSize = n.Config.MaxFloodSize
+	}
+	o.WebRTCWrapper.API = webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+	o.WebRTCWrapper.Configuration = webrtc.Configuration{}
+	node := &Node{
+		Network: n,
+		ID:      pkid,
+		Overlay: o,
+		DHT:     dht.NewDHT(o),
+		IP:      ip,
+		inbox:   make(chan *signal, 1024),
+	}
+	o.BootstrapSignaler = func(peerID string, instanceID *id.InstanceID) overlay.Signaler {
+		n.lock.Lock()
+		n.serverConnections += 1
+		n.lock.Unlock()
+		return &Signaler{From: node, To: peerID}
+	}
+	go node.handleSignals()
+
+	n.lock.Lock()
+	n.Nodes = append(n.Nodes, node)
+	n.nodesByID[pkid.ID] = node
+	n.lock.Unlock()
+
+	if bootstrap != nil {
+		if err := o.Connect(bootstrap.ID.ID, bootstrap.ID.InstanceID); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// AddNodes starts count nodes, spacing them out so that each joins a ring
+// which has had a moment to absorb the previous one.
+func (n *Network) AddNodes(count int, spacing time.Duration) error {
+	for i := 0; i < count; i++ {
+		if _, err := n.AddNode(); err != nil {
+			return err
+		}
+		time.Sleep(spacing)
+	}
+	return nil
+}
+
+// Node returns the node with the given overlay ID.
+func (n *Network) Node(peerID string) *Node {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.nodesByID[peerID]
+}
+
+// IDs lists the overlay IDs of every node in the network.
+func (n *Network) IDs() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var ids []string
+	for _, node := range n.Nodes {
+		ids = append(ids, node.ID.ID)
+	}
+	return ids
+}
+
+// ServerConnections returns how many connections nodes have initiated
+// through the simulated signaling server rather than through the overlay.
+func (n *Network) ServerConnections() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.serverConnections
+}
+
+// Partition splits the network so that nodes can only reach nodes in the
+// same group. Nodes not listed in any group form a group of their own.
+func (n *Network) Partition(groups ...[]*Node) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			n.partitions[node.IP] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Converged reports whether every node's flood holds exactly the neighbours
+// it would have with full knowledge of the ring.
+func (n *Network) Converged() bool {
+	ids := n.IDs()
+	n.lock.Lock()
+	nodes := append([]*Node{}, n.Nodes...)
+	n.lock.Unlock()
+	for _, node := range nodes {
+		others := util.Filter(ids, func(other string) bool {
+			return other != node.ID.ID
+		})
+		predecessors, successors := overlay.FloodFor(node.ID.ID, others, node.Overlay.MaxFloodSize)
+		if !equalSets(predecessors, node.Overlay.Predecessors()) || !equalSets(successors, node.Overlay.Successors()) {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForConvergence polls Converged until it holds or timeout elapses.
+func (n *Network) WaitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !n.Converged() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("sim network did not converge within %s", timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close tears down every node and stops the virtual network.
+func (n *Network) Close() error {
+	n.lock.Lock()
+	nodes := append([]*Node{}, n.Nodes...)
+	n.lock.Unlock()
+	close(n.done)
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			_ = node.Overlay.Close()
+		}(node)
+	}
+	wg.Wait()
+	return n.Router.Stop()
+}
+
+// reachable reports whether two hosts are on the same side of any partition.
+func (n *Network) reachable(from string, to string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.partitions[from] == n.partitions[to]
+}
+
+// deliverable applies partitions and random loss between two hosts.
+func (n *Network) deliverable(from string, to string) bool {
+	if !n.reachable(from, to) {
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.Config.Loss <= 0 || n.random.Float64() >= n.Config.Loss
+}
+
+func hostOf(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func equalSets(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !util.Contains(b, v) {
+			return false
+		}
+	}
+	return true
+}
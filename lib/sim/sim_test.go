@@ -0,0 +1,113 @@
+package sim
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, node *Node, key string) map[string]string {
+	done := make(chan map[string]string, 1)
+	node.DHT.Get(key, func(values map[string]string) {
+		done <- values
+	})
+	select {
+	case values := <-done:
+		return values
+	case <-time.After(5 * time.Second):
+		t.Fatalf("get %s from %s timed out", key, node.IP)
+		return nil
+	}
+}
+
+func put(t *testing.T, node *Node, key string, value string) {
+	done := make(chan struct{}, 1)
+	node.DHT.Put(key, value, node.ID.ID, func(map[string]string) {
+		done <- struct{}{}
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("put %s from %s timed out", key, node.IP)
+	}
+}
+
+func TestRingConverges(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 50 node simulation in short mode")
+	}
+	nodes := 50
+	if raceEnabled {
+		nodes = raceNodes
+	}
+	n, err := New(&Config{
+		Latency:      5 * time.Millisecond,
+		Jitter:       2 * time.Millisecond,
+		MaxFloodSize: 3,
+		Seed:         1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err := n.AddNodes(nodes, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.WaitForConvergence(60 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10 && i < nodes/2; i++ {
+		writer := n.Nodes[i]
+		reader := n.Nodes[len(n.Nodes)-1-i]
+		key := fmt.Sprintf("key-%d", i)
+		put(t, writer, key, "value")
+		assert.Equal(t, "value", get(t, reader, key)[writer.ID.ID])
+	}
+}
+
+func TestPartitionDropsConnections(t *testing.T) {
+	n, err := New(&Config{MaxFloodSize: 2, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err := n.AddNodes(4, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.WaitForConvergence(20 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	left := n.Nodes[:2]
+	right := n.Nodes[2:]
+	n.Partition(left, right)
+	assert.Eventually(t, func() bool {
+		for _, node := range right {
+			if left[0].Overlay.InFlood(node.ID.ID) {
+				return false
+			}
+		}
+		return left[0].Overlay.InFlood(left[1].ID.ID)
+	}, 20*time.Second, 100*time.Millisecond)
+}
+
+func TestJoinSignalsThroughOverlay(t *testing.T) {
+	n, err := New(&Config{MaxFloodSize: 2, Seed: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if err := n.AddNodes(8, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.WaitForConvergence(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// only each newcomer's bootstrap connection needs the server
+	assert.Equal(t, len(n.Nodes)-1, n.ServerConnections())
+}
@@ -0,0 +1,397 @@
+// Package socket implements transport.Transport over WebSocket connections,
+// for links between servers which can reach each other directly and have no
+// need for NAT traversal.
+package socket
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Path is where Listen serves the WebSocket endpoint.
+const Path = "/overlay"
+const HandshakeTimeout = 10 * time.Second
+
+// challengeSize is the size of the random challenges each side of a link
+// signs into its hello, so that hellos cannot be replayed.
+const challengeSize = 32
+
+type Transport struct {
+	ID *id.PublicKeyId
+	// Addresses maps peer IDs to the WebSocket URL they listen on
+	Addresses map[string]string
+	Dialer    *websocket.Dialer
+	Upgrader  websocket.Upgrader
+	// Replay remembers the hellos received, to refuse them if replayed
+	Replay *signer.ReplayCache
+
+	lock            sync.Mutex
+	links           map[string]*link
+	server          *http.Server
+	messageHandlers []transport.MessageHandler
+	stateHandlers   []transport.StateHandler
+}
+
+type link struct {
+	peerID    string
+	dialer    string
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+var _ transport.Transport = &Transport{}
+
+func New(i *id.PublicKeyId) *Transport {
+	return &Transport{
+		ID:        i,
+		Addresses: make(map[string]string),
+		Dialer:    websocket.DefaultDialer,
+		Upgrader: websocket.Upgrader{
+			HandshakeTimeout: HandshakeTimeout,
+		},
+		Replay: signer.NewReplayCache(),
+		links:  make(map[string]*link),
+	}
+}
+
+// AddPeer records the URL a peer can be dialed at, e.g. "ws://10.0.0.2:7000/overlay".
+func (t *Transport) AddPeer(peerID string, url string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Addresses[peerID] = url
+}
+
+// Listen accepts links from peers on addr, returning the address actually
+// bound so that ":0" can be used.
+func (t *Transport) Listen(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, t)
+	t.lock.Lock()
+	t.server = &http.Server{Handler: mux}
+	server := t.server
+	t.lock.Unlock()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("socket serve error: %s\n", err.Error())
+		}
+	}()
+	return listener.Addr(), nil
+}
+
+// ServeHTTP upgrades an incoming request into a link, so that the transport
+// can also be mounted on an existing HTTP server.
+func (t *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := t.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("socket upgrade error: %s\n", err.Error())
+		return
+	}
+	challenge, err := t.writeChallenge(conn)
+	var theirs []byte
+	if err == nil {
+		theirs, err = t.readChallenge(conn)
+	}
+	var from *message.MessageData
+	if err == nil {
+		from, err = t.readHello(conn, "", challenge)
+	}
+	if err != nil {
+		fmt.Printf("socket handshake error: %s\n", err.Error())
+		_ = conn.Close()
+		return
+	}
+	if err := t.writeHello(conn, from.From, theirs); err != nil {
+		fmt.Printf("socket handshake error: %s\n", err.Error())
+		_ = conn.Close()
+		return
+	}
+	t.register(&link{peerID: from.From, dialer: from.From, conn: conn})
+}
+
+// Shutdown stops listening and closes every link.
+func (t *Transport) Shutdown() error {
+	t.lock.Lock()
+	server := t.server
+	t.server = nil
+	peers := make([]string, 0, len(t.links))
+	for peer := range t.links {
+		peers = append(peers, peer)
+	}
+	t.lock.Unlock()
+	for _, peer := range peers {
+		_ = t.Close(peer)
+	}
+	if server != nil {
+		return server.Close()
+	}
+	return nil
+}
+
+func (t *Transport) Connect(peerID string, instanceID *id.InstanceID) error {
+	if t.IsActive(peerID) {
+		return nil
+	}
+	t.lock.Lock()
+	url, ok := t.Addresses[peerID]
+	t.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("socket no known address for %s", id.ShortID(peerID))
+	}
+	t.emitState(peerID, transport.StateConnecting)
+	conn, _, err := t.Dialer.Dial(url, nil)
+	if err != nil {
+		t.emitState(peerID, transport.StateClosed)
+		return err
+	}
+	challenge, err := t.writeChallenge(conn)
+	var theirs []byte
+	if err == nil {
+		theirs, err = t.readChallenge(conn)
+	}
+	if err == nil {
+		err = t.writeHello(conn, peerID, theirs)
+	}
+	if err == nil {
+		_, err = t.readHello(conn, peerID, challenge)
+	}
+	if err != nil {
+		_ = conn.Close()
+		t.emitState(peerID, transport.StateClosed)
+		return err
+	}
+	t.register(&link{peerID: peerID, dialer: t.ID.ID, conn: conn})
+	return nil
+}
+
+func (t *Transport) Send(m *message.Message) error {
+	t.lock.Lock()
+	l, ok := t.links[m.Data.To]
+	t.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("socket no active link for (%s)", m.Data.To)
+	}
+	m.Data.From = t.ID.ID
+	m.Data.FromInstance = t.ID.InstanceID.ID
+	m.Timestamp = time.Now()
+	bytes, err := message.Encode(m)
+	if err != nil {
+		return fmt.Errorf("socket %s", err.Error())
+	}
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	if err := l.conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
+		return fmt.Errorf("socket message send error: %s", err.Error())
+	}
+	return nil
+}
+
+func (t *Transport) Close(peerID string) error {
+	t.lock.Lock()
+	l, ok := t.links[peerID]
+	t.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("socket no active link for (%s)", peerID)
+	}
+	l.writeLock.Lock()
+	_ = l.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	l.writeLock.Unlock()
+	err := l.conn.Close()
+	t.unregister(l)
+	return err
+}
+
+func (t *Transport) IsActive(peerID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.links[peerID]
+	return ok
+}
+
+func (t *Transport) Peers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	peers := make([]string, 0, len(t.links))
+	for peer := range t.links {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (t *Transport) OnMessage(handler transport.MessageHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.messageHandlers = append(t.messageHandlers, handler)
+}
+
+func (t *Transport) OnStateChange(handler transport.StateHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stateHandlers = append(t.stateHandlers, handler)
+}
+
+// register adopts a handshaken link. When both sides dial each other at once
+// the link dialed by the lower ID wins, so that both ends keep the same one.
+func (t *Transport) register(l *link) {
+	t.lock.Lock()
+	existing, ok := t.links[l.peerID]
+	if ok && existing.dialer < l.dialer {
+		t.lock.Unlock()
+		_ = l.conn.Close()
+		return
+	}
+	t.links[l.peerID] = l
+	t.lock.Unlock()
+	if ok {
+		_ = existing.conn.Close()
+	} else {
+		t.emitState(l.peerID, transport.StateOpen)
+	}
+	go t.read(l)
+}
+
+func (t *Transport) unregister(l *link) {
+	t.lock.Lock()
+	current, ok := t.links[l.peerID]
+	if !ok || current != l {
+		t.lock.Unlock()
+		return
+	}
+	delete(t.links, l.peerID)
+	t.lock.Unlock()
+	t.emitState(l.peerID, transport.StateClosed)
+}
+
+func (t *Transport) read(l *link) {
+	defer t.unregister(l)
+	for {
+		_, bytes, err := l.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		m, err := message.Decode(bytes)
+		if err != nil {
+			fmt.Printf("socket %s\n", err.Error())
+			continue
+		}
+		switch m.Data.Action {
+		case message.OverlayMessage:
+			t.emitMessage(m)
+		case message.Disconnect:
+			_ = l.conn.Close()
+			return
+		default:
+			fmt.Printf("socket unrecognized message action: %s\n", m.Data.Action)
+		}
+	}
+}
+
+// writeChallenge sends the peer a random challenge to sign into its hello,
+// returning the challenge.
+func (t *Transport) writeChallenge(conn *websocket.Conn) ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return challenge, conn.WriteJSON(&message.Message{
+		Data: message.MessageData{
+			Action: message.Challenge,
+			Value:  challenge,
+		},
+	})
+}
+
+// readChallenge reads the challenge the peer wants signed into our hello.
+func (t *Transport) readChallenge(conn *websocket.Conn) ([]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	m := &message.Message{}
+	if err := conn.ReadJSON(m); err != nil {
+		return nil, err
+	}
+	if m.Data.Action != message.Challenge || len(m.Data.Value) != challengeSize {
+		return nil, fmt.Errorf("socket invalid challenge")
+	}
+	return m.Data.Value, nil
+}
+
+// writeHello sends a signed Connect message proving that we own our ID,
+// answering the peer's challenge.
+func (t *Transport) writeHello(conn *websocket.Conn, to string, challenge []byte) error {
+	m := &message.Message{
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:           to,
+			From:         t.ID.ID,
+			FromInstance: t.ID.InstanceID.ID,
+			Action:       message.Connect,
+			Value:        challenge,
+		},
+	}
+	if err := signer.PackMessage(m, t.ID); err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return conn.WriteJSON(m)
+}
+
+// readHello verifies the peer's signed Connect message, which must be for us,
+// answer our challenge, and come from expected unless expected is empty.
+func (t *Transport) readHello(conn *websocket.Conn, expected string, challenge []byte) (*message.MessageData, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	m := &message.Message{}
+	if err := conn.ReadJSON(m); err != nil {
+		return nil, err
+	}
+	if err := signer.UnpackMessage(m); err != nil {
+		return nil, err
+	}
+	if m.Data.Action != message.Connect || m.Data.To != t.ID.ID {
+		return nil, fmt.Errorf("socket invalid hello from %s", id.ShortID(m.Data.From))
+	}
+	if !bytes.Equal(m.Data.Value, challenge) {
+		return nil, fmt.Errorf("socket hello from %s does not answer our challenge", id.ShortID(m.Data.From))
+	}
+	if expected != "" && m.Data.From != expected {
+		return nil, fmt.Errorf("socket expected hello from %s but got %s", id.ShortID(expected), id.ShortID(m.Data.From))
+	}
+	if err := t.Replay.CheckMessage(m); err != nil {
+		return nil, fmt.Errorf("socket hello from %s: %s", id.ShortID(m.Data.From), err.Error())
+	}
+	return &m.Data, nil
+}
+
+func (t *Transport) emitMessage(m *message.Message) {
+	t.lock.Lock()
+	handlers := append([]transport.MessageHandler{}, t.messageHandlers...)
+	t.lock.Unlock()
+	for _, handler := range handlers {
+		handler(m)
+	}
+}
+
+func (t *Transport) emitState(peerID string, state transport.State) {
+	t.lock.Lock()
+	handlers := append([]transport.StateHandler{}, t.stateHandlers...)
+	t.lock.Unlock()
+	for _, handler := range handlers {
+		handler(peerID, state)
+	}
+}
@@ -0,0 +1,277 @@
+package socket
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/matanbroner/goverlay/lib/dht"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/overlay"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestTransport(t *testing.T) (*Transport, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(pkid)
+	addr, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fmt.Sprintf("ws://%s%s", addr.String(), Path)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectSendClose(t *testing.T) {
+	a, _ := newTestTransport(t)
+	b, bURL := newTestTransport(t)
+	defer a.Shutdown()
+	defer b.Shutdown()
+
+	received := make(chan *message.Message, 1)
+	b.OnMessage(func(m *message.Message) {
+		received <- m
+	})
+	states := make(chan transport.State, 4)
+	b.OnStateChange(func(peerID string, state transport.State) {
+		if peerID == a.ID.ID {
+			states <- state
+		}
+	})
+
+	assert.Error(t, a.Connect(b.ID.ID, nil))
+	a.AddPeer(b.ID.ID, bURL)
+	assert.NoError(t, a.Connect(b.ID.ID, nil))
+	assert.True(t, a.IsActive(b.ID.ID))
+	assert.Equal(t, transport.StateOpen, <-states)
+	assert.Equal(t, []string{a.ID.ID}, b.Peers())
+
+	assert.NoError(t, a.Send(&message.Message{
+		Data: message.MessageData{
+			To:     b.ID.ID,
+			Action: message.OverlayMessage,
+			Value:  []byte("hello"),
+		},
+	}))
+	select {
+	case m := <-received:
+		assert.Equal(t, a.ID.ID, m.Data.From)
+		assert.Equal(t, []byte("hello"), m.Data.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	assert.NoError(t, a.Close(b.ID.ID))
+	assert.False(t, a.IsActive(b.ID.ID))
+	assert.Equal(t, transport.StateClosed, <-states)
+	waitFor(t, func() bool {
+		return !b.IsActive(a.ID.ID)
+	})
+}
+
+func TestConnectRejectsWrongPeer(t *testing.T) {
+	a, _ := newTestTransport(t)
+	b, bURL := newTestTransport(t)
+	c, _ := newTestTransport(t)
+	defer a.Shutdown()
+	defer b.Shutdown()
+	defer c.Shutdown()
+
+	// b answers at the address a believes belongs to c
+	a.AddPeer(c.ID.ID, bURL)
+	assert.Error(t, a.Connect(c.ID.ID, nil))
+	assert.False(t, a.IsActive(c.ID.ID))
+}
+
+func TestHelloCannotBeReplayed(t *testing.T) {
+	a, _ := newTestTransport(t)
+	b, bURL := newTestTransport(t)
+	defer a.Shutdown()
+	defer b.Shutdown()
+
+	// dials b as a, sending the hello made for b's challenge, and reports
+	// whether b answered
+	attempt := func(hello func(challenge []byte) *message.Message) bool {
+		conn, _, err := websocket.DefaultDialer.Dial(bURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		challenge, err := a.readChallenge(conn)
+		assert.NoError(t, err)
+		_, err = a.writeChallenge(conn)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteJSON(hello(challenge)))
+		_, _, err = conn.ReadMessage()
+		return err == nil
+	}
+	signed := func(to string, challenge []byte) *message.Message {
+		m := &message.Message{Data: message.MessageData{
+			To:     to,
+			From:   a.ID.ID,
+			Action: message.Connect,
+			Value:  challenge,
+		}}
+		assert.NoError(t, signer.PackMessage(m, a.ID))
+		return m
+	}
+
+	var captured *message.Message
+	assert.True(t, attempt(func(challenge []byte) *message.Message {
+		captured = signed(b.ID.ID, challenge)
+		return captured
+	}))
+	// the same hello does not answer another challenge
+	assert.False(t, attempt(func([]byte) *message.Message { return captured }))
+	// nor is a hello for nobody in particular accepted
+	assert.False(t, attempt(func(challenge []byte) *message.Message { return signed("", challenge) }))
+}
+
+func TestOverlayOverSockets(t *testing.T) {
+	a, _ := newTestTransport(t)
+	b, bURL := newTestTransport(t)
+	defer a.Shutdown()
+	defer b.Shutdown()
+
+	oa := overlay.New(a.ID)
+	ob := overlay.New(b.ID)
+	oa.AddTransport(a)
+	ob.AddTransport(b)
+	da := dht.NewDHT(oa)
+	db := dht.NewDHT(ob)
+
+	a.AddPeer(b.ID.ID, bURL)
+	assert.NoError(t, oa.Connect(b.ID.ID, nil))
+	waitFor(t, func() bool {
+		return oa.InFlood(b.ID.ID) && ob.InFlood(a.ID.ID)
+	})
+
+	done := make(chan struct{}, 1)
+	da.Put("key", "value", a.ID.ID, func(map[string]string) {
+		done <- struct{}{}
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("put timed out")
+	}
+	values := make(chan map[string]string, 1)
+	db.Get("key", func(v map[string]string) {
+		values <- v
+	})
+	select {
+	case v := <-values:
+		assert.Equal(t, "value", v[a.ID.ID])
+	case <-time.After(5 * time.Second):
+		t.Fatal("get timed out")
+	}
+}
+
+type listenerFunc func(m *message.Message)
+
+func (f listenerFunc) OnMessage(m *message.Message) {
+	f(m)
+}
+
+func TestSealedOverSockets(t *testing.T) {
+	ts := make([]*Transport, 3)
+	urls := make([]string, 3)
+	for i := range ts {
+		ts[i], urls[i] = newTestTransport(t)
+		defer ts[i].Shutdown()
+	}
+	// a reaches c only through b, which greedy routing only takes if b lies
+	// between them, so the roles follow from the IDs
+	var a, b, c *Transport
+	var bURL, cURL string
+	for i := range ts {
+		a, b, c = ts[i], ts[(i+1)%3], ts[(i+2)%3]
+		bURL, cURL = urls[(i+1)%3], urls[(i+2)%3]
+		if id.ClosestIDInList(c.ID.ID, []string{a.ID.ID, b.ID.ID}) == b.ID.ID &&
+			id.ClosestIDInList(a.ID.ID, []string{b.ID.ID, c.ID.ID}) == b.ID.ID {
+			break
+		}
+	}
+
+	oa := overlay.New(a.ID)
+	ob := overlay.New(b.ID)
+	oc := overlay.New(c.ID)
+	oa.AddTransport(a)
+	ob.AddTransport(b)
+	oc.AddTransport(c)
+
+	a.AddPeer(b.ID.ID, bURL)
+	b.AddPeer(c.ID.ID, cURL)
+	assert.NoError(t, oa.Connect(b.ID.ID, nil))
+	assert.NoError(t, ob.Connect(c.ID.ID, nil))
+	waitFor(t, func() bool {
+		return a.IsActive(b.ID.ID) && c.IsActive(b.ID.ID)
+	})
+
+	var lock sync.Mutex
+	var relayed []string
+	b.OnMessage(func(m *message.Message) {
+		lock.Lock()
+		defer lock.Unlock()
+		relayed = append(relayed, string(m.Data.Value))
+	})
+	received := make(chan *message.Message, 1)
+	oc.AddListener(listenerFunc(func(m *message.Message) {
+		if m.Data.Action == message.DHTPut {
+			received <- m
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, oa.SendSealed(ctx, &message.Message{
+		Data: message.MessageData{
+			To:     c.ID.ID,
+			Action: message.DHTPut,
+			Value:  []byte("the secret"),
+		},
+	}))
+	select {
+	case m := <-received:
+		assert.Equal(t, "the secret", string(m.Data.Value))
+		assert.Equal(t, a.ID.ID, m.Data.From)
+		assert.False(t, m.Data.Sealed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sealed message not received")
+	}
+	_, ok := oa.Keys.Get(c.ID.ID)
+	assert.True(t, ok)
+
+	lock.Lock()
+	defer lock.Unlock()
+	sealed := false
+	for _, value := range relayed {
+		assert.NotContains(t, value, "the secret")
+		sealed = sealed || strings.Contains(value, `"sealed":true`)
+	}
+	assert.True(t, sealed)
+}
@@ -0,0 +1,50 @@
+// Package transport defines how the overlay exchanges messages with its
+// peers, independent of whether links are WebRTC data channels or direct
+// sockets between servers.
+package transport
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+)
+
+type State int
+
+const (
+	StateConnecting State = iota
+	StateOpen
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type MessageHandler func(m *message.Message)
+type StateHandler func(peerID string, state State)
+
+type Transport interface {
+	// Connect opens a link to the given peer unless one already exists
+	Connect(peerID string, instanceID *id.InstanceID) error
+	// Send delivers m to m.Data.To over an open link
+	Send(m *message.Message) error
+	// Close tears down the link to the given peer
+	Close(peerID string) error
+	// IsActive reports whether there is an open link to the given peer
+	IsActive(peerID string) bool
+	// Peers lists the peers we hold an open link to
+	Peers() []string
+	// OnMessage registers a handler for overlay messages received from peers
+	OnMessage(handler MessageHandler)
+	// OnStateChange registers a handler for links opening and closing
+	OnStateChange(handler StateHandler)
+}
@@ -1,5 +1,10 @@
 package util
 
+import (
+	"errors"
+	"strings"
+)
+
 func Contains[T comparable](s []T, elem T) bool {
 	for _, v := range s {
 		if v == elem {
@@ -23,3 +28,18 @@ func Filter[T comparable](s []T, f func(T) bool) []T {
 	}
 	return filtered
 }
+
+// JoinErrors combines the non-nil errors in errs into one, or returns nil if
+// there are none.
+func JoinErrors(errs []error) error {
+	var messages []string
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
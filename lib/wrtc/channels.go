@@ -0,0 +1,163 @@
+package wrtc
+
+import (
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/pion/webrtc/v3"
+)
+
+// ChannelHandler receives the messages arriving on a named channel.
+type ChannelHandler func(conn *WebRTCConnection, data []byte)
+
+// channelSpec is a named channel registered with RegisterChannel.
+type channelSpec struct {
+	options *webrtc.DataChannelInit
+	handler ChannelHandler
+}
+
+// ReliableChannel returns options for a channel which delivers every message
+// in order, as the control channel does.
+func ReliableChannel() *webrtc.DataChannelInit {
+	ordered := true
+	return &webrtc.DataChannelInit{Ordered: &ordered}
+}
+
+// UnreliableChannel returns options for a channel which never resends lost
+// messages and may deliver them out of order, suiting realtime traffic where
+// late data is useless.
+func UnreliableChannel() *webrtc.DataChannelInit {
+	ordered := false
+	var maxRetransmits uint16 = 0
+	return &webrtc.DataChannelInit{Ordered: &ordered, MaxRetransmits: &maxRetransmits}
+}
+
+// RegisterChannel declares a named channel, opened with OpenChannel using the
+// given options, whose messages are passed to handler. Channels the peer
+// opens under the same label are accepted and routed to handler too, while
+// channels with labels nobody registered are refused.
+func (w *WebRTCWrapper) RegisterChannel(label string, options *webrtc.DataChannelInit, handler ChannelHandler) error {
+	if label == defaultChannel {
+		return fmt.Errorf("wrtc channel %s is reserved", label)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.channels == nil {
+		w.channels = make(map[string]*channelSpec)
+	}
+	if _, ok := w.channels[label]; ok {
+		return fmt.Errorf("wrtc channel %s already registered", label)
+	}
+	w.channels[label] = &channelSpec{options: options, handler: handler}
+	return nil
+}
+
+// OpenChannel opens the registered channel label on our open connection to
+// peerID, unless it is already open or opening.
+func (w *WebRTCWrapper) OpenChannel(peerID string, instanceID *id.InstanceID, label string) error {
+	spec := w.channelSpec(label)
+	if spec == nil {
+		return fmt.Errorf("wrtc channel %s not registered", label)
+	}
+	conn := w.GetConnection(peerID, instanceID)
+	if conn == nil || !conn.IsOpen() {
+		return fmt.Errorf("wrtc no active connection for (%s)", id.ShortID(peerID))
+	}
+	if !conn.Agreement().Has(message.FeatureChannels) {
+		return fmt.Errorf("wrtc peer (%s) does not support named channels", id.ShortID(peerID))
+	}
+	if conn.NamedChannel(label) != nil {
+		return nil
+	}
+	channel, err := conn.PeerConnection.CreateDataChannel(label, spec.options)
+	if err != nil {
+		return fmt.Errorf("wrtc create channel %s error: %s", label, err.Error())
+	}
+	if !conn.addChannel(channel) {
+		// opened concurrently by another caller or by the peer
+		return channel.Close()
+	}
+	w.setupNamedChannel(conn, channel, spec)
+	return nil
+}
+
+// SendChannel sends data to a peer over the named channel label, which must
+// be open. Data larger than MaxChunkSize is sent in fragments, which on an
+// unreliable channel are only reassembled if none of them is lost.
+func (w *WebRTCWrapper) SendChannel(peerID string, instanceID *id.InstanceID, label string, data []byte) error {
+	conn := w.GetConnection(peerID, instanceID)
+	if conn == nil {
+		return fmt.Errorf("wrtc no active connection for (%s)", id.ShortID(peerID))
+	}
+	return w.sendFramed(conn, label, data)
+}
+
+func (w *WebRTCWrapper) channelSpec(label string) *channelSpec {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.channels[label]
+}
+
+// acceptChannel routes a channel opened by the peer. The control channel
+// carries overlay messages, and any other must have been registered.
+func (w *WebRTCWrapper) acceptChannel(conn *WebRTCConnection, channel *webrtc.DataChannel) {
+	if channel.Label() == defaultChannel {
+		conn.setChannel(channel)
+		if err := w.SetupDataChannel(conn); err != nil {
+			fmt.Printf("wrtc setup incoming channel error: %s\n", err.Error())
+		}
+		return
+	}
+	spec := w.channelSpec(channel.Label())
+	if spec == nil {
+		fmt.Printf("wrtc refused channel %s from %s\n", channel.Label(), id.ShortID(conn.PeerID))
+		_ = channel.Close()
+		return
+	}
+	if !conn.addChannel(channel) {
+		// both sides opened the channel at once, so keep one of them the
+		// same way as for colliding offers
+		if !id.ShouldYieldToID(w.ID.ID, conn.PeerID) {
+			_ = channel.Close()
+			return
+		}
+		if ours := conn.removeChannel(conn.NamedChannel(channel.Label())); ours != nil {
+			_ = ours.Close()
+		}
+		if !conn.addChannel(channel) {
+			_ = channel.Close()
+			return
+		}
+	}
+	w.setupNamedChannel(conn, channel, spec)
+}
+
+func (w *WebRTCWrapper) setupNamedChannel(conn *WebRTCConnection, channel *webrtc.DataChannel, spec *channelSpec) {
+	// only peers which know frames open named channels
+	f := newFramer(w, channel, true)
+	conn.setFramer(channel.Label(), f)
+	channel.OnMessage(func(m webrtc.DataChannelMessage) {
+		data, complete, err := f.receive(m.Data)
+		if err != nil {
+			fmt.Printf("wrtc channel %s frame error: %s\n", channel.Label(), err.Error())
+			return
+		}
+		if complete {
+			spec.handler(conn, data)
+		}
+	})
+	channel.OnClose(func() {
+		conn.removeChannel(channel)
+	})
+	channel.OnError(func(err error) {
+		fmt.Printf("wrtc channel %s error: %s\n", channel.Label(), err.Error())
+	})
+	onOpen := func() {
+		w.emitEvent(Event{Type: ChannelOpened, Connection: conn, State: conn.State(), Channel: channel.Label()})
+	}
+	if channel.ReadyState() == webrtc.DataChannelStateOpen {
+		onOpen()
+	} else {
+		channel.OnOpen(onOpen)
+	}
+}
@@ -0,0 +1,87 @@
+package wrtc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func waitForChannel(t *testing.T, events chan Event, label string) {
+	for {
+		e := nextEvent(t, events)
+		if e.Type == ChannelOpened && e.Channel == label {
+			return
+		}
+	}
+}
+
+// waitForPeer waits for a connection to open, which comes after its control
+// channel opens and the handshake is over.
+func waitForPeer(t *testing.T, events chan Event) {
+	for nextEvent(t, events).Type != PeerConnected {
+	}
+}
+
+func TestNamedChannels(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+
+	aReceived := make(chan []byte, 1)
+	bReceived := make(chan []byte, 1)
+	assert.NoError(t, a.w.RegisterChannel("bulk", UnreliableChannel(), func(conn *WebRTCConnection, data []byte) {
+		aReceived <- data
+	}))
+	assert.NoError(t, b.w.RegisterChannel("bulk", UnreliableChannel(), func(conn *WebRTCConnection, data []byte) {
+		assert.Equal(t, a.w.ID.ID, conn.PeerID)
+		bReceived <- data
+	}))
+	assert.Error(t, a.w.RegisterChannel("bulk", nil, nil))
+	assert.Error(t, a.w.RegisterChannel(defaultChannel, nil, nil))
+	// only a knows this one, so b refuses it
+	assert.NoError(t, a.w.RegisterChannel("secret", nil, func(conn *WebRTCConnection, data []byte) {}))
+
+	aEvents := make(chan Event, 32)
+	bEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	b.w.Subscribe(func(e Event) { bEvents <- e })
+	assert.Error(t, a.w.OpenChannel(b.w.ID.ID, nil, "bulk"))
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	waitForPeer(t, aEvents)
+
+	assert.NoError(t, a.w.OpenChannel(b.w.ID.ID, nil, "bulk"))
+	waitForChannel(t, aEvents, "bulk")
+	waitForChannel(t, bEvents, "bulk")
+	accepted := b.w.GetConnection(a.w.ID.ID, nil).NamedChannel("bulk")
+	assert.False(t, accepted.Ordered())
+	assert.Equal(t, uint16(0), *accepted.MaxRetransmits())
+
+	assert.NoError(t, a.w.SendChannel(b.w.ID.ID, nil, "bulk", []byte("ping")))
+	select {
+	case data := <-bReceived:
+		assert.Equal(t, []byte("ping"), data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("b received nothing")
+	}
+	assert.NoError(t, b.w.SendChannel(a.w.ID.ID, nil, "bulk", []byte("pong")))
+	select {
+	case data := <-aReceived:
+		assert.Equal(t, []byte("pong"), data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a received nothing")
+	}
+
+	assert.NoError(t, a.w.OpenChannel(b.w.ID.ID, nil, "secret"))
+	waitForChannel(t, aEvents, "secret")
+	_ = a.w.SendChannel(b.w.ID.ID, nil, "secret", []byte("lost"))
+	// give b a chance to adopt the channel before checking that it did not
+	assert.NoError(t, a.w.SendChannel(b.w.ID.ID, nil, "bulk", []byte("after")))
+	select {
+	case data := <-bReceived:
+		assert.Equal(t, []byte("after"), data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("b received nothing")
+	}
+	assert.Nil(t, b.w.GetConnection(a.w.ID.ID, nil).NamedChannel("secret"))
+	// overlay messages still flow over the control channel
+	assert.True(t, a.w.IsActive(b.w.ID.ID))
+}
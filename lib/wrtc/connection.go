@@ -0,0 +1,253 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/pion/webrtc/v3"
+)
+
+// Key returns the key the connection is registered under.
+func (conn *WebRTCConnection) Key() ConnectionKey {
+	return keyFor(conn.PeerID, conn.InstanceID)
+}
+
+// Instance returns the peer instance of the connection: InstanceID if it was
+// known when connecting, otherwise the one learned since, or nil.
+func (conn *WebRTCConnection) Instance() *id.InstanceID {
+	if conn.InstanceID != nil {
+		return conn.InstanceID
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.learnedInstance
+}
+
+// learnInstance records the peer instance of a connection made without
+// knowing it. The first instance learned sticks.
+func (conn *WebRTCConnection) learnInstance(instanceID *id.InstanceID) {
+	if conn.InstanceID != nil || instanceID == nil {
+		return
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.learnedInstance == nil {
+		conn.learnedInstance = instanceID
+	}
+}
+
+func (conn *WebRTCConnection) IsPending() bool {
+	iceConnState := conn.PeerConnection.ICEConnectionState()
+	return iceConnState == webrtc.ICEConnectionStateChecking || iceConnState == webrtc.ICEConnectionStateNew
+}
+
+// Channel returns the data channel of the connection, or nil before one has
+// been created or received.
+func (conn *WebRTCConnection) Channel() *webrtc.DataChannel {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.channel
+}
+
+func (conn *WebRTCConnection) setChannel(channel *webrtc.DataChannel) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.channel = channel
+}
+
+// NamedChannel returns the named channel label of the connection, or nil if
+// it has not been opened.
+func (conn *WebRTCConnection) NamedChannel(label string) *webrtc.DataChannel {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.channels[label]
+}
+
+// addChannel records a named channel, reporting false if one with the same
+// label is already open.
+func (conn *WebRTCConnection) addChannel(channel *webrtc.DataChannel) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if _, ok := conn.channels[channel.Label()]; ok {
+		return false
+	}
+	if conn.channels == nil {
+		conn.channels = make(map[string]*webrtc.DataChannel)
+	}
+	conn.channels[channel.Label()] = channel
+	return true
+}
+
+// removeChannel forgets a named channel, returning it if it was recorded.
+func (conn *WebRTCConnection) removeChannel(channel *webrtc.DataChannel) *webrtc.DataChannel {
+	if channel == nil {
+		return nil
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.channels[channel.Label()] != channel {
+		return nil
+	}
+	delete(conn.channels, channel.Label())
+	return channel
+}
+
+// takeChannels forgets and returns every named channel.
+func (conn *WebRTCConnection) takeChannels() []*webrtc.DataChannel {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	channels := make([]*webrtc.DataChannel, 0, len(conn.channels))
+	for _, channel := range conn.channels {
+		channels = append(channels, channel)
+	}
+	conn.channels = nil
+	return channels
+}
+
+func (conn *WebRTCConnection) framer(label string) *framer {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.framers[label]
+}
+
+func (conn *WebRTCConnection) setFramer(label string, f *framer) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.framers == nil {
+		conn.framers = make(map[string]*framer)
+	}
+	conn.framers[label] = f
+}
+
+// Agreement returns the protocol version, codec and features settled on with
+// the peer, or nil until the handshake is over.
+func (conn *WebRTCConnection) Agreement() *message.Agreement {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.agreement
+}
+
+// Codec returns the format of the messages sent to the peer, which is JSON
+// until the handshake is over.
+func (conn *WebRTCConnection) Codec() message.Codec {
+	if agreement := conn.Agreement(); agreement != nil {
+		return agreement.Codec
+	}
+	return message.JSON
+}
+
+func (conn *WebRTCConnection) sentHello() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.helloSent = true
+}
+
+// receiveHello records the peer's hello, unless one was already recorded.
+func (conn *WebRTCConnection) receiveHello(hello *message.Hello) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.peerHello == nil {
+		conn.peerHello = hello
+	}
+}
+
+// agree settles the handshake once both hellos have been exchanged,
+// returning the agreement if this call settled it.
+func (conn *WebRTCConnection) agree() (*message.Agreement, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if !conn.helloSent || conn.peerHello == nil || conn.agreement != nil {
+		return nil, nil
+	}
+	agreement, err := message.Negotiate(conn.peerHello)
+	if err != nil {
+		return nil, err
+	}
+	conn.agreement = agreement
+	return agreement, nil
+}
+
+// IsOpen reports whether the connection is open and its data channel too.
+func (conn *WebRTCConnection) IsOpen() bool {
+	channel := conn.Channel()
+	return conn.State() == ConnectionOpen && channel != nil && channel.ReadyState() == webrtc.DataChannelStateOpen
+}
+
+// State returns where the connection is in its life.
+func (conn *WebRTCConnection) State() ConnectionState {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.state
+}
+
+// advance moves the connection forward to state, reporting whether it did.
+// States never move backwards, so that a late callback cannot, say, reopen a
+// connection which is draining.
+func (conn *WebRTCConnection) advance(state ConnectionState) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if state <= conn.state {
+		return false
+	}
+	conn.state = state
+	return true
+}
+
+// IsClosed reports whether the connection has been removed from its wrapper.
+func (conn *WebRTCConnection) IsClosed() bool {
+	return conn.State() == ConnectionClosed
+}
+
+// IsUsed reports whether we want to keep the connection.
+func (conn *WebRTCConnection) IsUsed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.isUsed
+}
+
+// setUsed records whether we want to keep the connection, reporting whether
+// that changed.
+func (conn *WebRTCConnection) setUsed(used bool) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	changed := conn.isUsed != used
+	conn.isUsed = used
+	return changed
+}
+
+// IsUsedByPeer reports whether the peer wants to keep the connection.
+func (conn *WebRTCConnection) IsUsedByPeer() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.isUsedByPeer
+}
+
+// setUsedByPeer records whether the peer wants to keep the connection,
+// reporting whether that changed.
+func (conn *WebRTCConnection) setUsedByPeer(used bool) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	changed := conn.isUsedByPeer != used
+	conn.isUsedByPeer = used
+	return changed
+}
+
+// holdIce keeps a candidate received before the remote description, for
+// takePendingIce to return once it is set. It reports whether the candidate
+// was held, or should instead be added now.
+func (conn *WebRTCConnection) holdIce(candidate webrtc.ICECandidate) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.PeerConnection.RemoteDescription() != nil {
+		return false
+	}
+	conn.pendingIce = append(conn.pendingIce, candidate)
+	return true
+}
+
+func (conn *WebRTCConnection) takePendingIce() []webrtc.ICECandidate {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	pending := conn.pendingIce
+	conn.pendingIce = nil
+	return pending
+}
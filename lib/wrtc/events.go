@@ -0,0 +1,156 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/transport"
+)
+
+// ConnectionState is where a connection is in its life. States only ever move
+// forward, in the order they are declared, though some may be skipped.
+type ConnectionState int
+
+const (
+	// ConnectionNew has been created but has exchanged no descriptions yet
+	ConnectionNew ConnectionState = iota
+	// ConnectionSignaling is exchanging SDP offers and answers
+	ConnectionSignaling
+	// ConnectionConnecting is checking ICE candidates
+	ConnectionConnecting
+	// ConnectionOpen has an open data channel
+	ConnectionOpen
+	// ConnectionDraining is being disconnected
+	ConnectionDraining
+	// ConnectionClosed has been removed from its wrapper
+	ConnectionClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionNew:
+		return "new"
+	case ConnectionSignaling:
+		return "signaling"
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionOpen:
+		return "open"
+	case ConnectionDraining:
+		return "draining"
+	case ConnectionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type EventType int
+
+const (
+	// PeerConnected is sent when a connection first opens
+	PeerConnected EventType = iota
+	// PeerDisconnected is sent when a connection closes
+	PeerDisconnected
+	// ChannelOpened is sent for every data channel which opens
+	ChannelOpened
+	// UsageChanged is sent when we or the peer start or stop using a connection
+	UsageChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "peer-connected"
+	case PeerDisconnected:
+		return "peer-disconnected"
+	case ChannelOpened:
+		return "channel-opened"
+	case UsageChanged:
+		return "usage-changed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change to one of the connections of a wrapper.
+type Event struct {
+	Type       EventType
+	PeerID     string
+	InstanceID *id.InstanceID
+	Connection *WebRTCConnection
+	// State is the state of the connection when the event was sent
+	State ConnectionState
+	// Channel is the label of the data channel, for ChannelOpened
+	Channel string
+	// IsUsed and IsUsedByPeer are the usage of the connection, for UsageChanged
+	IsUsed       bool
+	IsUsedByPeer bool
+}
+
+type EventHandler func(e Event)
+
+// Subscription identifies a handler registered with Subscribe.
+type Subscription int
+
+// Subscribe registers handler for events on every connection, returning a
+// Subscription to pass to Unsubscribe. Handlers are called on the goroutine
+// which caused the event, so they must not block.
+func (w *WebRTCWrapper) Subscribe(handler EventHandler) Subscription {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastSubscription += 1
+	if w.subscribers == nil {
+		w.subscribers = make(map[Subscription]EventHandler)
+	}
+	w.subscribers[w.lastSubscription] = handler
+	return w.lastSubscription
+}
+
+// Unsubscribe stops a handler registered with Subscribe from receiving events.
+func (w *WebRTCWrapper) Unsubscribe(s Subscription) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.subscribers, s)
+}
+
+func (w *WebRTCWrapper) emitEvent(e Event) {
+	e.PeerID = e.Connection.PeerID
+	e.InstanceID = e.Connection.Instance()
+	w.lock.Lock()
+	handlers := make([]EventHandler, 0, len(w.subscribers))
+	for _, handler := range w.subscribers {
+		handlers = append(handlers, handler)
+	}
+	w.lock.Unlock()
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+// transition moves conn forward to state, sending the events and transport
+// state changes that follow. It reports whether the connection moved.
+func (w *WebRTCWrapper) transition(conn *WebRTCConnection, state ConnectionState) bool {
+	if !conn.advance(state) {
+		return false
+	}
+	switch state {
+	case ConnectionOpen:
+		w.emitEvent(Event{Type: PeerConnected, Connection: conn, State: state})
+		w.emitState(conn.PeerID, transport.StateOpen)
+	case ConnectionClosed:
+		w.emitEvent(Event{Type: PeerDisconnected, Connection: conn, State: state})
+		w.emitState(conn.PeerID, transport.StateClosed)
+	}
+	return true
+}
+
+// usageChanged tells subscribers the current usage of conn.
+func (w *WebRTCWrapper) usageChanged(conn *WebRTCConnection) {
+	used, usedByPeer := conn.IsUsed(), conn.IsUsedByPeer()
+	w.emitEvent(Event{
+		Type:         UsageChanged,
+		Connection:   conn,
+		State:        conn.State(),
+		IsUsed:       used,
+		IsUsedByPeer: usedByPeer,
+	})
+}
@@ -0,0 +1,150 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// pipe hands signals straight to another wrapper, in order.
+type pipe struct {
+	w     *WebRTCWrapper
+	peer  *pipe
+	inbox chan *message.Message
+}
+
+type pipeSignaler struct {
+	pipe *pipe
+	conn *WebRTCConnection
+}
+
+func (s *pipeSignaler) SetConnection(connection *WebRTCConnection) { s.conn = connection }
+func (s *pipeSignaler) IsOverlay() bool                            { return false }
+func (s *pipeSignaler) AddConnection()                             {}
+
+func (s *pipeSignaler) Send(m *message.Message) {
+	if s.conn != nil {
+		m.Timestamp = s.conn.Timestamp
+	}
+	s.pipe.peer.inbox <- m
+}
+
+func newPipe(t *testing.T, router *vnet.Router, ip string) *pipe {
+	vn := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+	if err := router.AddNet(vn); err != nil {
+		t.Fatal(err)
+	}
+	settings := webrtc.SettingEngine{}
+	settings.SetVNet(vn)
+	p := &pipe{w: newTestWrapper(t), inbox: make(chan *message.Message, 64)}
+	p.w.API = webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+	p.w.Configuration = webrtc.Configuration{}
+	p.w.NewSignaler = func(peerID string, _ *id.InstanceID) Signaler {
+		return &pipeSignaler{pipe: p}
+	}
+	go func() {
+		for m := range p.inbox {
+			from := p.peer.w.ID
+			if err := p.w.HandleSignal(from.ID, from.InstanceID, m, &pipeSignaler{pipe: p}); err != nil {
+				t.Logf("signal error: %s", err.Error())
+			}
+		}
+	}()
+	return p
+}
+
+func nextEvent(t *testing.T, events chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+// newPipePair creates two wrappers signaling each other over a virtual
+// network, returning a function which stops them.
+func newPipePair(t *testing.T) (*pipe, *pipe, func()) {
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newPipe(t, router, "10.0.0.1")
+	b := newPipe(t, router, "10.0.0.2")
+	a.peer, b.peer = b, a
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return a, b, func() {
+		_ = a.w.Stop()
+		_ = b.w.Stop()
+		_ = router.Stop()
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+
+	aEvents := make(chan Event, 32)
+	bEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	bSubscription := b.w.Subscribe(func(e Event) { bEvents <- e })
+
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	conn := a.w.GetConnection(b.w.ID.ID, nil)
+	assert.NotNil(t, conn)
+	e := nextEvent(t, aEvents)
+	assert.Equal(t, ChannelOpened, e.Type)
+	assert.Equal(t, defaultChannel, e.Channel)
+	assert.Equal(t, conn, e.Connection)
+	e = nextEvent(t, aEvents)
+	assert.Equal(t, PeerConnected, e.Type)
+	assert.Equal(t, b.w.ID.ID, e.PeerID)
+	assert.Equal(t, ConnectionOpen, conn.State())
+	assert.Equal(t, ChannelOpened, nextEvent(t, bEvents).Type)
+	assert.Equal(t, PeerConnected, nextEvent(t, bEvents).Type)
+
+	// both sides use the connection, so a only marks it unused
+	assert.NoError(t, a.w.MarkUnused(b.w.ID.ID))
+	e = nextEvent(t, aEvents)
+	assert.Equal(t, UsageChanged, e.Type)
+	assert.False(t, e.IsUsed)
+	assert.True(t, e.IsUsedByPeer)
+	e = nextEvent(t, bEvents)
+	assert.Equal(t, UsageChanged, e.Type)
+	assert.True(t, e.IsUsed)
+	assert.False(t, e.IsUsedByPeer)
+
+	b.w.Unsubscribe(bSubscription)
+	assert.NoError(t, a.w.Close(b.w.ID.ID))
+	e = nextEvent(t, aEvents)
+	assert.Equal(t, PeerDisconnected, e.Type)
+	assert.Equal(t, ConnectionClosed, e.State)
+	assert.Equal(t, ConnectionClosed, conn.State())
+	assert.Eventually(t, func() bool {
+		return b.w.GetConnection(a.w.ID.ID, nil) == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Empty(t, bEvents)
+}
+
+func TestStatesOnlyMoveForward(t *testing.T) {
+	conn := &WebRTCConnection{}
+	assert.Equal(t, ConnectionNew, conn.State())
+	assert.True(t, conn.advance(ConnectionConnecting))
+	assert.False(t, conn.advance(ConnectionSignaling))
+	assert.True(t, conn.advance(ConnectionDraining))
+	assert.False(t, conn.advance(ConnectionOpen))
+	assert.True(t, conn.advance(ConnectionClosed))
+	assert.True(t, conn.IsClosed())
+	assert.Equal(t, "closed", conn.State().String())
+}
@@ -0,0 +1,254 @@
+package wrtc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/pion/webrtc/v3"
+	"sync"
+	"time"
+)
+
+// Every frame sent on a data channel starts with one of these bytes, telling
+// whether it holds a whole message or one fragment of a larger one. They
+// differ from the first bytes of unframed messages, '{' for JSON and 1 for
+// the binary codec, which peers agreeing on the codec but not on fragments
+// send.
+const (
+	frameWhole    byte = 0xf0
+	frameFragment byte = 0xf1
+)
+
+// fragmentHeaderSize is the size of the header of a fragment frame: its type,
+// the ID of the message it belongs to, its index and the number of fragments.
+const fragmentHeaderSize = 1 + 16 + 4 + 4
+
+// Defaults for the limits of a new WebRTCWrapper. Chunks stay within the
+// 16KiB messages every WebRTC implementation accepts.
+const DefaultMaxChunkSize = 16 * 1024
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+const DefaultMaxReassemblyBytes = 64 * 1024 * 1024
+const DefaultMaxPartialMessages = 64
+const DefaultReassemblyTimeout = 30 * time.Second
+const DefaultMaxBufferedAmount = 1024 * 1024
+const DefaultSendTimeout = 30 * time.Second
+
+// framer carries messages of any size over one data channel, splitting those
+// larger than a chunk into fragments which are reassembled on arrival, and
+// holding senders back while the channel has too much data buffered. Peers
+// without FeatureFragments neither send nor expect frames, so until framing
+// is turned on messages are sent as they are.
+type framer struct {
+	w       *WebRTCWrapper
+	channel *webrtc.DataChannel
+
+	lock   sync.Mutex
+	framed bool
+	// low is closed whenever the buffered amount falls below the threshold
+	low      chan struct{}
+	partials map[uuid.UUID]*partial
+	// held is the number of bytes held in partials
+	held int
+}
+
+// partial is a message whose fragments are still arriving.
+type partial struct {
+	total   uint32
+	chunks  map[uint32][]byte
+	size    int
+	started time.Time
+}
+
+func newFramer(w *WebRTCWrapper, channel *webrtc.DataChannel, framed bool) *framer {
+	f := &framer{
+		w:        w,
+		channel:  channel,
+		framed:   framed,
+		low:      make(chan struct{}),
+		partials: make(map[uuid.UUID]*partial),
+	}
+	channel.SetBufferedAmountLowThreshold(uint64(w.MaxBufferedAmount / 2))
+	channel.OnBufferedAmountLow(func() {
+		f.lock.Lock()
+		close(f.low)
+		f.low = make(chan struct{})
+		f.lock.Unlock()
+	})
+	return f
+}
+
+func (f *framer) setFramed(framed bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.framed = framed
+}
+
+// send writes data to the channel, in fragments if it does not fit in a chunk.
+func (f *framer) send(data []byte) error {
+	frames, err := f.split(data)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(f.w.SendTimeout)
+	for _, frame := range frames {
+		if err := f.write(frame, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split turns data into the frames carrying it.
+func (f *framer) split(data []byte) ([][]byte, error) {
+	if len(data) > f.w.MaxMessageSize {
+		return nil, fmt.Errorf("wrtc message of %d bytes exceeds %d", len(data), f.w.MaxMessageSize)
+	}
+	f.lock.Lock()
+	framed := f.framed
+	f.lock.Unlock()
+	if !framed {
+		return [][]byte{data}, nil
+	}
+	if 1+len(data) <= f.w.MaxChunkSize {
+		return [][]byte{append([]byte{frameWhole}, data...)}, nil
+	}
+	chunkSize := f.w.MaxChunkSize - fragmentHeaderSize
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("wrtc chunk size %d too small", f.w.MaxChunkSize)
+	}
+	total := (len(data) + chunkSize - 1) / chunkSize
+	messageID := uuid.New()
+	frames := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-i*chunkSize)
+		frame[0] = frameFragment
+		copy(frame[1:17], messageID[:])
+		binary.BigEndian.PutUint32(frame[17:21], uint32(i))
+		binary.BigEndian.PutUint32(frame[21:25], uint32(total))
+		frames = append(frames, append(frame, data[i*chunkSize:end]...))
+	}
+	return frames, nil
+}
+
+// write sends a frame once the channel's buffer has room for it.
+func (f *framer) write(frame []byte, deadline time.Time) error {
+	for {
+		f.lock.Lock()
+		low := f.low
+		f.lock.Unlock()
+		if f.channel.BufferedAmount() <= uint64(f.w.MaxBufferedAmount) {
+			break
+		}
+		select {
+		case <-low:
+		case <-time.After(time.Until(deadline)):
+			return fmt.Errorf("wrtc send timed out with %d bytes buffered", f.channel.BufferedAmount())
+		}
+	}
+	if err := f.channel.Send(frame); err != nil {
+		return fmt.Errorf("wrtc message send error: %s", err.Error())
+	}
+	return nil
+}
+
+// receive takes a frame from the channel, returning the message it completes
+// if any. Partial messages are dropped once older than ReassemblyTimeout, or
+// when holding them would exceed MaxMessageSize or MaxReassemblyBytes, and
+// no more than MaxPartialMessages are started.
+func (f *framer) receive(frame []byte) ([]byte, bool, error) {
+	if len(frame) == 0 {
+		return nil, false, fmt.Errorf("wrtc empty frame")
+	}
+	switch frame[0] {
+	case frameWhole:
+		return frame[1:], true, nil
+	case '{':
+		// an unframed JSON message, from a peer without fragments or sent
+		// before the handshake
+		return frame, true, nil
+	case frameFragment:
+	default:
+		if message.IsBinary(frame) {
+			// an unframed binary message, from a peer without fragments
+			return frame, true, nil
+		}
+		return nil, false, fmt.Errorf("wrtc unknown frame type %d", frame[0])
+	}
+	if len(frame) < fragmentHeaderSize {
+		return nil, false, fmt.Errorf("wrtc truncated fragment")
+	}
+	var messageID uuid.UUID
+	copy(messageID[:], frame[1:17])
+	index := binary.BigEndian.Uint32(frame[17:21])
+	total := binary.BigEndian.Uint32(frame[21:25])
+	chunk := frame[fragmentHeaderSize:]
+	if total == 0 || index >= total || int64(total) > int64(f.w.MaxMessageSize) {
+		return nil, false, fmt.Errorf("wrtc invalid fragment %d of %d", index, total)
+	}
+	if len(chunk) == 0 {
+		// it would hold a partial message without counting towards any limit
+		return nil, false, fmt.Errorf("wrtc empty fragment %d of %d", index, total)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expire(time.Now())
+	p, ok := f.partials[messageID]
+	if !ok {
+		if len(f.partials) >= f.w.MaxPartialMessages {
+			return nil, false, fmt.Errorf("wrtc dropped fragment, %d messages already being reassembled", len(f.partials))
+		}
+		p = &partial{total: total, chunks: make(map[uint32][]byte), started: time.Now()}
+		f.partials[messageID] = p
+	}
+	if p.total != total {
+		f.drop(messageID, p)
+		return nil, false, fmt.Errorf("wrtc fragment count changed from %d to %d", p.total, total)
+	}
+	if _, ok := p.chunks[index]; ok {
+		return nil, false, nil
+	}
+	if p.size+len(chunk) > f.w.MaxMessageSize || f.held+len(chunk) > f.w.MaxReassemblyBytes {
+		f.drop(messageID, p)
+		return nil, false, fmt.Errorf("wrtc dropped message too large to reassemble")
+	}
+	// the frame buffer may be reused by the channel once we return
+	p.chunks[index] = append([]byte{}, chunk...)
+	p.size += len(chunk)
+	f.held += len(chunk)
+	if uint32(len(p.chunks)) < p.total {
+		return nil, false, nil
+	}
+	f.drop(messageID, p)
+	data := make([]byte, 0, p.size)
+	for i := uint32(0); i < p.total; i++ {
+		data = append(data, p.chunks[i]...)
+	}
+	return data, true, nil
+}
+
+// expire drops partial messages older than ReassemblyTimeout.
+func (f *framer) expire(now time.Time) {
+	for messageID, p := range f.partials {
+		if now.Sub(p.started) > f.w.ReassemblyTimeout {
+			f.drop(messageID, p)
+		}
+	}
+}
+
+func (f *framer) drop(messageID uuid.UUID, p *partial) {
+	delete(f.partials, messageID)
+	f.held -= p.size
+}
+
+// pending returns the number of partial messages and the bytes they hold.
+func (f *framer) pending() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.partials), f.held
+}
@@ -0,0 +1,152 @@
+package wrtc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// splitFrames returns the frames f would write to carry data.
+func splitFrames(t *testing.T, f *framer, data []byte) [][]byte {
+	frames, err := f.split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func newTestFramer(t *testing.T) *framer {
+	w := newTestWrapper(t)
+	w.MaxChunkSize = 64
+	w.MaxMessageSize = 1024
+	w.MaxReassemblyBytes = 1536
+	w.MaxPartialMessages = 4
+	return &framer{w: w, framed: true, low: make(chan struct{}), partials: make(map[uuid.UUID]*partial)}
+}
+
+func TestReassembly(t *testing.T) {
+	f := newTestFramer(t)
+	data, complete, err := f.receive(splitFrames(t, f, []byte("small"))[0])
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []byte("small"), data)
+
+	message := make([]byte, 1000)
+	_, _ = rand.Read(message)
+	frames := splitFrames(t, f, message)
+	assert.Greater(t, len(frames), 1)
+	// fragments may arrive in any order, and more than once
+	for i := len(frames) - 1; i > 0; i-- {
+		_, complete, err = f.receive(frames[i])
+		assert.NoError(t, err)
+		assert.False(t, complete)
+	}
+	_, complete, _ = f.receive(frames[1])
+	assert.False(t, complete)
+	data, complete, err = f.receive(frames[0])
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.True(t, bytes.Equal(message, data))
+	count, held := f.pending()
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 0, held)
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	f := newTestFramer(t)
+	_, _, err := f.receive(nil)
+	assert.Error(t, err)
+	_, _, err = f.receive([]byte{9, 1, 2})
+	assert.Error(t, err)
+	_, _, err = f.receive([]byte{frameFragment, 1, 2})
+	assert.Error(t, err)
+	bad := splitFrames(t, f, make([]byte, 200))[0]
+	bad[24] = 0
+	_, _, err = f.receive(bad)
+	assert.Error(t, err)
+
+	// two halves of messages fit, but a third would exceed the reassembly cap
+	for i := 0; i < 2; i++ {
+		frames := splitFrames(t, f, make([]byte, 1000))
+		for _, frame := range frames[:len(frames)/2+4] {
+			_, _, err = f.receive(frame)
+			assert.NoError(t, err)
+		}
+	}
+	frames := splitFrames(t, f, make([]byte, 1000))
+	for _, frame := range frames {
+		if _, _, err = f.receive(frame); err != nil {
+			break
+		}
+	}
+	assert.Error(t, err)
+	count, held := f.pending()
+	assert.Equal(t, 2, count)
+	assert.LessOrEqual(t, held, f.w.MaxReassemblyBytes)
+
+	// stale partial messages are dropped
+	f.w.ReassemblyTimeout = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	_, _, err = f.receive(splitFrames(t, f, []byte("x"))[0])
+	assert.NoError(t, err)
+	_, _, err = f.receive(frames[0])
+	assert.NoError(t, err)
+	count, held = f.pending()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, len(frames[0])-fragmentHeaderSize, held)
+
+	// empty fragments are refused, as they would not count towards the caps
+	empty := frames[1][:fragmentHeaderSize]
+	_, _, err = f.receive(empty)
+	assert.Error(t, err)
+	// and only so many messages may be reassembled at once
+	for i := 0; i < 3; i++ {
+		_, _, err = f.receive(splitFrames(t, f, make([]byte, 100))[0])
+		assert.NoError(t, err)
+	}
+	_, _, err = f.receive(splitFrames(t, f, make([]byte, 100))[0])
+	assert.Error(t, err)
+	count, _ = f.pending()
+	assert.Equal(t, 4, count)
+	// though fragments of those already started still arrive
+	_, _, err = f.receive(frames[1])
+	assert.NoError(t, err)
+}
+
+func TestLargeMessages(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+	// a small buffer makes the sender wait on the channel to drain
+	a.w.MaxBufferedAmount = 64 * 1024
+
+	received := make(chan []byte, 1)
+	assert.NoError(t, a.w.RegisterChannel("blob", nil, func(conn *WebRTCConnection, data []byte) {}))
+	assert.NoError(t, b.w.RegisterChannel("blob", nil, func(conn *WebRTCConnection, data []byte) {
+		received <- data
+	}))
+	aEvents := make(chan Event, 32)
+	bEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	b.w.Subscribe(func(e Event) { bEvents <- e })
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	waitForPeer(t, aEvents)
+	assert.NoError(t, a.w.OpenChannel(b.w.ID.ID, nil, "blob"))
+	waitForChannel(t, aEvents, "blob")
+	waitForChannel(t, bEvents, "blob")
+
+	blob := make([]byte, 4*1024*1024)
+	_, _ = rand.Read(blob)
+	assert.NoError(t, a.w.SendChannel(b.w.ID.ID, nil, "blob", blob))
+	select {
+	case data := <-received:
+		assert.True(t, bytes.Equal(blob, data))
+	case <-time.After(30 * time.Second):
+		t.Fatal("b received nothing")
+	}
+
+	a.w.MaxMessageSize = 1024
+	assert.Error(t, a.w.SendChannel(b.w.ID.ID, nil, "blob", blob))
+}
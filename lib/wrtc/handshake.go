@@ -0,0 +1,87 @@
+package wrtc
+
+import (
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"time"
+)
+
+// DefaultHandshakeTimeout is how long we wait for a peer's hello before
+// taking it to predate the handshake.
+const DefaultHandshakeTimeout = 5 * time.Second
+
+// startHandshake sends our signed hello once the control channel is open. The
+// hello is unframed JSON, so that peers which speak nothing newer can still read
+// it, and the connection opens once the peer's hello has been handled too.
+func (w *WebRTCWrapper) startHandshake(conn *WebRTCConnection) {
+	f := conn.framer(defaultChannel)
+	if f == nil {
+		return
+	}
+	hello := &message.Message{
+		Timestamp: time.Now(),
+		Data: message.MessageData{
+			To:           conn.PeerID,
+			From:         w.ID.ID,
+			FromInstance: w.ID.InstanceID.ID,
+			Action:       message.Handshake,
+			Protocol:     message.LocalHello(),
+		},
+	}
+	err := signer.PackMessage(hello, w.ID)
+	var bytes []byte
+	if err == nil {
+		bytes, err = message.Encode(hello)
+	}
+	if err == nil {
+		err = f.send(bytes)
+	}
+	if err != nil {
+		fmt.Printf("wrtc handshake with %s error: %s\n", id.ShortID(conn.PeerID), err.Error())
+		if err := w.Disconnect(conn); err != nil {
+			fmt.Printf("wrtc disconnect error: %s\n", err.Error())
+		}
+		return
+	}
+	conn.sentHello()
+	time.AfterFunc(w.HandshakeTimeout, func() {
+		// peers which never answer are treated as legacy ones
+		conn.receiveHello(message.LegacyHello())
+		w.finishHandshake(conn)
+	})
+	w.finishHandshake(conn)
+}
+
+// onHello handles the peer's hello.
+func (w *WebRTCWrapper) onHello(conn *WebRTCConnection, hello *message.Hello) {
+	if hello == nil {
+		hello = message.LegacyHello()
+	}
+	conn.receiveHello(hello)
+	w.finishHandshake(conn)
+}
+
+// finishHandshake opens conn once both hellos have been exchanged, or drops
+// it if we cannot speak with the peer.
+func (w *WebRTCWrapper) finishHandshake(conn *WebRTCConnection) {
+	if conn.IsClosed() {
+		return
+	}
+	agreement, err := conn.agree()
+	if err != nil {
+		fmt.Printf("wrtc handshake with %s failed: %s\n", id.ShortID(conn.PeerID), err.Error())
+		if err := w.Disconnect(conn); err != nil {
+			fmt.Printf("wrtc disconnect error: %s\n", err.Error())
+		}
+		return
+	}
+	if agreement == nil {
+		return
+	}
+	if f := conn.framer(defaultChannel); f != nil {
+		f.setFramed(agreement.Has(message.FeatureFragments))
+	}
+	w.transition(conn, ConnectionOpen)
+}
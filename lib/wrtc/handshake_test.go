@@ -0,0 +1,119 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+
+	aReceived := make(chan *message.Message, 1)
+	bReceived := make(chan *message.Message, 1)
+	a.w.OnMessage(func(m *message.Message) { aReceived <- m })
+	b.w.OnMessage(func(m *message.Message) { bReceived <- m })
+	aEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	assert.Equal(t, ChannelOpened, nextEvent(t, aEvents).Type)
+	assert.Equal(t, PeerConnected, nextEvent(t, aEvents).Type)
+	for _, conn := range []*WebRTCConnection{a.w.GetConnection(b.w.ID.ID, nil), b.w.GetConnection(a.w.ID.ID, nil)} {
+		assert.Eventually(t, func() bool { return conn.Agreement() != nil }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, message.ProtocolVersion, conn.Agreement().Version)
+		assert.Equal(t, message.Binary, conn.Codec())
+		assert.True(t, conn.Agreement().Has(message.FeatureFragments))
+		assert.True(t, conn.Agreement().Has(message.FeatureChannels))
+	}
+
+	send := func(from, to *pipe, received chan *message.Message) {
+		assert.NoError(t, from.w.Send(&message.Message{Data: message.MessageData{
+			To:     to.w.ID.ID,
+			Action: message.OverlayMessage,
+			Value:  []byte("hello"),
+		}}))
+		select {
+		case m := <-received:
+			assert.Equal(t, from.w.ID.ID, m.Data.From)
+			assert.Equal(t, []byte("hello"), m.Data.Value)
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received")
+		}
+	}
+	send(a, b, bReceived)
+	send(b, a, aReceived)
+}
+
+func TestLegacyHandshake(t *testing.T) {
+	conn := &WebRTCConnection{}
+	assert.Equal(t, message.JSON, conn.Codec())
+	conn.receiveHello(message.LegacyHello())
+	agreement, err := conn.agree()
+	assert.NoError(t, err)
+	assert.Nil(t, agreement)
+	conn.sentHello()
+	// a hello arriving after the timeout is ignored
+	conn.receiveHello(message.LocalHello())
+	agreement, err = conn.agree()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, agreement.Version)
+	assert.Equal(t, message.JSON, conn.Codec())
+	assert.False(t, conn.Agreement().Has(message.FeatureChannels))
+	agreement, err = conn.agree()
+	assert.NoError(t, err)
+	assert.Nil(t, agreement)
+
+	// legacy peers send plain JSON, and get it back
+	f := newTestFramer(t)
+	f.framed = false
+	data, complete, err := f.receive([]byte(`{"data":""}`))
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []byte(`{"data":""}`), data)
+	frames := splitFrames(t, f, make([]byte, 200))
+	assert.Len(t, frames, 1)
+	assert.Len(t, frames[0], 200)
+
+	conn = &WebRTCConnection{}
+	conn.sentHello()
+	conn.receiveHello(&message.Hello{Version: message.ProtocolVersion + 2, MinVersion: message.ProtocolVersion + 1})
+	_, err = conn.agree()
+	assert.Error(t, err)
+	assert.Nil(t, conn.Agreement())
+}
+
+func TestBinaryWithoutFragments(t *testing.T) {
+	agreement, err := message.Negotiate(&message.Hello{
+		Version: message.ProtocolVersion,
+		Codecs:  []message.Codec{message.Binary},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, message.Binary, agreement.Codec)
+	assert.False(t, agreement.Has(message.FeatureFragments))
+
+	// such peers send binary messages unframed
+	m := &message.Message{ID: "m1", Data: message.MessageData{Action: message.OverlayMessage, Value: []byte("hello")}}
+	bytes, err := message.Binary.Encode(m)
+	assert.NoError(t, err)
+	f := newTestFramer(t)
+	f.framed = false
+	data, complete, err := f.receive(bytes)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, bytes, data)
+	decoded, err := message.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), decoded.Data.Value)
+
+	// which framed ones never start with
+	f.framed = true
+	frames := splitFrames(t, f, bytes)
+	assert.Len(t, frames, 1)
+	assert.False(t, message.IsBinary(frames[0]))
+	data, complete, err = f.receive(frames[0])
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, bytes, data)
+}
@@ -0,0 +1,136 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"sync"
+)
+
+// ConnectionKey identifies a connection by peer ID and instance UUID. The UUID
+// is empty when the instance of the peer was not known when connecting, and
+// stays so once it is learned.
+type ConnectionKey struct {
+	PeerID       string
+	InstanceUUID string
+}
+
+func keyFor(peerID string, instanceID *id.InstanceID) ConnectionKey {
+	key := ConnectionKey{PeerID: peerID}
+	if instanceID != nil {
+		key.InstanceUUID = instanceID.UUID
+	}
+	return key
+}
+
+// registry holds the connections of a wrapper. It is safe for concurrent use,
+// since connections are added and removed from pion callbacks, the cleaner
+// and callers alike.
+type registry struct {
+	// self is our own ID, whose other instances are only ever matched exactly
+	self string
+
+	lock  sync.RWMutex
+	conns map[ConnectionKey]*WebRTCConnection
+	// order holds the connections in the order they were added
+	order []*WebRTCConnection
+}
+
+func newRegistry(self string) *registry {
+	return &registry{
+		self:  self,
+		conns: make(map[ConnectionKey]*WebRTCConnection),
+	}
+}
+
+// get returns the connection to the given peer instance, or with a nil
+// instance to any instance of the peer, preferring open connections. A
+// connection whose instance is not known yet may be to any instance, so it
+// matches too. Our own other instances are only ever matched exactly.
+func (r *registry) get(peerID string, instanceID *id.InstanceID) *WebRTCConnection {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.lookup(peerID, instanceID)
+}
+
+func (r *registry) lookup(peerID string, instanceID *id.InstanceID) *WebRTCConnection {
+	if instanceID != nil {
+		if conn, ok := r.conns[keyFor(peerID, instanceID)]; ok {
+			return conn
+		}
+	} else if peerID == r.self {
+		return nil
+	}
+	var match *WebRTCConnection
+	for _, conn := range r.order {
+		if conn.PeerID != peerID {
+			continue
+		}
+		instance := conn.Instance()
+		if instanceID == nil {
+			if conn.IsOpen() {
+				return conn
+			}
+		} else if instance.Is(instanceID) {
+			return conn
+		} else if instance != nil || peerID == r.self {
+			continue
+		}
+		if match == nil {
+			match = conn
+		}
+	}
+	return match
+}
+
+// instances lists the known instances of peerID we hold connections to.
+func (r *registry) instances(peerID string) []*id.InstanceID {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var instances []*id.InstanceID
+	for _, conn := range r.order {
+		if instance := conn.Instance(); conn.PeerID == peerID && instance != nil {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// add registers conn unless a matching connection already exists, in which
+// case that connection is returned along with false.
+func (r *registry) add(conn *WebRTCConnection) (*WebRTCConnection, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if existing := r.lookup(conn.PeerID, conn.InstanceID); existing != nil {
+		return existing, false
+	}
+	if existing, ok := r.conns[conn.Key()]; ok {
+		return existing, false
+	}
+	r.conns[conn.Key()] = conn
+	r.order = append(r.order, conn)
+	return conn, true
+}
+
+// remove unregisters conn, reporting whether it was registered. Only one of
+// several concurrent removals of the same connection succeeds.
+func (r *registry) remove(conn *WebRTCConnection) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conns[conn.Key()] != conn {
+		return false
+	}
+	delete(r.conns, conn.Key())
+	for i, c := range r.order {
+		if c == conn {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// snapshot returns the registered connections in the order they were added.
+func (r *registry) snapshot() []*WebRTCConnection {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]*WebRTCConnection{}, r.order...)
+}
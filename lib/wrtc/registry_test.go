@@ -0,0 +1,164 @@
+package wrtc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// nullSignaler drops every signal, leaving connections forever negotiating.
+type nullSignaler struct{}
+
+func (s *nullSignaler) SetConnection(connection *WebRTCConnection) {}
+func (s *nullSignaler) IsOverlay() bool                            { return false }
+func (s *nullSignaler) AddConnection()                             {}
+func (s *nullSignaler) Send(m *message.Message)                    {}
+
+func newTestWrapper(t *testing.T) *WebRTCWrapper {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWebRTCWrapper(pkid)
+	w.NewSignaler = func(peerID string, instanceID *id.InstanceID) Signaler {
+		return &nullSignaler{}
+	}
+	return w
+}
+
+func peerID(i int) string {
+	return fmt.Sprintf("%064x", i+1)
+}
+
+func TestRegistryLookup(t *testing.T) {
+	r := newRegistry(peerID(0))
+	first, second := id.NewInstanceID(), id.NewInstanceID()
+
+	peer := &WebRTCConnection{PeerID: peerID(1), InstanceID: first}
+	added, ok := r.add(peer)
+	assert.True(t, ok)
+	assert.Equal(t, peer, added)
+	// any instance of a peer will do, but a given instance must match
+	assert.Equal(t, peer, r.get(peerID(1), nil))
+	assert.Equal(t, peer, r.get(peerID(1), id.InstanceIDFromString(first.ID)))
+	assert.Nil(t, r.get(peerID(1), second))
+	added, ok = r.add(&WebRTCConnection{PeerID: peerID(1)})
+	assert.False(t, ok)
+	assert.Equal(t, peer, added)
+	other := &WebRTCConnection{PeerID: peerID(1), InstanceID: second}
+	_, ok = r.add(other)
+	assert.True(t, ok)
+	assert.Equal(t, other, r.get(peerID(1), second))
+	assert.Equal(t, []*id.InstanceID{first, second}, r.instances(peerID(1)))
+
+	// a connection whose instance is unknown may be to any instance, until
+	// the instance is learned
+	unknown := &WebRTCConnection{PeerID: peerID(2)}
+	_, ok = r.add(unknown)
+	assert.True(t, ok)
+	assert.Equal(t, unknown, r.get(peerID(2), first))
+	assert.Empty(t, r.instances(peerID(2)))
+	unknown.learnInstance(second)
+	unknown.learnInstance(first)
+	assert.Equal(t, second, unknown.Instance())
+	assert.Nil(t, r.get(peerID(2), first))
+	assert.Equal(t, unknown, r.get(peerID(2), second))
+	assert.Equal(t, []*id.InstanceID{second}, r.instances(peerID(2)))
+
+	// our own instances are only matched exactly
+	self := &WebRTCConnection{PeerID: peerID(0), InstanceID: first}
+	_, ok = r.add(self)
+	assert.True(t, ok)
+	assert.Equal(t, self, r.get(peerID(0), first))
+	assert.Nil(t, r.get(peerID(0), second))
+	assert.Nil(t, r.get(peerID(0), nil))
+	_, ok = r.add(&WebRTCConnection{PeerID: peerID(0), InstanceID: second})
+	assert.True(t, ok)
+	_, ok = r.add(&WebRTCConnection{PeerID: peerID(0)})
+	assert.True(t, ok)
+	_, ok = r.add(&WebRTCConnection{PeerID: peerID(0)})
+	assert.False(t, ok)
+	assert.Nil(t, r.get(peerID(0), id.NewInstanceID()))
+
+	assert.Equal(t, []*WebRTCConnection{peer, other, unknown, self}, r.snapshot()[:4])
+	assert.True(t, r.remove(peer))
+	assert.False(t, r.remove(peer))
+	assert.Equal(t, other, r.get(peerID(1), nil))
+	assert.True(t, r.remove(other))
+	assert.Nil(t, r.get(peerID(1), nil))
+	assert.Len(t, r.snapshot(), 4)
+}
+
+func TestConnectDisconnectStorm(t *testing.T) {
+	w := newTestWrapper(t)
+	const peers = 4
+	const workers = 8
+	const rounds = 20
+
+	var lock sync.Mutex
+	opened := make(map[string]int)
+	closed := make(map[string]int)
+	w.OnStateChange(func(peerID string, state transport.State) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch state {
+		case transport.StateConnecting:
+			opened[peerID] += 1
+		case transport.StateClosed:
+			closed[peerID] += 1
+		}
+	})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				peer := peerID((worker + round) % peers)
+				switch (worker + round) % 4 {
+				case 0, 1:
+					assert.NoError(t, w.Connect(peer, nil))
+				case 2:
+					// the connection may already be gone
+					_ = w.Close(peer)
+				case 3:
+					for _, conn := range w.Connections() {
+						_ = conn.IsUsed()
+						_ = w.IsActive(conn.PeerID)
+					}
+					_ = w.OpenConnections()
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// at most one connection per peer survives the storm
+	seen := make(map[string]bool)
+	for _, conn := range w.Connections() {
+		assert.False(t, seen[conn.PeerID])
+		seen[conn.PeerID] = true
+	}
+	assert.NoError(t, w.Stop())
+	assert.Empty(t, w.Connections())
+	for i := 0; i < peers; i++ {
+		assert.Nil(t, w.GetConnection(peerID(i), nil))
+	}
+
+	// every connection started was closed exactly once
+	lock.Lock()
+	defer lock.Unlock()
+	assert.NotEmpty(t, opened)
+	assert.Equal(t, opened, closed)
+}
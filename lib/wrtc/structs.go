@@ -2,38 +2,61 @@ package wrtc
 
 import (
 	"github.com/matanbroner/goverlay/lib/id"
-	"github.com/matanbroner/goverlay/lib/overlay"
+	"github.com/matanbroner/goverlay/lib/message"
 	"github.com/pion/webrtc/v3"
+	"sync"
 	"time"
 )
 
+type Signaler interface {
+	SetConnection(connection *WebRTCConnection)
+	IsOverlay() bool
+	AddConnection()
+	Send(m *message.Message)
+}
+
 type WebRTCWrapperConfig struct {
 	IsInitiator bool
 	PeerID      string
 	InstanceID  *id.InstanceID
 	Timestamp   time.Time
-	Signaler    overlay.Signaler
+	Signaler    Signaler
 
 	// websocketProxy
 	// websocketProxyInstance
 }
 
+// WebRTCConnection is a connection to a single peer instance. The pointer is
+// a stable handle for as long as the connection lives, and the fields which
+// change after creation are only reachable through its methods.
 type WebRTCConnection struct {
 	PeerID         string
 	InstanceID     *id.InstanceID
-	IsUsed         bool
-	IsUsedByPeer   bool
 	IsInitiator    bool
 	IsGolden       bool
-	IsClosed       bool
 	IsOverlay      bool
 	Timestamp      time.Time
 	LastUsed       time.Time
-	Signaler       overlay.Signaler
+	Signaler       Signaler
 	PeerConnection *webrtc.PeerConnection
-	Channel        *webrtc.DataChannel
-	PendingIce     []webrtc.ICECandidate
-	Index          int
 
-	// pendingIce: []
+	lock    sync.Mutex
+	state   ConnectionState
+	channel *webrtc.DataChannel
+	// channels holds the named channels opened besides the control channel
+	channels map[string]*webrtc.DataChannel
+	// framers carry messages over each channel, keyed by label
+	framers      map[string]*framer
+	isUsed       bool
+	isUsedByPeer bool
+	// helloSent and peerHello track the handshake, and agreement holds its
+	// outcome
+	helloSent bool
+	peerHello *message.Hello
+	agreement *message.Agreement
+	// pendingIce holds candidates received before the remote description
+	pendingIce []webrtc.ICECandidate
+	// learnedInstance is the peer instance of a connection made without
+	// knowing it, once its signals tell
+	learnedInstance *id.InstanceID
 }
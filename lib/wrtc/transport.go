@@ -0,0 +1,76 @@
+package wrtc
+
+import (
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"time"
+)
+
+var _ transport.Transport = &WebRTCWrapper{}
+
+// Connect starts a connection to the given peer as the initiator, using a
+// signaler from NewSignaler.
+func (w *WebRTCWrapper) Connect(peerID string, instanceID *id.InstanceID) error {
+	if w.NewSignaler == nil {
+		return fmt.Errorf("wrtc no signaler available to connect to %s", id.ShortID(peerID))
+	}
+	if w.GetConnection(peerID, instanceID) != nil {
+		return nil
+	}
+	_, err := w.Start(&WebRTCWrapperConfig{
+		IsInitiator: true,
+		PeerID:      peerID,
+		InstanceID:  instanceID,
+		Timestamp:   time.Now(),
+		Signaler:    w.NewSignaler(peerID, instanceID),
+	})
+	return err
+}
+
+func (w *WebRTCWrapper) Close(peerID string) error {
+	conn := w.GetConnection(peerID, nil)
+	if conn == nil {
+		return fmt.Errorf("wrtc no active connection for (%s)", peerID)
+	}
+	return w.Disconnect(conn)
+}
+
+func (w *WebRTCWrapper) Peers() []string {
+	var peers []string
+	for _, conn := range w.OpenConnections() {
+		peers = append(peers, conn.PeerID)
+	}
+	return peers
+}
+
+func (w *WebRTCWrapper) OnMessage(handler transport.MessageHandler) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.messageHandlers = append(w.messageHandlers, handler)
+}
+
+func (w *WebRTCWrapper) OnStateChange(handler transport.StateHandler) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.stateHandlers = append(w.stateHandlers, handler)
+}
+
+func (w *WebRTCWrapper) emitMessage(m *message.Message) {
+	w.lock.Lock()
+	handlers := append([]transport.MessageHandler{}, w.messageHandlers...)
+	w.lock.Unlock()
+	for _, handler := range handlers {
+		handler(m)
+	}
+}
+
+func (w *WebRTCWrapper) emitState(peerID string, state transport.State) {
+	w.lock.Lock()
+	handlers := append([]transport.StateHandler{}, w.stateHandlers...)
+	w.lock.Unlock()
+	for _, handler := range handlers {
+		handler(peerID, state)
+	}
+}
@@ -0,0 +1,49 @@
+package wrtc
+
+import (
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+)
+
+// verify checks that m was signed by the peer at the other end of conn, for
+// us, and is not a replay, replacing its Data with the signed contents.
+// Unsigned messages cannot be verified and are refused.
+func (w *WebRTCWrapper) verify(conn *WebRTCConnection, m *message.Message) error {
+	if !m.Packed {
+		return fmt.Errorf("wrtc unsigned message")
+	}
+	if err := signer.UnpackMessage(m); err != nil {
+		return fmt.Errorf("wrtc verify error: %s", err.Error())
+	}
+	if m.Data.From != conn.PeerID {
+		return fmt.Errorf("wrtc message signed by %s arrived from %s", id.ShortID(m.Data.From), id.ShortID(conn.PeerID))
+	}
+	if m.Data.To != w.ID.ID {
+		return fmt.Errorf("wrtc message was signed for %s", id.ShortID(m.Data.To))
+	}
+	if m.Data.ToInstance != "" && m.Data.ToInstance != w.ID.InstanceID.ID {
+		return fmt.Errorf("wrtc message was signed for instance %s", m.Data.ToInstance)
+	}
+	if err := w.Replay.CheckMessage(m); err != nil {
+		return fmt.Errorf("wrtc %s", err.Error())
+	}
+	return nil
+}
+
+// reject drops a message which could not be read or verified.
+func (w *WebRTCWrapper) reject(conn *WebRTCConnection, err error) {
+	w.lock.Lock()
+	w.rejected += 1
+	w.lock.Unlock()
+	fmt.Printf("wrtc dropped message from %s: %s\n", id.ShortID(conn.PeerID), err.Error())
+}
+
+// Rejected returns how many messages have been dropped because they could
+// not be read or verified.
+func (w *WebRTCWrapper) Rejected() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.rejected
+}
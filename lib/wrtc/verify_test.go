@@ -0,0 +1,137 @@
+package wrtc
+
+import (
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRejectsUnverifiedAndReplayedMessages(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+
+	received := make(chan *message.Message, 4)
+	b.w.OnMessage(func(m *message.Message) { received <- m })
+	aEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	waitForPeer(t, aEvents)
+
+	overlayMessage := func(from string) *message.Message {
+		return &message.Message{Data: message.MessageData{
+			To:     b.w.ID.ID,
+			From:   from,
+			Action: message.OverlayMessage,
+			Value:  []byte("forged"),
+		}}
+	}
+	// unsigned
+	bytes, err := message.Encode(overlayMessage(a.w.ID.ID))
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	// signed by someone else claiming to be a
+	other := newTestWrapper(t)
+	forged := overlayMessage(a.w.ID.ID)
+	assert.NoError(t, signer.PackMessage(forged, other.ID))
+	bytes, err = message.Encode(forged)
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	// signed by someone else as themselves, but relayed by a
+	relayed := overlayMessage(other.ID.ID)
+	assert.NoError(t, signer.PackMessage(relayed, other.ID))
+	bytes, err = message.Binary.Encode(relayed)
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+
+	assert.NoError(t, a.w.Send(&message.Message{Data: message.MessageData{
+		To:     b.w.ID.ID,
+		Action: message.OverlayMessage,
+		Value:  []byte("genuine"),
+	}}))
+	select {
+	case m := <-received:
+		assert.Equal(t, []byte("genuine"), m.Data.Value)
+		assert.Equal(t, a.w.ID.ID, m.Data.From)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+	assert.Equal(t, 3, b.w.Rejected())
+
+	// a genuine message is delivered only once
+	captured := overlayMessage(a.w.ID.ID)
+	captured.Data.Value = []byte("once")
+	assert.NoError(t, signer.PackMessage(captured, a.w.ID))
+	bytes, err = message.Encode(captured)
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	// nor can one signed for somebody else be passed on
+	misdirected := overlayMessage(a.w.ID.ID)
+	misdirected.Data.To = other.ID.ID
+	assert.NoError(t, signer.PackMessage(misdirected, a.w.ID))
+	bytes, err = message.Encode(misdirected)
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	select {
+	case m := <-received:
+		assert.Equal(t, []byte("once"), m.Data.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+	assert.Eventually(t, func() bool { return b.w.Rejected() == 5 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, a.w.Rejected())
+	assert.Empty(t, received)
+}
+
+func TestSendToInstance(t *testing.T) {
+	a, b, stop := newPipePair(t)
+	defer stop()
+
+	received := make(chan *message.Message, 4)
+	b.w.OnMessage(func(m *message.Message) { received <- m })
+	aEvents := make(chan Event, 32)
+	a.w.Subscribe(func(e Event) { aEvents <- e })
+	assert.NoError(t, a.w.Connect(b.w.ID.ID, nil))
+	waitForPeer(t, aEvents)
+
+	// the instance of b was learned from its answer
+	instances := a.w.Instances(b.w.ID.ID)
+	if assert.Len(t, instances, 1) {
+		assert.True(t, instances[0].Is(b.w.ID.InstanceID))
+	}
+	assert.NoError(t, a.w.Send(&message.Message{Data: message.MessageData{
+		To:         b.w.ID.ID,
+		ToInstance: b.w.ID.InstanceID.ID,
+		Action:     message.OverlayMessage,
+		Value:      []byte("targeted"),
+	}}))
+	select {
+	case m := <-received:
+		assert.Equal(t, []byte("targeted"), m.Data.Value)
+		assert.Equal(t, a.w.ID.InstanceID.ID, m.Data.FromInstance)
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+	// another instance of b is not reachable over this connection
+	assert.Error(t, a.w.Send(&message.Message{Data: message.MessageData{
+		To:         b.w.ID.ID,
+		ToInstance: id.NewInstanceID().ID,
+		Action:     message.OverlayMessage,
+	}}))
+	// nor are messages signed for another instance accepted
+	misdirected := &message.Message{Data: message.MessageData{
+		To:         b.w.ID.ID,
+		ToInstance: id.NewInstanceID().ID,
+		From:       a.w.ID.ID,
+		Action:     message.OverlayMessage,
+	}}
+	assert.NoError(t, signer.PackMessage(misdirected, a.w.ID))
+	bytes, err := message.Encode(misdirected)
+	assert.NoError(t, err)
+	assert.NoError(t, a.w.SendRaw(b.w.ID.ID, bytes))
+	assert.Eventually(t, func() bool { return b.w.Rejected() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, received)
+}
@@ -1,85 +1,130 @@
 package wrtc
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/matanbroner/goverlay/lib/id"
 	"github.com/matanbroner/goverlay/lib/message"
-	"github.com/matanbroner/goverlay/lib/overlay"
 	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
 	"github.com/matanbroner/goverlay/lib/util"
 	"github.com/pion/webrtc/v3"
+	"sync"
 	"time"
 )
 
 const defaultChannel = "chat"
 
 type WebRTCWrapper struct {
-	ID             *id.PublicKeyId
-	Overlay        *overlay.Overlay
-	Connections    []*WebRTCConnection
-	ConnectionsMap map[string]*WebRTCConnection
-	InstancesMap   map[string]*WebRTCConnection
-	Listeners      []func()
-	DeadTimestamps []time.Time
+	ID *id.PublicKeyId
+	// API and Configuration are used to create peer connections, and can be
+	// replaced to run over a virtual network or with custom ICE servers
+	API           *webrtc.API
+	Configuration webrtc.Configuration
+	// NewSignaler creates the signaler used by Connect to reach a peer
+	NewSignaler func(peerID string, instanceID *id.InstanceID) Signaler
+	// MaxChunkSize bounds the frames written to data channels, with larger
+	// messages sent in fragments of up to MaxMessageSize in total
+	MaxChunkSize   int
+	MaxMessageSize int
+	// MaxReassemblyBytes bounds the memory held by partly received messages
+	// on each channel, MaxPartialMessages their number, and ReassemblyTimeout
+	// how long they are held for
+	MaxReassemblyBytes int
+	MaxPartialMessages int
+	ReassemblyTimeout  time.Duration
+	// MaxBufferedAmount is how much data a channel may have queued before
+	// senders wait, for up to SendTimeout, for it to drain
+	MaxBufferedAmount int
+	SendTimeout       time.Duration
+	// HandshakeTimeout is how long to wait for a peer's hello
+	HandshakeTimeout time.Duration
+	// Replay remembers the messages received, to refuse them if replayed
+	Replay *signer.ReplayCache
+
+	connections *registry
+	lock        sync.Mutex
+	// deadTimestamps holds the timestamps of closed connections, so that
+	// late signals for them do not start new ones
+	deadTimestamps   []time.Time
+	messageHandlers  []transport.MessageHandler
+	stateHandlers    []transport.StateHandler
+	subscribers      map[Subscription]EventHandler
+	lastSubscription Subscription
+	// channels holds the named channels registered with RegisterChannel
+	channels map[string]*channelSpec
+	// rejected counts the messages dropped because they failed verification
+	rejected int
 }
 
-func NewWebRTCWrapper(id *id.PublicKeyId, o *overlay.Overlay) *WebRTCWrapper {
+func NewWebRTCWrapper(id *id.PublicKeyId) *WebRTCWrapper {
 	w := &WebRTCWrapper{
-		ID:      id,
-		Overlay: o,
+		ID:                 id,
+		API:                webrtc.NewAPI(),
+		Configuration:      DefaultWebRTCConfig,
+		MaxChunkSize:       DefaultMaxChunkSize,
+		MaxMessageSize:     DefaultMaxMessageSize,
+		MaxReassemblyBytes: DefaultMaxReassemblyBytes,
+		MaxPartialMessages: DefaultMaxPartialMessages,
+		ReassemblyTimeout:  DefaultReassemblyTimeout,
+		MaxBufferedAmount:  DefaultMaxBufferedAmount,
+		SendTimeout:        DefaultSendTimeout,
+		HandshakeTimeout:   DefaultHandshakeTimeout,
+		Replay:             signer.NewReplayCache(),
+		connections:        newRegistry(id.ID),
 	}
 	return w
 }
 
 func (w *WebRTCWrapper) Start(config *WebRTCWrapperConfig) (*WebRTCConnection, error) {
-	existingConnection := w.GetConnection(config.PeerID, config.InstanceID)
-	if existingConnection != nil {
-		existingConnection.IsUsed = true
-	}
-	if config.PeerID == w.ID.ID && config.InstanceID.UUID == w.ID.InstanceID.UUID {
+	if config.PeerID == w.ID.ID && (config.InstanceID == nil || config.InstanceID.UUID == w.ID.InstanceID.UUID) {
 		// do not connect to self
 		return nil, nil
 	}
+	existingConnection := w.GetConnection(config.PeerID, config.InstanceID)
+	if existingConnection != nil {
+		w.setUsed(existingConnection, true)
+		return existingConnection, nil
+	}
 	connection := &WebRTCConnection{
 		PeerID:       config.PeerID,
 		InstanceID:   config.InstanceID,
-		IsUsed:       true,
-		IsUsedByPeer: true,
+		isUsed:       true,
+		isUsedByPeer: true,
 		IsInitiator:  config.IsInitiator,
 		IsGolden:     false,
-		IsClosed:     false,
 		Timestamp:    config.Timestamp,
 		LastUsed:     time.Now(),
 		IsOverlay:    config.Signaler.IsOverlay(),
 	}
 	connection.Signaler = config.Signaler
 
-	config.Signaler.SetConnection(connection)
-	w.Connections = append(w.Connections, connection)
-	connection.Index = len(w.Connections) - 1
-
-	if config.PeerID == w.ID.ID {
-		w.InstancesMap[config.InstanceID.UUID] = connection
-	} else {
-		w.ConnectionsMap[config.PeerID] = connection
-	}
-	pc, err := webrtc.NewPeerConnection(DefaultWebRTCConfig)
+	pc, err := w.API.NewPeerConnection(w.Configuration)
 	if err != nil {
 		return nil, err
 	}
 	connection.PeerConnection = pc
-	if !connection.IsInitiator {
-		// setup chat on incoming data channel
-		connection.PeerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
-			connection.Channel = dc
-		})
+
+	// another caller may have registered a connection since we looked
+	if existing, added := w.connections.add(connection); !added {
+		_ = pc.Close()
+		w.setUsed(existing, true)
+		return existing, nil
 	}
+	config.Signaler.SetConnection(connection)
+	w.emitState(config.PeerID, transport.StateConnecting)
+
+	// the control channel is opened by the initiator, whereas named channels
+	// may be opened by either side
+	connection.PeerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		w.acceptChannel(connection, dc)
+	})
 	connection.PeerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if !connection.IsClosed {
+		// a nil candidate marks the end of gathering
+		if candidate != nil && !connection.IsClosed() {
 			connection.Signaler.Send(&message.Message{
 				Data: message.MessageData{
-					Candidate: *candidate,
+					Candidate: candidate,
 				},
 			})
 		}
@@ -89,40 +134,39 @@ func (w *WebRTCWrapper) Start(config *WebRTCWrapperConfig) (*WebRTCConnection, e
 			sd, err := connection.PeerConnection.CreateOffer(nil)
 			if err != nil {
 				fmt.Printf("wrtc offer creation error: %s\n", err.Error())
+				return
 			}
-			if err := connection.PeerConnection.SetLocalDescription(sd); err != nil {
-				fmt.Printf("wrtc set local description error: %s\n", err.Error())
-			}
+			// send the offer before setting it locally, so that it reaches the
+			// peer ahead of the candidates gathered once it is set
+			w.transition(connection, ConnectionSignaling)
 			connection.Signaler.Send(&message.Message{
 				Data: message.MessageData{
-					SDP: *connection.PeerConnection.LocalDescription(),
+					SDP: &sd,
 				},
 			})
+			if err := connection.PeerConnection.SetLocalDescription(sd); err != nil {
+				fmt.Printf("wrtc set local description error: %s\n", err.Error())
+			}
 		}
 	})
 
 	connection.PeerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		switch state {
-		case webrtc.ICEConnectionStateClosed:
-		case webrtc.ICEConnectionStateDisconnected:
+		case webrtc.ICEConnectionStateChecking:
+			w.transition(connection, ConnectionConnecting)
 		case webrtc.ICEConnectionStateFailed:
 			if err := w.RemoveConnection(connection); err != nil {
 				fmt.Printf("wrtc ice state change remove connection error: %s\n", err.Error())
 			}
-			if err := w.UpdateListeners(); err != nil {
-				fmt.Printf("wrtc ice state update listeners error: %s\n", err.Error())
-			}
-		default:
-			return
 		}
 	})
 	if connection.IsInitiator {
-		// create chat channel
-		channel, err := connection.PeerConnection.CreateDataChannel(defaultChannel, nil)
+		// create the control channel
+		channel, err := connection.PeerConnection.CreateDataChannel(defaultChannel, ReliableChannel())
 		if err != nil {
 			return nil, fmt.Errorf("wrtc create default channel error")
 		}
-		connection.Channel = channel
+		connection.setChannel(channel)
 		if err := w.SetupDataChannel(connection); err != nil {
 			return nil, fmt.Errorf("wrtc setup default channel error")
 		}
@@ -130,42 +174,38 @@ func (w *WebRTCWrapper) Start(config *WebRTCWrapperConfig) (*WebRTCConnection, e
 	return connection, nil
 }
 
+// Stop disconnects every connection, including those still being
+// negotiated, carrying on past failures and returning all of them.
 func (w *WebRTCWrapper) Stop() error {
-	for k := range w.ConnectionsMap {
-		if err := w.Disconnect(w.ConnectionsMap[k]); err != nil {
-			return err
-		}
+	var errs []error
+	for _, conn := range w.connections.snapshot() {
+		errs = append(errs, w.Disconnect(conn))
 	}
-	for k := range w.InstancesMap {
-		if err := w.Disconnect(w.InstancesMap[k]); err != nil {
-			return err
-		}
-	}
-	return nil
+	return util.JoinErrors(errs)
 }
 
-func (w *WebRTCWrapper) HandleSignal(peer string, instanceID *id.InstanceID, m *message.Message, signaler *overlay.Signaler) error {
-	if util.Contains(w.DeadTimestamps, m.Timestamp) {
+// ErrStaleSignal is returned by HandleSignal for signals of a connection
+// attempt which a newer one has replaced. When both peers connect to each
+// other at once the older attempt gives way, and its remaining signals are
+// expected to arrive and be dropped.
+var ErrStaleSignal = errors.New("wrtc signal timestamp before connection timestamp")
+
+func (w *WebRTCWrapper) HandleSignal(peer string, instanceID *id.InstanceID, m *message.Message, signaler Signaler) error {
+	if w.isDeadTimestamp(m.Timestamp) {
 		return fmt.Errorf("wrtc dead timestamp in signal message")
 	}
 	conn := w.GetConnection(peer, instanceID)
-	if conn == nil {
-		return fmt.Errorf("wrtc no active connection for signal")
-	}
-	if conn.Timestamp.Before(m.Timestamp) {
-		fmt.Println("wrtc expired connection for signal message")
+	if conn != nil && conn.Timestamp.Before(m.Timestamp) {
+		// a newer attempt replaces ours, see ErrStaleSignal
 		if err := w.Disconnect(conn); err != nil {
 			return err
 		}
 		conn = nil
 	}
 	if conn != nil && m.Timestamp.Before(conn.Timestamp) {
-		return fmt.Errorf("wrtc message timestamp before connection timestamp")
-	}
-	var sdp *webrtc.SessionDescription
-	if m.Data.SDP == (webrtc.SessionDescription{}) {
-		sdp = &m.Data.SDP
+		return ErrStaleSignal
 	}
+	sdp := m.Data.SDP
 	if conn != nil && sdp != nil && sdp.Type == webrtc.SDPTypeOffer && id.ShouldYieldToID(w.ID.ID, peer) {
 		fmt.Println("wrtc collision")
 		if err := w.Disconnect(conn); err != nil {
@@ -175,7 +215,7 @@ func (w *WebRTCWrapper) HandleSignal(peer string, instanceID *id.InstanceID, m *
 			IsInitiator: false,
 			PeerID:      peer,
 			InstanceID:  instanceID,
-			Signaler:    *signaler,
+			Signaler:    signaler,
 			Timestamp:   m.Timestamp,
 		})
 		if err != nil {
@@ -193,7 +233,7 @@ func (w *WebRTCWrapper) HandleSignal(peer string, instanceID *id.InstanceID, m *
 				IsInitiator: false,
 				PeerID:      peer,
 				InstanceID:  instanceID,
-				Signaler:    *signaler,
+				Signaler:    signaler,
 				Timestamp:   m.Timestamp,
 			})
 			if err != nil {
@@ -202,34 +242,37 @@ func (w *WebRTCWrapper) HandleSignal(peer string, instanceID *id.InstanceID, m *
 			conn = newConn
 		}
 	}
+	conn.learnInstance(instanceID)
 	if sdp != nil {
+		w.transition(conn, ConnectionSignaling)
 		if err := conn.PeerConnection.SetRemoteDescription(*sdp); err != nil {
 			return fmt.Errorf("wrtc error on set remote description: %s", err.Error())
 		}
 		if sdp.Type == webrtc.SDPTypeOffer {
 			// answer the offer
-			_, err := conn.PeerConnection.CreateAnswer(nil)
+			answer, err := conn.PeerConnection.CreateAnswer(nil)
 			if err != nil {
 				return fmt.Errorf("wrtc error on create sdp answer: %s", err.Error())
 			}
 			conn.Signaler.Send(&message.Message{
 				Data: message.MessageData{
-					SDP: *conn.PeerConnection.LocalDescription(),
+					SDP: &answer,
 				},
 			})
+			if err := conn.PeerConnection.SetLocalDescription(answer); err != nil {
+				return fmt.Errorf("wrtc error on set local description: %s", err.Error())
+			}
 		}
-		for _, pending := range conn.PendingIce {
+		for _, pending := range conn.takePendingIce() {
 			if err := w.AddIce(pending, conn); err != nil {
 				return fmt.Errorf("wrtc error on add pending ice: %s", err.Error())
 			}
 		}
-		conn.PendingIce = []webrtc.ICECandidate{}
-	} else if m.Data.Candidate != (webrtc.ICECandidate{}) {
-		if conn.PeerConnection.RemoteDescription().Type == webrtc.SDPTypeOffer {
-			if err := w.AddIce(m.Data.Candidate, conn); err != nil {
+	} else if m.Data.Candidate != nil {
+		// hold candidates until we know the remote description
+		if !conn.holdIce(*m.Data.Candidate) {
+			if err := w.AddIce(*m.Data.Candidate, conn); err != nil {
 				return fmt.Errorf("wrtc error on add ice: %s", err.Error())
-			} else {
-				conn.PendingIce = append(conn.PendingIce, m.Data.Candidate)
 			}
 		}
 	}
@@ -240,10 +283,16 @@ func (w *WebRTCWrapper) AddIce(c webrtc.ICECandidate, conn *WebRTCConnection) er
 	return conn.PeerConnection.AddICECandidate(c.ToJSON())
 }
 
+// Connections returns a snapshot of every connection, open or not, in the
+// order they were started.
+func (w *WebRTCWrapper) Connections() []*WebRTCConnection {
+	return w.connections.snapshot()
+}
+
 func (w *WebRTCWrapper) OpenConnections() []*WebRTCConnection {
 	var active []*WebRTCConnection
-	for _, conn := range w.Connections {
-		if w.IsActive(conn.PeerID) {
+	for _, conn := range w.connections.snapshot() {
+		if conn.IsOpen() {
 			active = append(active, conn)
 		}
 	}
@@ -252,82 +301,94 @@ func (w *WebRTCWrapper) OpenConnections() []*WebRTCConnection {
 
 func (w *WebRTCWrapper) IsActive(peer string) bool {
 	conn := w.GetConnection(peer, nil)
-	return conn != nil && conn.Channel != nil && conn.Channel.ReadyState() == webrtc.DataChannelStateOpen
+	return conn != nil && conn.IsOpen()
+}
+
+// Instances lists the instances of peerID we are connected to, as far as
+// they are known. Several devices may share one identity, our own included.
+func (w *WebRTCWrapper) Instances(peerID string) []*id.InstanceID {
+	return w.connections.instances(peerID)
 }
 
 func (w *WebRTCWrapper) GetConnection(peerID string, instanceID *id.InstanceID) *WebRTCConnection {
-	if instanceID != nil && peerID == w.ID.ID {
-		return w.InstancesMap[instanceID.UUID]
-	} else {
-		return w.ConnectionsMap[peerID]
-	}
+	return w.connections.get(peerID, instanceID)
 }
 
+// RemoveConnection forgets conn. Of several concurrent removals, e.g. by
+// Disconnect and the channel closing, only the first has any effect.
 func (w *WebRTCWrapper) RemoveConnection(conn *WebRTCConnection) error {
-	w.DeadTimestamps = append(w.DeadTimestamps, conn.Timestamp)
-	w.Connections = append(w.Connections[:conn.Index], w.Connections[conn.Index+1:]...)
-	if w.ConnectionsMap[conn.PeerID] == conn {
-		delete(w.ConnectionsMap, conn.PeerID)
-	}
-	if w.InstancesMap[conn.InstanceID.UUID] == conn {
-		delete(w.InstancesMap, conn.InstanceID.UUID)
+	if !w.connections.remove(conn) {
+		return nil
 	}
-	if err := w.Overlay.ConnectionClosed(conn); err != nil {
-		return err
-	}
-	return w.UpdateListeners()
+	w.lock.Lock()
+	w.deadTimestamps = append(w.deadTimestamps, conn.Timestamp)
+	w.lock.Unlock()
+	w.transition(conn, ConnectionClosed)
+	return nil
 }
 
 func (w *WebRTCWrapper) Disconnect(conn *WebRTCConnection) error {
 	if conn == nil {
 		return fmt.Errorf("wrtc disconnect nil connection")
 	}
-	if conn.Channel != nil {
-		if err := conn.Channel.Close(); err != nil {
-			return fmt.Errorf("wrtc channel close error: %s", err.Error())
+	if conn.IsClosed() {
+		return nil
+	}
+	w.transition(conn, ConnectionDraining)
+	// close everything even if part of it fails, so that no connection is
+	// left half open
+	var errs []error
+	for _, channel := range conn.takeChannels() {
+		if err := channel.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("wrtc channel %s close error: %s", channel.Label(), err.Error()))
+		}
+	}
+	if channel := conn.Channel(); channel != nil {
+		if err := channel.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("wrtc channel close error: %s", err.Error()))
 		}
 	}
 	if conn.PeerConnection != nil && conn.PeerConnection.SignalingState() != webrtc.SignalingStateClosed {
 		if err := conn.PeerConnection.Close(); err != nil {
-			return fmt.Errorf("wrtc peer connection close error: %s", err.Error())
+			errs = append(errs, fmt.Errorf("wrtc peer connection close error: %s", err.Error()))
 		}
 	}
-	return w.RemoveConnection(conn)
+	errs = append(errs, w.RemoveConnection(conn))
+	return util.JoinErrors(errs)
 }
 
 func (w *WebRTCWrapper) SetupDataChannel(conn *WebRTCConnection) error {
-	conn.Channel.OnMessage(func(m webrtc.DataChannelMessage) {
-		if len(m.Data) == 0 {
+	channel := conn.Channel()
+	// frames are only used once the handshake shows the peer knows them
+	f := newFramer(w, channel, false)
+	conn.setFramer(defaultChannel, f)
+	channel.OnMessage(func(m webrtc.DataChannelMessage) {
+		data, complete, err := f.receive(m.Data)
+		if err != nil {
+			fmt.Printf("wrtc frame error: %s\n", err.Error())
 			return
 		}
-		msg := &message.Message{}
-		if err := json.Unmarshal(m.Data, msg); err != nil {
-			fmt.Printf("wrtc message parse error: %s", err.Error())
+		if !complete || len(data) == 0 {
+			return
 		}
-		if msg.Packed {
-			packed := &signer.SignedData{}
-			if err := json.Unmarshal(msg.EncodedData, packed); err != nil {
-				fmt.Printf("wrtc message parse error: %s\n", err.Error())
-			}
-			unpacked, err := signer.Unpack(packed, w.ID)
-			if err != nil {
-				fmt.Println(err.Error())
-			}
-			msg.EncodedData = []byte(unpacked.Data)
+		msg, err := message.Decode(data)
+		if err == nil {
+			err = w.verify(conn, msg)
 		}
-		if err := json.Unmarshal(msg.EncodedData, &msg.Data); err != nil {
-			fmt.Printf("wrtc message parse error: %s\n", err.Error())
+		if err != nil {
+			w.reject(conn, err)
+			return
 		}
 		switch msg.Data.Action {
 		case message.MarkUsedByPeer:
 			{
-				conn.IsUsedByPeer = true
+				w.setUsedByPeer(conn, true)
 				break
 			}
 		case message.MarkUnusedByPeer:
 			{
-				conn.IsUsedByPeer = false
-				if !conn.IsUsed {
+				w.setUsedByPeer(conn, false)
+				if !conn.IsUsed() {
 					if err := w.Disconnect(conn); err != nil {
 						fmt.Printf("wrtc disconnect channel error: %s\n", err.Error())
 					}
@@ -341,66 +402,66 @@ func (w *WebRTCWrapper) SetupDataChannel(conn *WebRTCConnection) error {
 			}
 		case message.OverlayMessage:
 			{
-				if err := w.Overlay.OnMessage(msg); err != nil {
-					fmt.Printf("wrtc overlay message handler error: %s", err.Error())
-				}
+				w.emitMessage(msg)
+			}
+		case message.Handshake:
+			{
+				w.onHello(conn, msg.Data.Protocol)
 			}
 		default:
 			fmt.Printf("wrtc unrecognized message action: %s", msg.Data.Action)
 		}
 
 	})
-	conn.Channel.OnClose(func() {
+	channel.OnClose(func() {
 		if err := w.RemoveConnection(conn); err != nil {
 			fmt.Printf("wrtc remove connection error: %s\n", err.Error())
 		}
 	})
-	if conn.Channel.ReadyState() == webrtc.DataChannelStateOpen {
-		conn.Signaler.AddConnection()
-		if err := w.UpdateListeners(); err != nil {
-			fmt.Printf("wrtc update listeners error: %s\n", err.Error())
-		}
+	if channel.ReadyState() == webrtc.DataChannelStateOpen {
+		w.onChannelOpen(conn, channel)
 	} else {
-		conn.Channel.OnOpen(func() {
-			conn.Signaler.AddConnection()
-			if err := w.UpdateListeners(); err != nil {
-				fmt.Printf("wrtc update listeners error: %s\n", err.Error())
-			}
+		channel.OnOpen(func() {
+			w.onChannelOpen(conn, channel)
 		})
 	}
-	conn.Channel.OnError(func(err error) {
+	channel.OnError(func(err error) {
 		fmt.Printf("wrtc channel error: %s", err.Error())
 	})
 	return nil
 }
 
+// onChannelOpen starts the handshake which opens conn once its data channel
+// is open.
+func (w *WebRTCWrapper) onChannelOpen(conn *WebRTCConnection, channel *webrtc.DataChannel) {
+	conn.Signaler.AddConnection()
+	w.emitEvent(Event{Type: ChannelOpened, Connection: conn, State: conn.State(), Channel: channel.Label()})
+	w.startHandshake(conn)
+}
+
 func (w *WebRTCWrapper) Send(m *message.Message) error {
-	instanceID := id.InstanceIDFromString(m.Data.FromInstance)
-	if instanceID == nil {
-		return fmt.Errorf("wrtc invalid instance id in outgoing message: %s", m.Data.FromInstance)
+	var instanceID *id.InstanceID
+	if m.Data.ToInstance != "" {
+		instanceID = id.InstanceIDFromString(m.Data.ToInstance)
+		if instanceID == nil {
+			return fmt.Errorf("wrtc invalid instance id in outgoing message: %s", m.Data.ToInstance)
+		}
 	}
 	conn := w.GetConnection(m.Data.To, instanceID)
 	if conn == nil {
-		return fmt.Errorf("wrtc no active connection for (%s, %s)", m.Data.To, instanceID.UUID)
-	}
-	if conn.Channel.ReadyState() != webrtc.DataChannelStateOpen {
-		return fmt.Errorf("wrtc channel not open")
+		return fmt.Errorf("wrtc no active connection for (%s, %s)", m.Data.To, m.Data.ToInstance)
 	}
 	m.Data.From = w.ID.ID
+	m.Data.FromInstance = w.ID.InstanceID.ID
 	m.Timestamp = time.Now()
-	bytes, err := json.Marshal(m.Data)
-	if err != nil {
-		return fmt.Errorf("wrtc message marshall error: %s", err.Error())
+	if err := signer.PackMessage(m, w.ID); err != nil {
+		return fmt.Errorf("wrtc pack error: %s", err.Error())
 	}
-	m.EncodedData = bytes
-	bytes, err = json.Marshal(m)
+	bytes, err := conn.Codec().Encode(m)
 	if err != nil {
-		return fmt.Errorf("wrtc message marshall error: %s", err.Error())
-	}
-	if err := conn.Channel.Send(bytes); err != nil {
-		return fmt.Errorf("wrtc message send error: %s", err.Error())
+		return fmt.Errorf("wrtc %s", err.Error())
 	}
-	return nil
+	return w.sendFramed(conn, defaultChannel, bytes)
 }
 
 func (w *WebRTCWrapper) SendRaw(peer string, bytes []byte) error {
@@ -408,13 +469,16 @@ func (w *WebRTCWrapper) SendRaw(peer string, bytes []byte) error {
 	if conn == nil {
 		return fmt.Errorf("wrtc no active connection for (%s)", peer)
 	}
-	if conn.Channel.ReadyState() != webrtc.DataChannelStateOpen {
-		return fmt.Errorf("wrtc channel not open")
-	}
-	if err := conn.Channel.Send(bytes); err != nil {
-		return fmt.Errorf("wrtc message send error: %s", err.Error())
+	return w.sendFramed(conn, defaultChannel, bytes)
+}
+
+// sendFramed writes data to the channel label of conn, fragmenting it if needed.
+func (w *WebRTCWrapper) sendFramed(conn *WebRTCConnection, label string, data []byte) error {
+	f := conn.framer(label)
+	if f == nil || f.channel.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("wrtc channel %s not open", label)
 	}
-	return nil
+	return f.send(data)
 }
 
 func (w *WebRTCWrapper) MarkUsed(peer string) error {
@@ -431,7 +495,7 @@ func (w *WebRTCWrapper) MarkUsed(peer string) error {
 	}); err != nil {
 		return err
 	}
-	conn.IsUsed = true
+	w.setUsed(conn, true)
 	return nil
 }
 
@@ -440,7 +504,7 @@ func (w *WebRTCWrapper) MarkUnused(peer string) error {
 	if conn == nil {
 		return fmt.Errorf("wrtc no active connection for (%s)", peer)
 	}
-	if conn.IsUsed && conn.IsUsedByPeer {
+	if conn.IsUsed() && conn.IsUsedByPeer() {
 		if err := w.Send(&message.Message{
 			Data: message.MessageData{
 				To:     peer,
@@ -450,21 +514,30 @@ func (w *WebRTCWrapper) MarkUnused(peer string) error {
 		}); err != nil {
 			return err
 		}
-		conn.IsUsed = false
+		w.setUsed(conn, false)
 	} else {
 		return w.Disconnect(conn)
 	}
 	return nil
 }
 
-func (w *WebRTCWrapper) UpdateListeners() error {
-	for _, listen := range w.Listeners {
-		listen()
+// setUsed records whether we want to keep conn, telling subscribers if that changed.
+func (w *WebRTCWrapper) setUsed(conn *WebRTCConnection, used bool) {
+	if conn.setUsed(used) {
+		w.usageChanged(conn)
+	}
+}
+
+// setUsedByPeer records whether the peer wants to keep conn, telling
+// subscribers if that changed.
+func (w *WebRTCWrapper) setUsedByPeer(conn *WebRTCConnection, used bool) {
+	if conn.setUsedByPeer(used) {
+		w.usageChanged(conn)
 	}
-	return nil
 }
 
-func (conn *WebRTCConnection) IsPending() bool {
-	iceConnState := conn.PeerConnection.ICEConnectionState()
-	return iceConnState == webrtc.ICEConnectionStateChecking || iceConnState == webrtc.ICEConnectionStateNew
+func (w *WebRTCWrapper) isDeadTimestamp(t time.Time) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return util.Contains(w.deadTimestamps, t)
 }
@@ -0,0 +1,67 @@
+package ws
+
+import (
+	"encoding/json"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
+	"github.com/matanbroner/goverlay/lib/overlay"
+	"github.com/matanbroner/goverlay/lib/wrtc"
+	"log"
+)
+
+// Signaler carries the SDP and ICE messages of one WebRTC connection through
+// the signaling server, wrapped in the Value of a signed relay message.
+type Signaler struct {
+	WebSocket  *WebSocketWrapper
+	To         string
+	ToInstance string
+	Connection *wrtc.WebRTCConnection
+}
+
+// NewSignaler creates a signaler to reach peerID, suitable for
+// wrtc.WebRTCWrapper.NewSignaler.
+func (ws *WebSocketWrapper) NewSignaler(peerID string, instanceID *id.InstanceID) overlay.Signaler {
+	s := &Signaler{
+		WebSocket: ws,
+		To:        peerID,
+	}
+	if instanceID != nil {
+		s.ToInstance = instanceID.ID
+	}
+	return s
+}
+
+func (s *Signaler) SetConnection(connection *wrtc.WebRTCConnection) {
+	s.Connection = connection
+}
+
+func (s *Signaler) IsOverlay() bool {
+	return false
+}
+
+// AddConnection confirms to the server the first time we reach the peer, so
+// that it hands us out to others as a bootstrap peer.
+func (s *Signaler) AddConnection() {
+	set := *s.WebSocket.SuccessfulFirstConnectionSet
+	if set.Contains(s.To) {
+		return
+	}
+	set.Add(s.To)
+	if err := s.WebSocket.Confirm(s.To); err != nil {
+		log.Println("ws confirm error:", err.Error())
+	}
+}
+
+func (s *Signaler) Send(m *message.Message) {
+	if s.Connection != nil {
+		m.Timestamp = s.Connection.Timestamp
+	}
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		log.Println("ws signal encode error:", err.Error())
+		return
+	}
+	if err := s.WebSocket.Send(s.To, s.ToInstance, string(bytes), true); err != nil {
+		log.Println("ws signal send error:", err.Error())
+	}
+}
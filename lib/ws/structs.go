@@ -1,5 +1,13 @@
 package ws
 
+import "time"
+
+const DefaultMaxRetrySeconds = 60
+const DefaultMaxUnconfirmed = 256
+
+// flushInterval is how often Flush checks for outstanding acknowledgements.
+const flushInterval = 50 * time.Millisecond
+
 type WebSocketConfig struct {
 	Reconnect bool
 }
@@ -1,54 +1,99 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/keepalive"
 	"github.com/matanbroner/goverlay/lib/message"
 	"github.com/matanbroner/goverlay/lib/overlay"
 	"github.com/matanbroner/goverlay/lib/signer"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/matanbroner/goverlay/lib/wrtc"
 	"log"
-	"os"
-	"os/signal"
+	"math/rand"
+	"sync"
 	"time"
 )
 
 type WebSocketWrapper struct {
-	ID                           *id.PublicKeyId
-	Overlay                      *overlay.Overlay
-	Host                         string
-	ConnectionMap                *map[string]string
-	RetrySeconds                 int
+	ID            *id.PublicKeyId
+	Overlay       *overlay.Overlay
+	Host          string
+	ConnectionMap *map[string]string
+	// RetrySeconds is the delay before the first reconnection attempt, which
+	// doubles on every failure up to MaxRetrySeconds
+	RetrySeconds    int
+	MaxRetrySeconds int
+	// MaxUnconfirmed bounds how many messages the server has yet to
+	// acknowledge are kept for resending after a reconnection
+	MaxUnconfirmed int
+	// PingInterval is how often the server is pinged, and ReadTimeout how
+	// long it may stay silent before the socket is treated as lost
+	PingInterval                 time.Duration
+	ReadTimeout                  time.Duration
 	SuccessfulFirstConnectionSet *mapset.Set[string]
-	Socket                       *websocket.Conn
-	Graceful                     bool
-	MessageOutChannel            chan message.Message
-	DoneChannel                  chan struct{}
-	InterruptChannel             chan os.Signal
+	// Replay remembers the signed messages relayed to us, to refuse them if
+	// replayed
+	Replay      *signer.ReplayCache
+	Socket      *websocket.Conn
+	Graceful    bool
+	DoneChannel chan struct{}
+
+	lock          sync.Mutex
+	state         transport.State
+	session       int
+	wake          chan struct{}
+	stop          chan struct{}
+	unconfirmed   []*outgoing
+	stateHandlers []func(state transport.State)
+	latency       time.Duration
+	// agreement is the protocol settled on with the server
+	agreement *message.Agreement
 
 	// this.webrtc = overlay.webrtc;
 	// this.webrtc = overlay.webrtc;
 	// this.onNetworkUpdate = onNetworkUpdate;
 	//	this.overlay.messageListeners.push(new OverlayMessageListener(this));
-	//	this.pingHandle = setInterval(()=> {
-	//	this.ping();
-	//}, 30 * 1000);
+}
+
+// outgoing is a message awaiting acknowledgement, along with the session it
+// was last written in.
+type outgoing struct {
+	message message.Message
+	session int
 }
 
 func NewWebSocketWrapper(o *overlay.Overlay, host string) *WebSocketWrapper {
 	connectionMap := make(map[string]string)
 	successConnectionSet := mapset.NewSet[string]()
-	return &WebSocketWrapper{
+	ws := &WebSocketWrapper{
 		ID:                           o.ID,
 		Host:                         host,
 		Overlay:                      o,
 		ConnectionMap:                &connectionMap,
 		RetrySeconds:                 1,
+		MaxRetrySeconds:              DefaultMaxRetrySeconds,
+		MaxUnconfirmed:               DefaultMaxUnconfirmed,
+		PingInterval:                 keepalive.DefaultPingInterval,
+		ReadTimeout:                  keepalive.DefaultReadTimeout,
 		SuccessfulFirstConnectionSet: &successConnectionSet,
+		Replay:                       signer.NewReplayCache(),
+		state:                        transport.StateClosed,
 	}
+	// until we have peers to signal through, connections go via the server
+	o.BootstrapSignaler = ws.NewSignaler
+	return ws
 }
 
+// Connect opens the socket to the server and announces us. Should the socket
+// later be lost, the wrapper reconnects on its own with a Reconnect message
+// and resends whatever the server had not acknowledged.
 func (ws *WebSocketWrapper) Connect(config *WebSocketConfig) error {
 	if config == nil {
 		config = &WebSocketConfig{
@@ -56,73 +101,234 @@ func (ws *WebSocketWrapper) Connect(config *WebSocketConfig) error {
 		}
 	}
 
+	ws.lock.Lock()
 	ws.Graceful = false
-	sock, _, err := websocket.DefaultDialer.Dial(ws.Host, nil)
-	if err != nil {
-		return err
-	}
-	ws.Socket = sock
-
-	ws.DoneChannel = make(chan struct{})
-	ws.MessageOutChannel = make(chan message.Message)
-	ws.InterruptChannel = make(chan os.Signal, 1)
-	signal.Notify(ws.InterruptChannel, os.Interrupt)
-
-	go func() {
-		defer close(ws.DoneChannel)
-		for {
-			_, m, err := ws.Socket.ReadMessage()
-			if err != nil {
-				log.Println("ws error:", err.Error())
-				return
-			}
-			if err := ws.onMessage(m); err != nil {
-				log.Println("ws error:", err.Error())
-				return
-			}
-		}
-	}()
-
-	go ws.handleChannels()
+	ws.stop = make(chan struct{})
+	ws.lock.Unlock()
 
 	action := message.Connect
 	if config.Reconnect {
 		action = message.Reconnect
 	}
 
-	m := message.Message{
+	ws.setState(transport.StateConnecting)
+	if err := ws.open(action); err != nil {
+		ws.setState(transport.StateClosed)
+		return err
+	}
+
+	//if (this.blockCallback) {
+	//	this.sendGetBlock();
+	//}
+
+	return nil
+}
+
+// open dials the server, sends the hello and starts a new session.
+func (ws *WebSocketWrapper) open(action string) error {
+	sock, _, err := websocket.DefaultDialer.Dial(ws.Host, nil)
+	if err != nil {
+		return err
+	}
+	hello := message.Message{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
 		Data: message.MessageData{
 			Action:       action,
 			From:         ws.ID.ID,
 			FromInstance: ws.ID.InstanceID.ID,
+			Protocol:     message.LocalHello(),
 		},
 		Packed: true,
 	}
+	if err := ws.write(sock, hello); err != nil {
+		_ = sock.Close()
+		return err
+	}
 
-	ws.MessageOutChannel <- m
+	keepalive.Start(sock, ws.ReadTimeout, func(latency time.Duration) {
+		ws.lock.Lock()
+		ws.latency = latency
+		ws.lock.Unlock()
+	})
 
-	//if (this.blockCallback) {
-	//	this.sendGetBlock();
-	//}
-
-	// TODO: handle graceful reconnection, ws.onclose -> reconnect
-	// see https://github.com/recws-org/recws
+	done := make(chan struct{})
+	wake := make(chan struct{}, 1)
+	ws.lock.Lock()
+	if ws.Graceful {
+		// Disconnect was called while we were dialing
+		ws.lock.Unlock()
+		_ = sock.Close()
+		return fmt.Errorf("ws disconnected")
+	}
+	ws.Socket = sock
+	ws.DoneChannel = done
+	ws.wake = wake
+	ws.session += 1
+	session := ws.session
+	ws.lock.Unlock()
 
+	go ws.read(sock, done)
+	go ws.handleChannels(sock, done, wake, session)
+	ws.setState(transport.StateOpen)
+	// resend anything left unacknowledged by the previous session
+	wake <- struct{}{}
 	return nil
 }
 
+func (ws *WebSocketWrapper) read(sock *websocket.Conn, done chan struct{}) {
+	for {
+		_, m, err := sock.ReadMessage()
+		if err != nil {
+			log.Println("ws error:", err.Error())
+			break
+		}
+		_ = sock.SetReadDeadline(time.Now().Add(ws.ReadTimeout))
+		if err := ws.onMessage(m); err != nil {
+			log.Println("ws error:", err.Error())
+		}
+	}
+	close(done)
+	ws.onSocketLost(sock)
+}
+
+// onSocketLost reconnects unless we disconnected on purpose.
+func (ws *WebSocketWrapper) onSocketLost(sock *websocket.Conn) {
+	ws.lock.Lock()
+	current := ws.Socket == sock
+	graceful := ws.Graceful
+	stop := ws.stop
+	ws.lock.Unlock()
+	if !current {
+		return
+	}
+	if graceful {
+		ws.setState(transport.StateClosed)
+		return
+	}
+	ws.setState(transport.StateConnecting)
+	go ws.reconnect(stop)
+}
+
+func (ws *WebSocketWrapper) reconnect(stop chan struct{}) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-stop:
+			ws.setState(transport.StateClosed)
+			return
+		case <-time.After(ws.backoff(attempt)):
+		}
+		if err := ws.open(message.Reconnect); err != nil {
+			log.Println("ws reconnect error:", err.Error())
+			continue
+		}
+		return
+	}
+}
+
+// backoff returns a jittered delay before the given reconnection attempt,
+// between half and all of the exponential delay so that many nodes losing the
+// server at once do not return in lockstep.
+func (ws *WebSocketWrapper) backoff(attempt int) time.Duration {
+	delay := time.Duration(ws.RetrySeconds) * time.Second
+	max := time.Duration(ws.MaxRetrySeconds) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Disconnect closes the socket for good, telling the server with a close
+// frame, and stops any reconnection in progress.
 func (ws *WebSocketWrapper) Disconnect() error {
-	if ws.Socket != nil {
-		if err := ws.Socket.Close(); err != nil {
+	ws.lock.Lock()
+	ws.Graceful = true
+	sock := ws.Socket
+	stop := ws.stop
+	ws.stop = nil
+	ws.lock.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	if sock != nil {
+		// control frames may be written alongside the session's writer
+		_ = sock.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		if err := sock.Close(); err != nil {
 			return err
 		}
 	}
+	ws.setState(transport.StateClosed)
+	return nil
+}
 
+// Flush waits until the server has acknowledged everything we sent, or until
+// ctx is done.
+func (ws *WebSocketWrapper) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for ws.UnconfirmedCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ws flush error: %d messages unacknowledged: %s", ws.UnconfirmedCount(), ctx.Err().Error())
+		case <-ticker.C:
+		}
+	}
 	return nil
 }
 
+// State returns the state of our connection to the server.
+func (ws *WebSocketWrapper) State() transport.State {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.state
+}
+
+// Latency returns the round trip time to the server measured by the last
+// ping, or zero before the first pong.
+func (ws *WebSocketWrapper) Latency() time.Duration {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.latency
+}
+
+// Agreement returns the protocol settled on with the server, or nil until it
+// has answered our hello.
+func (ws *WebSocketWrapper) Agreement() *message.Agreement {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return ws.agreement
+}
+
+// OnStateChange registers a handler called whenever the connection to the
+// server opens, is lost and being re-established, or is closed for good.
+func (ws *WebSocketWrapper) OnStateChange(handler func(state transport.State)) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.stateHandlers = append(ws.stateHandlers, handler)
+}
+
+func (ws *WebSocketWrapper) setState(state transport.State) {
+	ws.lock.Lock()
+	if ws.state == state {
+		ws.lock.Unlock()
+		return
+	}
+	ws.state = state
+	handlers := append([]func(transport.State){}, ws.stateHandlers...)
+	ws.lock.Unlock()
+	for _, handler := range handlers {
+		handler(state)
+	}
+}
+
 func (ws *WebSocketWrapper) Confirm(id string) error {
-	ws.MessageOutChannel <- message.Message{
+	return ws.enqueue(message.Message{
 		Data: message.MessageData{
 			Action:       message.Confirm,
 			Confirmed:    id,
@@ -130,36 +336,100 @@ func (ws *WebSocketWrapper) Confirm(id string) error {
 			FromInstance: ws.ID.InstanceID.ID,
 		},
 		Packed: true,
-	}
-	return nil
+	})
 }
 
+// Send asks the server to relay data to a peer, or to every instance of the
+// peer if toInstance is empty.
 func (ws *WebSocketWrapper) Send(to string, toInstance string, data string, packed bool) error {
-	ws.MessageOutChannel <- message.Message{
+	return ws.enqueue(message.Message{
 		Data: message.MessageData{
 			To:           to,
 			ToInstance:   toInstance,
 			From:         ws.ID.ID,
 			FromInstance: ws.ID.InstanceID.ID,
-			Data:         data,
+			Action:       message.Signal,
+			Value:        []byte(data),
 		},
-		Packed: packed,
-	}
-	return nil
+		Packed:    packed,
+		Timestamp: time.Now(),
+	})
 }
 
 func (ws *WebSocketWrapper) SendGetBlock() error {
-	ws.MessageOutChannel <- message.Message{
+	return ws.enqueue(message.Message{
 		Data: message.MessageData{
 			Action:       message.GetBlock,
 			From:         ws.ID.ID,
 			FromInstance: ws.ID.InstanceID.ID,
 		},
 		Packed: true,
+	})
+}
+
+// UnconfirmedCount returns how many sent messages the server has yet to acknowledge.
+func (ws *WebSocketWrapper) UnconfirmedCount() int {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	return len(ws.unconfirmed)
+}
+
+// enqueue holds m until the server acknowledges it, writing it now if we are
+// connected or once we have reconnected otherwise.
+func (ws *WebSocketWrapper) enqueue(m message.Message) error {
+	ws.lock.Lock()
+	if ws.stop == nil {
+		ws.lock.Unlock()
+		return fmt.Errorf("ws not connected")
+	}
+	if m.ID == "" {
+		m.ID = uuid.New().String()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	ws.unconfirmed = append(ws.unconfirmed, &outgoing{message: m})
+	if ws.MaxUnconfirmed > 0 && len(ws.unconfirmed) > ws.MaxUnconfirmed {
+		ws.unconfirmed = ws.unconfirmed[1:]
+	}
+	wake := ws.wake
+	ws.lock.Unlock()
+	select {
+	case wake <- struct{}{}:
+	default:
 	}
 	return nil
 }
 
+// unsent marks and returns the unacknowledged messages not yet written in
+// session, or nothing if session has been superseded.
+func (ws *WebSocketWrapper) unsent(session int) []message.Message {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if session != ws.session {
+		return nil
+	}
+	var messages []message.Message
+	for _, o := range ws.unconfirmed {
+		if o.session != session {
+			o.session = session
+			messages = append(messages, o.message)
+		}
+	}
+	return messages
+}
+
+func (ws *WebSocketWrapper) acknowledge(messageID string) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for i, o := range ws.unconfirmed {
+		if o.message.ID == messageID {
+			ws.unconfirmed = append(ws.unconfirmed[:i], ws.unconfirmed[i+1:]...)
+			return
+		}
+	}
+}
+
 func (ws *WebSocketWrapper) encodeRawMessage(message string, pack bool) ([]byte, error) {
 	payload := json.RawMessage(message)
 	payloadBytes, err := payload.MarshalJSON()
@@ -182,74 +452,147 @@ func (ws *WebSocketWrapper) encodeRawMessage(message string, pack bool) ([]byte,
 	}
 }
 
-func (ws *WebSocketWrapper) onMessage(m []byte) error {
-	parsed := &message.Message{}
-	if err := json.Unmarshal(m, parsed); err != nil {
+func (ws *WebSocketWrapper) onMessage(bytes []byte) error {
+	m, err := message.Decode(bytes)
+	if err != nil {
 		return err
 	}
-	if parsed.Packed {
-		packed := &signer.SignedData{}
-		if err := json.Unmarshal(parsed.EncodedData, packed); err != nil {
+	if m.Packed {
+		// signed messages come from peers through the server, which could
+		// resend them
+		if err := signer.UnpackMessage(m); err != nil {
 			return err
 		}
-		unpacked, err := signer.Unpack(packed, ws.ID)
-		if err != nil {
+		if m.Data.To != ws.ID.ID {
+			return fmt.Errorf("ws message from %s was signed for %s", id.ShortID(m.Data.From), id.ShortID(m.Data.To))
+		}
+		if err := ws.Replay.CheckMessage(m); err != nil {
 			return err
 		}
-		parsed.EncodedData = []byte(unpacked.Data)
 	}
-	if err := json.Unmarshal(parsed.EncodedData, &parsed.Data); err != nil {
-		return err
+	if m.AckID != "" {
+		ws.acknowledge(m.AckID)
+	}
+	switch m.Data.Action {
+	case message.Connect, message.Reconnect:
+		if err := ws.onWelcome(m); err != nil {
+			return err
+		}
+		if m.Data.Action == message.Connect {
+			return ws.onBootstrapPeers(m)
+		}
+	case message.GetBlock:
+		return ws.onBootstrapPeers(m)
+	case message.Incompatible:
+		// reconnecting would be refused too
+		_ = ws.Disconnect()
+		return fmt.Errorf("ws server refused our protocol: %s", string(m.Data.Value))
+	case message.Ack:
+	case message.Signal:
+		return ws.onSignal(m)
+	case message.Undeliverable:
+		log.Println("ws undeliverable:", string(m.Data.Value))
+	default:
+		return fmt.Errorf("ws unrecognized message action: %s", m.Data.Action)
 	}
-	switch parsed.Data.Action {
-	case "p":
+	return nil
+}
 
+// onWelcome settles the protocol from the server's answer to our hello,
+// giving up on servers we cannot speak with.
+func (ws *WebSocketWrapper) onWelcome(m *message.Message) error {
+	agreement, err := message.Negotiate(m.Data.Protocol)
+	if err != nil {
+		_ = ws.Disconnect()
+		return fmt.Errorf("ws handshake error: %s", err.Error())
 	}
+	ws.lock.Lock()
+	ws.agreement = agreement
+	ws.lock.Unlock()
+	return nil
+}
 
+// onBootstrapPeers connects to the peers handed out by the server.
+func (ws *WebSocketWrapper) onBootstrapPeers(m *message.Message) error {
+	var peers []message.Peer
+	if err := json.Unmarshal(m.Data.Value, &peers); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		go func(peer message.Peer) {
+			if err := ws.Overlay.Connect(peer.ID, id.InstanceIDFromString(peer.InstanceID)); err != nil {
+				log.Println("ws bootstrap connect error:", err.Error())
+			}
+		}(peer)
+	}
 	return nil
 }
 
-func (ws *WebSocketWrapper) handleChannels() {
-	ticker := time.NewTicker(time.Second)
+// onSignal passes a relayed SDP or ICE message to the WebRTC wrapper. Only
+// signed signals are accepted, since the server relays on behalf of anyone.
+func (ws *WebSocketWrapper) onSignal(m *message.Message) error {
+	if !m.Packed {
+		return fmt.Errorf("ws unsigned signal from %s", id.ShortID(m.Data.From))
+	}
+	if ws.Overlay == nil || ws.Overlay.WebRTCWrapper == nil {
+		return fmt.Errorf("ws no webrtc wrapper to signal")
+	}
+	signal := &message.Message{}
+	if err := json.Unmarshal(m.Data.Value, signal); err != nil {
+		return err
+	}
+	reply := &Signaler{
+		WebSocket:  ws,
+		To:         m.Data.From,
+		ToInstance: m.Data.FromInstance,
+	}
+	err := ws.Overlay.WebRTCWrapper.HandleSignal(m.Data.From, id.InstanceIDFromString(m.Data.FromInstance), signal, reply)
+	if errors.Is(err, wrtc.ErrStaleSignal) {
+		return nil
+	}
+	return err
+}
+
+// write packs m if needed and writes it to sock.
+func (ws *WebSocketWrapper) write(sock *websocket.Conn, m message.Message) error {
+	if m.Packed {
+		if err := signer.PackMessage(&m, ws.ID); err != nil {
+			return fmt.Errorf("ws pack error: %s", err.Error())
+		}
+	} else {
+		bytes, err := json.Marshal(m.Data)
+		if err != nil {
+			return fmt.Errorf("ws encode error: %s", err.Error())
+		}
+		m.EncodedData = bytes
+	}
+	return sock.WriteJSON(m)
+}
+
+// handleChannels is the single writer for a session, sending queued messages
+// whenever woken and pinging the server until the session's socket is lost.
+func (ws *WebSocketWrapper) handleChannels(sock *websocket.Conn, done chan struct{}, wake chan struct{}, session int) {
+	ticker := time.NewTicker(ws.PingInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ws.DoneChannel:
+		case <-done:
 			return
-		case m := <-ws.MessageOutChannel:
-			bytes, err := json.Marshal(m.Data)
-			if err != nil {
-				log.Println("ws encode error:", err.Error())
-			}
-			if m.Packed {
-				packed, err := signer.Pack(string(bytes), ws.ID.PrivateKey)
-				if err != nil {
-					log.Println("ws pack error:", err.Error())
-				}
-				packedBytes, err := json.Marshal(packed)
-				if err != nil {
-					log.Println("ws encode error:", err.Error())
-				}
-				bytes = packedBytes
-			}
-			m.EncodedData = bytes
-			if err := ws.Socket.WriteJSON(m); err != nil {
-				log.Println("ws write error:", err.Error())
+		case <-ticker.C:
+			if err := keepalive.Ping(sock, ws.PingInterval); err != nil {
+				log.Println("ws ping error:", err.Error())
+				_ = sock.Close()
 				return
 			}
-		case <-ws.InterruptChannel:
-			// Cleanly close the connection by sending a close message and then
-			// waiting (with timeout) for the server to close the connection.
-			err := ws.Socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			if err != nil {
-				log.Println("ws interrupt error:", err.Error())
-				return
-			}
-			select {
-			case <-ws.DoneChannel:
-			case <-time.After(time.Second):
+		case <-wake:
+			for _, m := range ws.unsent(session) {
+				if err := ws.write(sock, m); err != nil {
+					log.Println("ws write error:", err.Error())
+					// the read loop notices the closed socket and reconnects
+					_ = sock.Close()
+					return
+				}
 			}
-			return
 		}
 	}
 }
@@ -1,18 +1,30 @@
 package ws
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/message"
 	"github.com/matanbroner/goverlay/lib/overlay"
+	signalserver "github.com/matanbroner/goverlay/lib/signal"
+	"github.com/matanbroner/goverlay/lib/transport"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
 	// Write code here to run before tests
-	go startWsServer()
+	startWsServer()
 
 	// Run tests
 	exitVal := m.Run()
@@ -37,7 +49,15 @@ func startWsServer() {
 		}
 		log.Println("wss client connected")
 	})
-	log.Fatal(http.ListenAndServe(":9999", nil))
+	// listen before any test dials, which creating an identity no longer
+	// takes long enough to guarantee
+	listener, err := net.Listen("tcp", ":9999")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Fatal(http.Serve(listener, nil))
+	}()
 }
 
 func TestConnect(t *testing.T) {
@@ -53,3 +73,193 @@ func TestConnect(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// newTestID generates an identity with a small key, to keep tests fast.
+func newTestID(t *testing.T) *id.PublicKeyId {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid, err := id.NewPublicKeyId(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkid
+}
+
+// newVNetOverlay creates an overlay whose WebRTC traffic runs over the
+// virtual network of router, so that no real interfaces are needed.
+func newVNetOverlay(t *testing.T, router *vnet.Router, ip string) *overlay.Overlay {
+	pkid := newTestID(t)
+	vn := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+	if err := router.AddNet(vn); err != nil {
+		t.Fatal(err)
+	}
+	settings := webrtc.SettingEngine{}
+	settings.SetVNet(vn)
+	o := overlay.New(pkid)
+	o.WebRTCWrapper.API = webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+	o.WebRTCWrapper.Configuration = webrtc.Configuration{}
+	return o
+}
+
+func TestSignalerConnectsPeers(t *testing.T) {
+	server := signalserver.New()
+	addr, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "10.0.0.0/24",
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer router.Stop()
+
+	a := newVNetOverlay(t, router, "10.0.0.1")
+	b := newVNetOverlay(t, router, "10.0.0.2")
+	url := fmt.Sprintf("ws://%s/", addr.String())
+	wsA := NewWebSocketWrapper(a, url)
+	wsB := NewWebSocketWrapper(b, url)
+	if err := wsA.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer wsA.Disconnect()
+	// b is handed a as a bootstrap peer once a has registered
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Peers()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := wsB.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer wsB.Disconnect()
+
+	deadline = time.Now().Add(10 * time.Second)
+	for !(a.IsActive(b.ID.ID) && b.IsActive(a.ID.ID)) {
+		if time.Now().After(deadline) {
+			t.Fatal("peers did not connect through the signaling server")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for !(*wsB.SuccessfulFirstConnectionSet).Contains(a.ID.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not confirmed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// both ends of every link settled on the current protocol
+	assert.Equal(t, message.ProtocolVersion, wsA.Agreement().Version)
+	agreement, ok := server.Agreement(signalserver.Peer{ID: b.ID.ID, InstanceID: b.ID.InstanceID.ID})
+	assert.True(t, ok)
+	assert.Equal(t, message.ProtocolVersion, agreement.Version)
+	assert.Equal(t, message.Binary, a.WebRTCWrapper.GetConnection(b.ID.ID, nil).Codec())
+	_ = a.WebRTCWrapper.Stop()
+	_ = b.WebRTCWrapper.Stop()
+}
+
+func nextState(t *testing.T, states chan transport.State) transport.State {
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for state change")
+		return transport.StateClosed
+	}
+}
+
+func TestReconnectResumesSession(t *testing.T) {
+	server := signalserver.New()
+	addr, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkid := newTestID(t)
+	ws := NewWebSocketWrapper(overlay.New(pkid), fmt.Sprintf("ws://%s/", addr.String()))
+	states := make(chan transport.State, 8)
+	ws.OnStateChange(func(state transport.State) {
+		states <- state
+	})
+
+	if err := ws.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, transport.StateConnecting, nextState(t, states))
+	assert.Equal(t, transport.StateOpen, nextState(t, states))
+
+	assert.NoError(t, server.Shutdown())
+	assert.Equal(t, transport.StateConnecting, nextState(t, states))
+	// sent while the server is away, so held until we are back
+	assert.NoError(t, ws.Send(id.HalfMaxStr, "", "hello", true))
+	assert.Equal(t, 1, ws.UnconfirmedCount())
+
+	restarted := signalserver.New()
+	if _, err := restarted.Listen(addr.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Shutdown()
+	assert.Equal(t, transport.StateOpen, nextState(t, states))
+	assert.Eventually(t, func() bool {
+		return ws.UnconfirmedCount() == 0 && len(restarted.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, ws.Disconnect())
+	assert.Equal(t, transport.StateClosed, nextState(t, states))
+	assert.Error(t, ws.Send(id.HalfMaxStr, "", "hello", true))
+}
+
+func TestBackoff(t *testing.T) {
+	ws := &WebSocketWrapper{RetrySeconds: 1, MaxRetrySeconds: 8}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		delay := ws.backoff(attempt + 1)
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+}
+
+func TestKeepAliveMeasuresLatency(t *testing.T) {
+	server := signalserver.New()
+	addr, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+	pkid := newTestID(t)
+	ws := NewWebSocketWrapper(overlay.New(pkid), fmt.Sprintf("ws://%s/", addr.String()))
+	ws.PingInterval = 20 * time.Millisecond
+	if err := ws.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Disconnect()
+	assert.Eventually(t, func() bool {
+		return ws.Latency() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKeepAliveDetectsHalfOpenSocket(t *testing.T) {
+	pkid, err := id.NewPublicKeyId(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test server never reads, so never answers our pings
+	ws := NewWebSocketWrapper(overlay.New(pkid), "ws://localhost:9999/ws")
+	ws.PingInterval = 20 * time.Millisecond
+	ws.ReadTimeout = 100 * time.Millisecond
+	states := make(chan transport.State, 8)
+	ws.OnStateChange(func(state transport.State) {
+		states <- state
+	})
+	if err := ws.Connect(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Disconnect()
+	assert.Equal(t, transport.StateConnecting, nextState(t, states))
+	assert.Equal(t, transport.StateOpen, nextState(t, states))
+	assert.Equal(t, transport.StateConnecting, nextState(t, states))
+}
@@ -1,7 +1,51 @@
+// Command goverlay runs an overlay node which bootstraps through a signaling
+// server, leaving the network gracefully on SIGINT or SIGTERM. The id
+// subcommand creates and inspects the identity files nodes can run with.
 package main
 
-import "fmt"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/matanbroner/goverlay/lib/id"
+	"github.com/matanbroner/goverlay/lib/node"
+	"github.com/matanbroner/goverlay/lib/signer"
+	"os"
+	"os/signal"
+	"syscall"
+)
 
 func main() {
-	fmt.Println("Hello World!")
+	if len(os.Args) > 1 && os.Args[1] == "id" {
+		if err := identityMain(os.Args[2:]); err != nil {
+			fmt.Printf("goverlay id error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	host := flag.String("signal", "ws://localhost:8080/", "URL of the signaling server")
+	shutdownTimeout := flag.Duration("shutdown-timeout", node.DefaultShutdownTimeout, "how long to spend leaving the network")
+	identity := flag.String("identity", "", "file to keep the node identity in, created if missing; a fresh identity is used if empty")
+	passphraseFile := flag.String("passphrase-file", "", "file holding the identity passphrase, instead of $"+PassphraseEnv)
+	acceptUnbound := flag.Bool("accept-unbound", false, "accept messages signed without an id and timestamp, from peers which predate them")
+	flag.Parse()
+
+	signer.SetAcceptUnboundMessages(*acceptUnbound)
+
+	pkid, err := loadIdentity(*identity, *passphraseFile)
+	if err != nil {
+		fmt.Printf("goverlay id error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	n := node.New(pkid, *host)
+	n.ShutdownTimeout = *shutdownTimeout
+	fmt.Printf("goverlay node %s\n", id.ShortID(pkid.ID))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := n.Run(ctx); err != nil {
+		fmt.Printf("goverlay error: %s\n", err.Error())
+		os.Exit(1)
+	}
 }